@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/christianalexander/kvdb/stores"
+	"github.com/christianalexander/kvdb/stores/serializable"
+	"github.com/sirupsen/logrus"
+)
+
+// serveAdmin serves the administration endpoints on an address until the server fails.
+func serveAdmin(addr string, store stores.Store) {
+	mux := http.NewServeMux()
+	mux.Handle("/locks", locksHandler(store))
+
+	logrus.Infof("Serving administration on %s", addr)
+	err := http.ListenAndServe(addr, mux)
+	logrus.Errorf("Stopped serving administration: %v", err)
+}
+
+// locksHandler reports the locks held and waited for, and the wait-for graph. With '?format=dot',
+// only the graph is reported, in the Graphviz DOT language.
+func locksHandler(store stores.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inspector, ok := store.(serializable.LockInspector)
+		if !ok {
+			http.Error(w, "The store does not take locks", http.StatusNotFound)
+			return
+		}
+
+		table := inspector.Locks()
+		switch format := r.URL.Query().Get("format"); format {
+		case "", "text":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(w, table.String())
+		case "dot":
+			w.Header().Set("Content-Type", "text/vnd.graphviz")
+			io.WriteString(w, table.DOT())
+		default:
+			http.Error(w, fmt.Sprintf("Unknown format '%s': expected 'text' or 'dot'", format), http.StatusBadRequest)
+		}
+	})
+}
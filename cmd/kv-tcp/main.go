@@ -3,19 +3,26 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/christianalexander/kvdb"
 	"github.com/christianalexander/kvdb/commands"
-	"github.com/christianalexander/kvdb/protobuf"
+	"github.com/christianalexander/kvdb/internal/storage"
 	"github.com/christianalexander/kvdb/stores"
+	"github.com/christianalexander/kvdb/stores/deferred"
 	"github.com/christianalexander/kvdb/stores/serializable"
+	"github.com/christianalexander/kvdb/stores/snapshot"
 	"github.com/christianalexander/kvdb/transactors"
 
 	"github.com/sirupsen/logrus"
@@ -27,12 +34,20 @@ type contextKey struct {
 
 var ctxKeyServer = contextKey{"SERVER"}
 
-var inPath string
-var outPath string
+var storageFlags storage.Flags
+var isolation string
+var deferWrites bool
+var lockTimeout time.Duration
+var lockPolicy string
+var adminAddr string
 
 func init() {
-	flag.StringVar(&inPath, "in", "", "The path to the log input file")
-	flag.StringVar(&outPath, "out", "", "The path to the log out file")
+	storageFlags.Register(flag.CommandLine)
+	flag.StringVar(&isolation, "isolation", "serializable", "The isolation of transactions: 'serializable' (two-phase locking), 'snapshot' (MVCC) or 'ssi' (serializable snapshot isolation)")
+	flag.BoolVar(&deferWrites, "defer-writes", false, "Buffer the writes of serializable transactions until they commit, rather than writing in place and undoing them on rollback (snapshot transactions always do)")
+	flag.DurationVar(&lockTimeout, "lock-timeout", 0, "How long a serializable transaction waits for a lock before the statement fails (0 waits indefinitely). SESSION LOCK_TIMEOUT overrides it")
+	flag.StringVar(&lockPolicy, "lock-policy", string(serializable.PolicyDetect), "What a serializable transaction does when a lock it asks for is held: 'detect' (wait, aborting the youngest transaction in a deadlock), 'wait-die', 'wound-wait' or 'no-wait'")
+	flag.StringVar(&adminAddr, "admin-addr", "", "The address of an HTTP server for administration, which reports locks at /locks (disabled if empty)")
 
 	flag.Parse()
 }
@@ -49,44 +64,70 @@ func main() {
 
 	logrus.Infoln("Listening on port 8888")
 
-	store := stores.NewInMemoryStore()
-
-	if inPath != "" {
-		inFile, err := os.Open(inPath)
-		if err != nil {
-			logrus.Fatalf("Failed to open inPath file ('%s'): %v", inPath, err)
-		}
-
-		reader := protobuf.NewReader(inFile)
-		s, err := stores.FromPersistence(context.Background(), reader, store)
-		if err != nil {
-			logrus.Fatalf("Failed to read from persistence: %v", err)
-		}
+	cctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-		store = s
+	st, err := storage.Open(cctx, storageFlags)
+	if err != nil {
+		logrus.Fatalln(err)
 	}
+	defer st.Close()
+	store := st.Store
 
-	var writer stores.Writer
-	if outPath != "" {
-		outFile, err := os.OpenFile(outPath, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0664)
+	// Connections are found by their open transaction, so that a wounded transaction can be rolled back.
+	transactions := &sync.Map{}
+
+	switch isolation {
+	case "serializable":
+		policy, err := serializable.ParsePolicy(lockPolicy)
 		if err != nil {
-			logrus.Fatalf("Failed to open outPath file ('%s'): %v", outPath, err)
+			logrus.Fatalln(err)
+		}
+		if deferWrites {
+			store = deferred.NewStore(store)
 		}
+		store = serializable.NewTwoPhaseLockStore(store, serializable.Options{
+			LockTimeout: lockTimeout,
+			Policy:      policy,
+			OnWound: func(txID int64, err error) {
+				if c, ok := transactions.Load(txID); ok {
+					c.(*conn).wound(txID, err)
+				}
+			},
+		})
+	case "snapshot":
+		store = snapshot.NewStore(store)
+	case "ssi":
+		store = serializable.NewSSIStore(store)
+	default:
+		logrus.Fatalf("Unknown isolation '%s'", isolation)
+	}
+	// Transaction IDs carry on from the log, so that new records are not mistaken for those of earlier transactions.
+	transactor := transactors.New(store, st.Writer, transactors.Options{LatestTransactionID: st.Replayed.HighestTransactionID})
 
-		w := protobuf.NewWriter(outFile)
-		writer = w
-		store = stores.WithPersistence(writer, store)
+	go st.RunCheckpoints(cctx, transactor)
+	if adminAddr != "" {
+		go serveAdmin(adminAddr, store)
 	}
 
-	store = serializable.NewTwoPhaseLockStore(store)
-	transactor := transactors.New(store, writer)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGABRT)
 
-	server{store, transactor}.serve(ln.(*net.TCPListener))
+	go func() {
+		s := <-sig
+		logrus.Infof("Signal received: %s", s)
+		ln.Close()
+	}()
+
+	err = server{store, transactor, transactions}.serve(ln.(*net.TCPListener))
+	logrus.Infof("Stopped serving: %v", err)
 }
 
 type server struct {
 	store      stores.Store
 	transactor transactors.Transactor
+	// transactions maps the ID of each open transaction to its *conn.
+	transactions *sync.Map
 }
 
 func (s server) serve(l net.Listener) error {
@@ -119,10 +160,25 @@ func (s server) serve(l net.Listener) error {
 	}
 }
 
+// maxValueLength bounds the payload of a length-prefixed SETB.
+const maxValueLength = 64 << 20
+
 type conn struct {
-	nc    net.Conn
-	close chan struct{}
-	txID  int64
+	nc     net.Conn
+	reader *bufio.Reader
+	close  chan struct{}
+	srv    server
+
+	// mu guards txID against a wound, which may roll back the transaction from another goroutine
+	// while no command is executing. wounded is the error to report for the rolled back transaction.
+	mu        sync.Mutex
+	txID      int64
+	executing bool
+	wounded   error
+
+	// lockTimeout overrides -lock-timeout for the connection, and txLockTimeout for the rest of its transaction.
+	lockTimeout   *time.Duration
+	txLockTimeout *time.Duration
 }
 
 func newConn(c net.Conn) *conn {
@@ -132,16 +188,19 @@ func newConn(c net.Conn) *conn {
 func (c *conn) serve(ctx context.Context) {
 	defer c.nc.Close()
 
-	reader := bufio.NewReaderSize(c.nc, 4<<10)
+	c.reader = bufio.NewReaderSize(c.nc, 4<<10)
+	c.srv = ctx.Value(ctxKeyServer).(server)
 
 	cctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	go func() {
 		<-cctx.Done()
+		c.mu.Lock()
+		defer c.mu.Unlock()
 		if c.txID != 0 {
-			srv := ctx.Value(ctxKeyServer).(server)
-			srv.transactor.Rollback(context.WithValue(cctx, stores.ContextKeyTransactionID, c.txID))
+			c.srv.transactor.Rollback(context.WithValue(cctx, stores.ContextKeyTransactionID, c.txID))
+			c.setTxIDLocked(0)
 		}
 	}()
 
@@ -152,7 +211,7 @@ func (c *conn) serve(ctx context.Context) {
 		case <-cctx.Done():
 			return
 		default:
-			l, _, err := reader.ReadLine()
+			l, _, err := c.reader.ReadLine()
 			if err != nil {
 				if err != io.EOF {
 					logrus.Warnf("Failed to read request: %v", err)
@@ -166,6 +225,18 @@ func (c *conn) serve(ctx context.Context) {
 				continue
 			}
 
+			// A transaction wounded while the connection was idle has already been rolled back, and the
+			// command, which was meant to be part of it, is not executed.
+			c.mu.Lock()
+			wounded := c.wounded
+			c.wounded = nil
+			c.executing = wounded == nil
+			c.mu.Unlock()
+			if wounded != nil {
+				fmt.Fprintf(c.nc, "%v; the transaction was rolled back\r\n", wounded)
+				continue
+			}
+
 			cmd, err := c.GetCommand(cctx, n, p1, p2)
 			if err != nil {
 				logrus.Warnln(err)
@@ -173,10 +244,22 @@ func (c *conn) serve(ctx context.Context) {
 				return
 			}
 
-			srv := ctx.Value(ctxKeyServer).(server)
-			srv.transactor.Execute(context.WithValue(cctx, stores.ContextKeyTransactionID, c.txID), cmd)
+			err = c.srv.transactor.Execute(c.context(cctx), cmd)
+			if errors.Is(err, transactors.ErrCommitNotLogged) {
+				// The store holds writes the log does not commit, which replaying the log on restart drops.
+				logrus.Fatalf("Stopping the server: %v", err)
+			}
+			rolledBack := c.finish(cctx, err)
 			if err != nil {
 				logrus.Warnf("Failed to execute command: %v", err)
+				if rolledBack {
+					fmt.Fprintf(c.nc, "%v; the transaction was rolled back\r\n", err)
+					continue
+				}
+				if errors.Is(err, stores.ErrLockTimeout) && c.inTransaction() {
+					fmt.Fprintf(c.nc, "%v; the transaction is still open\r\n", err)
+					continue
+				}
 				fmt.Fprintf(c.nc, "%v\r\n", err)
 				continue
 			}
@@ -184,6 +267,119 @@ func (c *conn) serve(ctx context.Context) {
 	}
 }
 
+// finish ends the execution of a command, rolling back its transaction if the command failed in a way that
+// aborts it, or if the transaction was wounded meanwhile, as it holds locks other transactions are waiting for.
+func (c *conn) finish(ctx context.Context, err error) (rolledBack bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.executing = false
+	if c.txID == 0 {
+		c.wounded = nil
+		c.txLockTimeout = nil
+		return false
+	}
+	if !stores.AbortsTransaction(err) && c.wounded == nil {
+		return false
+	}
+
+	c.srv.transactor.Rollback(context.WithValue(ctx, stores.ContextKeyTransactionID, c.txID))
+	c.setTxIDLocked(0)
+	c.txLockTimeout = nil
+	if err != nil {
+		// The error reports the rollback, so the wound need not be reported again.
+		c.wounded = nil
+	}
+
+	return err != nil
+}
+
+// wound rolls back a transaction wounded by an older one, unless the transaction has already ended.
+// If a command is executing, the transaction is rolled back once it returns.
+func (c *conn) wound(txID int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.txID != txID {
+		return
+	}
+	c.wounded = err
+	if c.executing {
+		return
+	}
+
+	c.srv.transactor.Rollback(context.WithValue(context.Background(), stores.ContextKeyTransactionID, txID))
+	c.setTxIDLocked(0)
+	c.txLockTimeout = nil
+}
+
+// setTxID sets the open transaction of the connection.
+func (c *conn) setTxID(txID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.setTxIDLocked(txID)
+}
+
+// setTxIDLocked sets the open transaction of the connection. The caller must hold the lock.
+func (c *conn) setTxIDLocked(txID int64) {
+	if c.txID != 0 {
+		c.srv.transactions.Delete(c.txID)
+	}
+	c.txID = txID
+	if txID != 0 {
+		c.srv.transactions.Store(txID, c)
+	}
+}
+
+// setLockTimeout returns a command that overrides the lock timeout with a duration, or goes back to
+// -lock-timeout with DEFAULT. Within a transaction, the setting lasts until the transaction ends.
+func (c *conn) setLockTimeout(param string) (kvdb.Command, error) {
+	var timeout *time.Duration
+	if !strings.EqualFold(param, "DEFAULT") {
+		d, err := time.ParseDuration(param)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("expected 'SESSION LOCK_TIMEOUT <duration|DEFAULT>', got 'SESSION LOCK_TIMEOUT %s'", param)
+		}
+		timeout = &d
+	}
+
+	return commands.NewSetOption(c.nc, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if c.txID != 0 {
+			c.txLockTimeout = timeout
+		} else {
+			c.lockTimeout = timeout
+		}
+	}), nil
+}
+
+// inTransaction reports whether the connection has an open transaction.
+func (c *conn) inTransaction() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.txID != 0
+}
+
+// context returns the context a command is executed in, with the transaction and settings of the connection.
+func (c *conn) context(ctx context.Context) context.Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ctx = context.WithValue(ctx, stores.ContextKeyTransactionID, c.txID)
+	if c.txLockTimeout != nil {
+		return context.WithValue(ctx, stores.ContextKeyLockTimeout, *c.txLockTimeout)
+	}
+	if c.lockTimeout != nil {
+		return context.WithValue(ctx, stores.ContextKeyLockTimeout, *c.lockTimeout)
+	}
+
+	return ctx
+}
+
 func (c *conn) GetCommand(ctx context.Context, commandName, p1, p2 string) (kvdb.Command, error) {
 	switch strings.ToUpper(commandName) {
 	case "QUIT":
@@ -197,12 +393,56 @@ func (c *conn) GetCommand(ctx context.Context, commandName, p1, p2 string) (kvdb
 		}
 		srv := ctx.Value(ctxKeyServer).(server)
 		return commands.NewSet(c.nc, srv.store, p1, p2), nil
+	case "SETB":
+		length, err := strconv.Atoi(p2)
+		if p1 == "" || err != nil || length < 0 || length > maxValueLength {
+			return nil, fmt.Errorf("expected 'SETB <key> <length>' followed by the value, got 'SETB %s %s'", p1, p2)
+		}
+		value, err := c.readPayload(length)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SETB value: %v", err)
+		}
+		srv := ctx.Value(ctxKeyServer).(server)
+		return commands.NewSetBytes(c.nc, srv.store, p1, value), nil
+	case "SETEX":
+		seconds, value, _ := splitParam(p2)
+		ttl, err := strconv.Atoi(seconds)
+		if p1 == "" || value == "" || err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("expected 'SETEX <key> <seconds> <value>', got 'SETEX %s %s'", p1, p2)
+		}
+		srv := ctx.Value(ctxKeyServer).(server)
+		return commands.NewSetWithExpiry(c.nc, srv.store, p1, value, time.Duration(ttl)*time.Second), nil
+	case "EXPIRE":
+		ttl, err := strconv.Atoi(p2)
+		if p1 == "" || err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("expected 'EXPIRE <key> <seconds>', got 'EXPIRE %s %s'", p1, p2)
+		}
+		srv := ctx.Value(ctxKeyServer).(server)
+		return commands.NewExpire(c.nc, srv.store, p1, time.Duration(ttl)*time.Second), nil
+	case "PERSIST":
+		if p1 == "" {
+			return nil, fmt.Errorf("expected 'PERSIST <key>', but no key specified")
+		}
+		srv := ctx.Value(ctxKeyServer).(server)
+		return commands.NewPersist(c.nc, srv.store, p1), nil
+	case "TTL":
+		if p1 == "" {
+			return nil, fmt.Errorf("expected 'TTL <key>', but no key specified")
+		}
+		srv := ctx.Value(ctxKeyServer).(server)
+		return commands.NewTTL(c.nc, srv.store, p1), nil
 	case "GET":
 		if p1 == "" {
 			return nil, fmt.Errorf("expected 'GET <key>', but no key specified")
 		}
 		srv := ctx.Value(ctxKeyServer).(server)
 		return commands.NewGet(c.nc, srv.store, p1), nil
+	case "GETB":
+		if p1 == "" {
+			return nil, fmt.Errorf("expected 'GETB <key>', but no key specified")
+		}
+		srv := ctx.Value(ctxKeyServer).(server)
+		return commands.NewGetLengthPrefixed(c.nc, srv.store, p1), nil
 	case "DEL":
 		if p1 == "" {
 			return nil, fmt.Errorf("expected 'DEL <key>', but no key specified")
@@ -213,31 +453,88 @@ func (c *conn) GetCommand(ctx context.Context, commandName, p1, p2 string) (kvdb
 		if c.txID != 0 {
 			return nil, fmt.Errorf("cannot begin transaction within an active transaction")
 		}
+		options, err := parseTxOptions(strings.TrimSpace(p1 + " " + p2))
+		if err != nil {
+			return nil, err
+		}
 		srv := ctx.Value(ctxKeyServer).(server)
-		return commands.NewBegin(c.nc, srv.transactor, func(txID int64) {
-			c.txID = txID
-		}), nil
+		return commands.NewBegin(c.nc, srv.transactor, options, c.setTxID), nil
 	case "COMMIT":
 		if c.txID == 0 {
 			return nil, fmt.Errorf("cannot commit without a transaction")
 		}
 		srv := ctx.Value(ctxKeyServer).(server)
-		return commands.NewCommit(c.nc, srv.transactor, func(txID int64) {
-			c.txID = txID
-		}), nil
+		return commands.NewCommit(c.nc, srv.transactor, c.setTxID), nil
 	case "ROLLBACK":
 		if c.txID == 0 {
 			return nil, fmt.Errorf("cannot rollback without a transaction")
 		}
 		srv := ctx.Value(ctxKeyServer).(server)
-		return commands.NewRollback(c.nc, srv.transactor, func(txID int64) {
-			c.txID = txID
+		if strings.EqualFold(p1, "TO") {
+			name := savepointName(p2)
+			if name == "" {
+				return nil, fmt.Errorf("expected 'ROLLBACK TO [SAVEPOINT] <name>', got 'ROLLBACK %s %s'", p1, p2)
+			}
+			return commands.NewRollbackTo(c.nc, srv.transactor, name), nil
+		}
+		return commands.NewRollback(c.nc, srv.transactor, c.setTxID), nil
+	case "SESSION":
+		// Settings of the connection have a verb of their own, so that SET is left to keys.
+		if !strings.EqualFold(p1, "LOCK_TIMEOUT") {
+			return nil, fmt.Errorf("expected 'SESSION LOCK_TIMEOUT <duration|DEFAULT>', got 'SESSION %s %s'", p1, p2)
+		}
+		return c.setLockTimeout(p2)
+	case "SHOW":
+		if !strings.EqualFold(p1, "LOCKS") || p2 != "" {
+			return nil, fmt.Errorf("expected 'SHOW LOCKS', got 'SHOW %s %s'", p1, p2)
+		}
+		srv := ctx.Value(ctxKeyServer).(server)
+		return commands.NewShowLocks(c.nc, func() (string, error) {
+			inspector, ok := srv.store.(serializable.LockInspector)
+			if !ok {
+				return "", fmt.Errorf("the store does not take locks")
+			}
+			return inspector.Locks().String(), nil
 		}), nil
+	case "SAVEPOINT":
+		if p1 == "" || p2 != "" {
+			return nil, fmt.Errorf("expected 'SAVEPOINT <name>', got 'SAVEPOINT %s %s'", p1, p2)
+		}
+		if c.txID == 0 {
+			return nil, fmt.Errorf("cannot set a savepoint without a transaction")
+		}
+		srv := ctx.Value(ctxKeyServer).(server)
+		return commands.NewSavepoint(c.nc, srv.transactor, p1), nil
+	case "RELEASE":
+		name := savepointName(strings.TrimSpace(p1 + " " + p2))
+		if name == "" {
+			return nil, fmt.Errorf("expected 'RELEASE [SAVEPOINT] <name>', got 'RELEASE %s %s'", p1, p2)
+		}
+		if c.txID == 0 {
+			return nil, fmt.Errorf("cannot release a savepoint without a transaction")
+		}
+		srv := ctx.Value(ctxKeyServer).(server)
+		return commands.NewReleaseSavepoint(c.nc, srv.transactor, name), nil
 	}
 
 	return nil, fmt.Errorf("invalid command '%s'", commandName)
 }
 
+// readPayload reads a value of the given length and the CRLF that terminates it.
+func (c *conn) readPayload(length int) ([]byte, error) {
+	buf := make([]byte, length+2)
+	_, err := io.ReadFull(c.reader, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if buf[length] != '\r' || buf[length+1] != '\n' {
+		return nil, fmt.Errorf("value of length %d was not followed by CRLF", length)
+	}
+
+	return buf[:length], nil
+}
+
 func parseCommandLine(line string) (commandName, p1, p2 string, ok bool) {
 	s1 := strings.Index(line, " ")
 	s2 := strings.Index(line[s1+1:], " ")
@@ -250,3 +547,59 @@ func parseCommandLine(line string) (commandName, p1, p2 string, ok bool) {
 	s2 += s1 + 1
 	return line[:s1], line[s1+1 : s2], line[s2+1:], true
 }
+
+// savepointName returns the name of a savepoint given as '<name>' or 'SAVEPOINT <name>', or "" if there is none.
+func savepointName(param string) string {
+	first, rest, ok := splitParam(param)
+	if !ok && strings.EqualFold(first, "SAVEPOINT") {
+		return ""
+	}
+	if !ok {
+		return first
+	}
+	if !strings.EqualFold(first, "SAVEPOINT") || strings.Contains(rest, " ") {
+		return ""
+	}
+
+	return rest
+}
+
+// parseTxOptions parses the options of 'BEGIN [ISOLATION LEVEL <level>] [READ ONLY | READ WRITE]'.
+func parseTxOptions(params string) (transactors.TxOptions, error) {
+	var options transactors.TxOptions
+	words := strings.Fields(strings.ToUpper(params))
+	for len(words) > 0 {
+		switch {
+		case len(words) >= 2 && words[0] == "READ" && words[1] == "ONLY":
+			options.ReadOnly = true
+			words = words[2:]
+		case len(words) >= 2 && words[0] == "READ" && words[1] == "WRITE":
+			options.ReadOnly = false
+			words = words[2:]
+		case len(words) >= 3 && words[0] == "ISOLATION" && words[1] == "LEVEL":
+			// SERIALIZABLE is the only level named by a single word.
+			n := 4
+			if words[2] == string(stores.IsolationSerializable) || len(words) < n {
+				n = 3
+			}
+			level, err := stores.ParseIsolationLevel(strings.Join(words[2:n], " "))
+			if err != nil {
+				return options, err
+			}
+			options.Isolation = level
+			words = words[n:]
+		default:
+			return options, fmt.Errorf("expected 'BEGIN [ISOLATION LEVEL <level>] [READ ONLY | READ WRITE]', got 'BEGIN %s'", params)
+		}
+	}
+
+	return options, nil
+}
+
+func splitParam(param string) (first, rest string, ok bool) {
+	i := strings.Index(param, " ")
+	if i < 0 {
+		return param, "", false
+	}
+	return param[:i], param[i+1:], true
+}
@@ -1,14 +1,32 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 
+	"github.com/christianalexander/kvdb"
+	"github.com/christianalexander/kvdb/commands"
 	"github.com/christianalexander/kvdb/stores"
+	"github.com/christianalexander/kvdb/transactors"
 	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
 )
 
+// execute executes a command, stopping the server if its writes were applied but could not be
+// committed in the log, as the store then holds writes that replaying the log on restart drops.
+func execute(ctx context.Context, transactor transactors.Transactor, command kvdb.Command) error {
+	err := transactor.Execute(ctx, command)
+	if errors.Is(err, transactors.ErrCommitNotLogged) {
+		logrus.Fatalf("Stopping the server: %v", err)
+	}
+
+	return err
+}
+
 func GetGetHandler(store stores.Store) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -25,18 +43,28 @@ func GetGetHandler(store stores.Store) http.Handler {
 	})
 }
 
-func GetSetHandler(store stores.Store) http.Handler {
+func GetSetHandler(store stores.Store, transactor transactors.Transactor) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		key := vars["Key"]
 
+		var ttl time.Duration
+		if v := r.URL.Query().Get("ttl"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, fmt.Sprintf("Invalid ttl '%s': expected a positive duration such as '30s'", v), http.StatusBadRequest)
+				return
+			}
+			ttl = d
+		}
+
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Failed to read body: %v", err), http.StatusBadRequest)
 			return
 		}
 
-		err = store.Set(r.Context(), key, string(body))
+		err = execute(r.Context(), transactor, commands.NewSetWithExpiry(ioutil.Discard, store, key, string(body), ttl))
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Failed to set value: %v", err), http.StatusInternalServerError)
 			return
@@ -48,12 +76,12 @@ func GetSetHandler(store stores.Store) http.Handler {
 	})
 }
 
-func GetDeleteHandler(store stores.Store) http.Handler {
+func GetDeleteHandler(store stores.Store, transactor transactors.Transactor) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		key := vars["Key"]
 
-		err := store.Delete(r.Context(), key)
+		err := execute(r.Context(), transactor, commands.NewDelete(ioutil.Discard, store, key))
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Failed to delete value: %v", err), http.StatusInternalServerError)
 			return
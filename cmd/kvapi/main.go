@@ -9,21 +9,18 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/christianalexander/kvdb/protobuf"
-
 	"github.com/christianalexander/kvdb/cmd/kvapi/handlers"
-	"github.com/christianalexander/kvdb/stores"
+	"github.com/christianalexander/kvdb/internal/storage"
+	"github.com/christianalexander/kvdb/transactors"
 	"github.com/sirupsen/logrus"
 
 	"github.com/gorilla/mux"
 )
 
-var inPath string
-var outPath string
+var storageFlags storage.Flags
 
 func init() {
-	flag.StringVar(&inPath, "in", "", "The path to the log input file")
-	flag.StringVar(&outPath, "out", "", "The path to the log out file")
+	storageFlags.Register(flag.CommandLine)
 
 	flag.Parse()
 }
@@ -33,44 +30,29 @@ func main() {
 
 	cctx, cancel := context.WithCancel(context.Background())
 
-	store := stores.NewInMemoryStore()
-
-	if inPath != "" {
-		inFile, err := os.Open(inPath)
-		if err != nil {
-			logrus.Fatalf("Failed to open inPath file ('%s'): %v", inPath, err)
-		}
-
-		reader := protobuf.NewReader(inFile)
-		s, err := stores.FromPersistence(cctx, reader, store)
-		if err != nil {
-			logrus.Fatalf("Failed to read from persistence: %v", err)
-		}
-
-		store = s
+	st, err := storage.Open(cctx, storageFlags)
+	if err != nil {
+		logrus.Fatalln(err)
 	}
+	defer st.Close()
+	store := st.Store
 
-	if outPath != "" {
-		outFile, err := os.OpenFile(outPath, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0664)
-		if err != nil {
-			logrus.Fatalf("Failed to open outPath file ('%s'): %v", outPath, err)
-		}
-
-		writer := protobuf.NewWriter(outFile)
-		store = stores.WithPersistence(writer, store)
-	}
+	// Transaction IDs carry on from the log, so that new records are not mistaken for those of earlier transactions.
+	transactor := transactors.New(store, st.Writer, transactors.Options{LatestTransactionID: st.Replayed.HighestTransactionID})
+	go st.RunCheckpoints(cctx, transactor)
 
 	r := mux.NewRouter()
 
 	r.Handle("/{Key}", handlers.GetGetHandler(store)).Methods(http.MethodGet)
-	r.Handle("/{Key}", handlers.GetSetHandler(store)).Methods(http.MethodPut, http.MethodPost)
-	r.Handle("/{Key}", handlers.GetDeleteHandler(store)).Methods(http.MethodDelete)
+	r.Handle("/{Key}", handlers.GetSetHandler(store, transactor)).Methods(http.MethodPut, http.MethodPost)
+	r.Handle("/{Key}", handlers.GetDeleteHandler(store, transactor)).Methods(http.MethodDelete)
 
 	srv := http.Server{Handler: r, Addr: ":3001"}
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGABRT)
 
+	stopped := make(chan struct{})
 	go func() {
 		s := <-sig
 		logrus.Infof("Signal received: %s", s)
@@ -80,8 +62,13 @@ func main() {
 		tctx, cancel := context.WithTimeout(context.Background(), time.Second)
 		srv.RegisterOnShutdown(cancel)
 		srv.Shutdown(tctx)
+		close(stopped)
 	}()
 
 	logrus.Infoln("Listening on port 3001")
-	logrus.Fatal(srv.ListenAndServe())
+	err = srv.ListenAndServe()
+	if err != http.ErrServerClosed {
+		logrus.Fatal(err)
+	}
+	<-stopped
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/christianalexander/kvdb/stores"
+	"github.com/christianalexander/kvdb/wal"
+	"github.com/sirupsen/logrus"
+)
+
+func compact(args []string) error {
+	flags := flag.NewFlagSet("compact", flag.ExitOnError)
+	out := flags.String("out", "", "The directory to write the compacted log to, which must not hold a log")
+	path, logFormat, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		return fmt.Errorf("compact needs -out")
+	}
+	if _, err := os.Stat(filepath.Join(*out, "MANIFEST")); err == nil {
+		return fmt.Errorf("'%s' already holds a log", *out)
+	}
+
+	ctx := context.Background()
+	store := stores.NewInMemoryStore()
+	result, format, err := replay(ctx, path, logFormat, store)
+	if err != nil {
+		return err
+	}
+
+	// The compacted log is a lone checkpoint, holding the latest committed value of every live key.
+	to, err := wal.Open(*out, wal.Options{Format: format})
+	if err != nil {
+		return err
+	}
+
+	err = to.Checkpoint(func(w io.Writer) error {
+		return stores.WriteCheckpoint(ctx, store, format.NewWriter(w), result.LastTransactionID)
+	})
+	if cerr := to.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write compacted log: %v", err)
+	}
+
+	logrus.Infof("Compacted '%s' into '%s'", path, *out)
+	return nil
+}
+
+// replay loads the committed state of the log at a path into a store, returning the format the log is in.
+func replay(ctx context.Context, path string, format wal.Format, store stores.Store) (stores.ReplayResult, wal.Format, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return stores.ReplayResult{}, "", err
+	}
+
+	if info.IsDir() {
+		log, err := wal.Open(path, wal.Options{ReadOnly: true})
+		if err != nil {
+			return stores.ReplayResult{}, "", err
+		}
+		defer log.Close()
+
+		result, err := wal.Replay(ctx, log, store, stores.ReplayOptions{})
+		return result, log.Format(), err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return stores.ReplayResult{}, "", err
+	}
+	defer f.Close()
+
+	result, err := stores.Replay(ctx, format.NewReader(f), store, stores.ReplayOptions{})
+	return result, format, err
+}
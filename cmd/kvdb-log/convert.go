@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/christianalexander/kvdb/wal"
+	"github.com/sirupsen/logrus"
+)
+
+func convert(args []string) error {
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	to := flags.String("to", "", "The format to convert to: 'protobuf' or 'json'")
+	out := flags.String("out", "", "The data directory or file to write the converted log to")
+	path, logFormat, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		return fmt.Errorf("convert needs -out")
+	}
+	format, err := wal.ParseFormat(*to)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	// A data directory is copied file by file, keeping its checkpoint and segments.
+	if info.IsDir() {
+		err = wal.Convert(path, *out, format)
+	} else {
+		err = convertFile(path, logFormat, *out, format)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to convert '%s': %v", path, err)
+	}
+
+	logrus.Infof("Converted '%s' to %s in '%s'", path, format, *out)
+	return nil
+}
+
+func convertFile(path string, from wal.Format, out string, to wal.Format) error {
+	if _, err := os.Stat(out); err == nil {
+		return fmt.Errorf("'%s' already exists", out)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return wal.ConvertFile(context.Background(), from.NewReader(f), out, to)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/christianalexander/kvdb/jsonl"
+	"github.com/christianalexander/kvdb/stores"
+)
+
+func dump(args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	format := flags.String("format", "text", "The output format: 'text' or 'json'")
+	path, logFormat, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+
+	print, err := newPrinter(*format, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	return eachRecord(path, logFormat, func(file string, r stores.Record) error {
+		return print(r)
+	})
+}
+
+// newPrinter returns a function that prints records in a format.
+func newPrinter(format string, w io.Writer) (func(r stores.Record) error, error) {
+	switch format {
+	case "text":
+		return func(r stores.Record) error {
+			_, err := fmt.Fprintln(w, r.String())
+			return err
+		}, nil
+	case "json":
+		writer := jsonl.NewWriter(w)
+		return func(r stores.Record) error {
+			return writer.Write(context.Background(), r)
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown format '%s': expected 'text' or 'json'", format)
+}
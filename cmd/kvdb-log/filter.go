@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/christianalexander/kvdb/stores"
+)
+
+func filter(args []string) error {
+	flags := flag.NewFlagSet("filter", flag.ExitOnError)
+	prefix := flags.String("prefix", "", "Print the records of keys with this prefix")
+	txID := flags.Int64("tx", 0, "Print the records of this transaction, including its commit")
+	format := flags.String("format", "text", "The output format: 'text' or 'json'")
+	path, logFormat, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+	if *prefix == "" && *txID == 0 {
+		return fmt.Errorf("filter needs -prefix, -tx or both")
+	}
+
+	print, err := newPrinter(*format, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	return eachRecord(path, logFormat, func(file string, r stores.Record) error {
+		if *prefix != "" && (r.Key == "" || !strings.HasPrefix(r.Key, *prefix)) {
+			return nil
+		}
+		if *txID != 0 && (r.TransactionID != *txID || r.Kind == stores.RecordKindCheckpoint) {
+			return nil
+		}
+
+		return print(r)
+	})
+}
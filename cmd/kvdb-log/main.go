@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/christianalexander/kvdb/stores"
+	"github.com/christianalexander/kvdb/wal"
+	"github.com/sirupsen/logrus"
+)
+
+const usage = `Usage: kvdb-log <command> [flags] <path>
+
+<path> is a data directory, whose checkpoint and segments are read in order, or a single log file.
+
+Commands:
+  dump     Print every record
+  stats    Count records per kind and list open transactions
+  verify   Report framing errors and uncommitted transactions
+  compact  Write a minimal log holding only the latest value of each key
+  filter   Print the records of a key prefix or transaction
+  convert  Copy a log into another format
+`
+
+type command func(args []string) error
+
+var commands = map[string]command{
+	"dump":    dump,
+	"stats":   stats,
+	"verify":  verify,
+	"compact": compact,
+	"filter":  filter,
+	"convert": convert,
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	err := cmd(os.Args[2:])
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+}
+
+// parse parses the flags of a command, which must be followed by a single path. It returns
+// the path and the format to read a single log file in.
+func parse(flags *flag.FlagSet, args []string) (string, wal.Format, error) {
+	logFormat := flags.String("log-format", string(wal.FormatProtobuf), "The format of a single log file: 'protobuf' or 'json'. A data directory records its own format")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: kvdb-log %s [flags] <path>\n", flags.Name())
+		flags.PrintDefaults()
+	}
+
+	err := flags.Parse(args)
+	if err != nil {
+		return "", "", err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return "", "", fmt.Errorf("expected a single path, got %d", flags.NArg())
+	}
+
+	format, err := wal.ParseFormat(*logFormat)
+	if err != nil {
+		return "", "", err
+	}
+
+	return flags.Arg(0), format, nil
+}
+
+// logFiles returns the files of the log at a path, which is a data directory or a single file, and their format.
+func logFiles(path string, format wal.Format) ([]string, wal.Format, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if !info.IsDir() {
+		return []string{path}, format, nil
+	}
+
+	return wal.ListFiles(path)
+}
+
+// eachRecord calls fn with every record of the log at a path, stopping at the first that can not be read.
+func eachRecord(path string, format wal.Format, fn func(file string, r stores.Record) error) error {
+	files, format, err := logFiles(path, format)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		err := eachFileRecord(file, format, func(r stores.Record) error {
+			return fn(file, r)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func eachFileRecord(file string, format wal.Format, fn func(r stores.Record) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	records := make(chan stores.Record)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- format.NewReader(f).Read(context.Background(), records)
+		close(records)
+	}()
+
+	// Records are drained after fn fails, so that the reader is not left blocked.
+	for r := range records {
+		if err == nil {
+			err = fn(r)
+		}
+	}
+	if rerr := <-errs; rerr != io.EOF && err == nil {
+		err = fmt.Errorf("%s: %v", file, rerr)
+	}
+
+	return err
+}
+
+// transactions tracks which transactions have records but no commit or abort yet.
+type transactions map[int64]int
+
+func (t transactions) add(r stores.Record) {
+	switch {
+	case r.Kind == stores.RecordKindCommit || r.Kind == stores.RecordKindAbort:
+		delete(t, r.TransactionID)
+	case r.Kind != stores.RecordKindCheckpoint && r.TransactionID != 0:
+		t[r.TransactionID]++
+	}
+}
+
+// open returns the IDs of the open transactions in order.
+func (t transactions) open() []int64 {
+	ids := make([]int64, 0, len(t))
+	for id := range t {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/christianalexander/kvdb/stores"
+	"github.com/christianalexander/kvdb/wal"
+)
+
+// writeLog writes records to a new data directory and returns its path.
+func writeLog(t *testing.T, records []stores.Record) string {
+	t.Helper()
+
+	dir := filepath.Join(t.TempDir(), "data")
+	l, err := wal.Open(dir, wal.Options{})
+	if err != nil {
+		t.Fatalf("open log: %v", err)
+	}
+	defer l.Close()
+
+	w := l.Format().NewWriter(l)
+	for _, r := range records {
+		if err := w.Write(context.Background(), r); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	return dir
+}
+
+// testLog holds a committed, an aborted and an open transaction, and a write outside any transaction.
+var testLog = []stores.Record{
+	{Kind: stores.RecordKindSet, Key: "user:1", Value: "ann", TransactionID: 1},
+	{Kind: stores.RecordKindSet, Key: "user:2", Value: "bob", TransactionID: 2},
+	{Kind: stores.RecordKindCommit, TransactionID: 1},
+	{Kind: stores.RecordKindAbort, TransactionID: 2},
+	{Kind: stores.RecordKindSet, Key: "order:1", Value: "x"},
+	{Kind: stores.RecordKindSet, Key: "user:1", Value: "cat", TransactionID: 3},
+}
+
+// run runs a command, returning what it printed.
+func run(t *testing.T, cmd command, args ...string) (string, error) {
+	t.Helper()
+
+	f, err := ioutil.TempFile(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatalf("create stdout: %v", err)
+	}
+	defer f.Close()
+
+	stdout := os.Stdout
+	os.Stdout = f
+	err = cmd(args)
+	os.Stdout = stdout
+
+	if _, serr := f.Seek(0, io.SeekStart); serr != nil {
+		t.Fatalf("seek stdout: %v", serr)
+	}
+	out, rerr := ioutil.ReadAll(f)
+	if rerr != nil {
+		t.Fatalf("read stdout: %v", rerr)
+	}
+
+	return string(out), err
+}
+
+func lines(out string) []string {
+	return strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+}
+
+func TestDump(t *testing.T) {
+	dir := writeLog(t, testLog)
+
+	out, err := run(t, dump, dir)
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	var want []string
+	for _, r := range testLog {
+		want = append(want, r.String())
+	}
+	if got := lines(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("dump: got %q, want %q", got, want)
+	}
+
+	// JSON output can be read back as a log of its own.
+	out, err = run(t, dump, "-format", "json", dir)
+	if err != nil {
+		t.Fatalf("dump as json: %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "log.jsonl")
+	if err := ioutil.WriteFile(file, []byte(out), 0664); err != nil {
+		t.Fatalf("write dump: %v", err)
+	}
+	again, err := run(t, dump, "-log-format", "json", file)
+	if err != nil || !reflect.DeepEqual(lines(again), want) {
+		t.Errorf("dump of the json dump: got %q, %v, want %q", lines(again), err, want)
+	}
+}
+
+func TestStats(t *testing.T) {
+	out, err := run(t, stats, writeLog(t, testLog))
+	if err != nil {
+		t.Fatalf("stats: %v", err)
+	}
+
+	for _, want := range []string{
+		"Records: 6\n",
+		"  ABORT      1\n",
+		"  COMMIT     1\n",
+		"  SET        4\n",
+		"Distinct keys: 3\n",
+		"Committed transactions: 1\n",
+		"Aborted transactions: 1\n",
+		"Open transactions: 1\n  3 (1 records)\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("stats is missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	dir := writeLog(t, testLog)
+
+	for name, tc := range map[string]struct {
+		args []string
+		want []stores.Record
+	}{
+		"prefix":      {[]string{"-prefix", "user:"}, []stores.Record{testLog[0], testLog[1], testLog[5]}},
+		"transaction": {[]string{"-tx", "2"}, []stores.Record{testLog[1], testLog[3]}},
+		"both":        {[]string{"-prefix", "user:1", "-tx", "3"}, []stores.Record{testLog[5]}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			out, err := run(t, filter, append(tc.args, dir)...)
+			if err != nil {
+				t.Fatalf("filter: %v", err)
+			}
+			var want []string
+			for _, r := range tc.want {
+				want = append(want, r.String())
+			}
+			if got := lines(out); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+
+	if _, err := run(t, filter, dir); err == nil {
+		t.Errorf("filter without a prefix or transaction succeeded")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	if out, err := run(t, verify, writeLog(t, testLog[:5])); err != nil {
+		t.Errorf("verify of a complete log: %v\n%s", err, out)
+	}
+
+	// Transaction 3 has no commit or abort.
+	out, err := run(t, verify, writeLog(t, testLog))
+	if err == nil || !strings.Contains(out, "Transaction 3 has 1 records but no commit or abort") {
+		t.Errorf("verify of a log with an open transaction: got %v\n%s", err, out)
+	}
+
+	dir := writeLog(t, testLog[:5])
+	files, _, err := wal.ListFiles(dir)
+	if err != nil || len(files) == 0 {
+		t.Fatalf("list files: %v, %v", files, err)
+	}
+	segment := files[len(files)-1]
+	contents, err := ioutil.ReadFile(segment)
+	if err != nil {
+		t.Fatalf("read segment: %v", err)
+	}
+	contents[len(contents)/2] ^= 0xff
+	if err := ioutil.WriteFile(segment, contents, 0664); err != nil {
+		t.Fatalf("write segment: %v", err)
+	}
+	out, err = run(t, verify, dir)
+	if err == nil || !strings.Contains(out, segment+": ") || strings.Contains(out, segment+": 5 valid records\n") {
+		t.Errorf("verify of a corrupt log: got %v\n%s", err, out)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := writeLog(t, testLog)
+	out := filepath.Join(t.TempDir(), "compacted")
+
+	if _, err := run(t, compact, "-out", out, dir); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+
+	// Only committed values are kept, and they are all held by the checkpoint.
+	printed, err := run(t, dump, out)
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	want := []string{
+		"SET:0:order:1:x",
+		"SET:0:user:1:ann",
+		"CHECKPOINT:1::",
+	}
+	if got := lines(printed); !reflect.DeepEqual(got, want) {
+		t.Errorf("compacted log: got %q, want %q", got, want)
+	}
+
+	if _, err := run(t, compact, "-out", out, dir); err == nil {
+		t.Errorf("compacting into a directory that holds a log succeeded")
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+
+	"github.com/christianalexander/kvdb/stores"
+)
+
+func stats(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	path, logFormat, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+
+	kinds := make(map[stores.RecordKind]int)
+	keys := make(map[string]bool)
+	txs := make(transactions)
+	committed := 0
+	aborted := 0
+	total := 0
+
+	err = eachRecord(path, logFormat, func(file string, r stores.Record) error {
+		total++
+		kinds[r.Kind]++
+		if r.Key != "" {
+			keys[r.Key] = true
+		}
+		switch r.Kind {
+		case stores.RecordKindCommit:
+			committed++
+		case stores.RecordKindAbort:
+			aborted++
+		}
+		txs.add(r)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(kinds))
+	for k := range kinds {
+		names = append(names, string(k))
+	}
+	sort.Strings(names)
+
+	fmt.Printf("Records: %d\n", total)
+	for _, k := range names {
+		fmt.Printf("  %-10s %d\n", k, kinds[stores.RecordKind(k)])
+	}
+	fmt.Printf("Distinct keys: %d\n", len(keys))
+	fmt.Printf("Committed transactions: %d\n", committed)
+	fmt.Printf("Aborted transactions: %d\n", aborted)
+
+	open := txs.open()
+	fmt.Printf("Open transactions: %d\n", len(open))
+	for _, id := range open {
+		fmt.Printf("  %d (%d records)\n", id, txs[id])
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/christianalexander/kvdb/stores"
+	"github.com/christianalexander/kvdb/wal"
+)
+
+func verify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	path, logFormat, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+
+	files, format, err := logFiles(path, logFormat)
+	if err != nil {
+		return err
+	}
+
+	problems := 0
+	for _, file := range files {
+		records, corruption, err := verifyFile(file, format)
+		if err != nil {
+			return err
+		}
+		if corruption != nil {
+			fmt.Printf("%s: %d valid records, then a %v\n", file, records, corruption)
+			problems++
+			continue
+		}
+		fmt.Printf("%s: %d valid records\n", file, records)
+	}
+	if problems > 0 {
+		return fmt.Errorf("found %d corrupt files", problems)
+	}
+
+	txs := make(transactions)
+	err = eachRecord(path, format, func(file string, r stores.Record) error {
+		txs.add(r)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The newest transactions may still have been open when the log was read, rather than abandoned.
+	open := txs.open()
+	for _, id := range open {
+		fmt.Printf("Transaction %d has %d records but no commit or abort\n", id, txs[id])
+	}
+	if len(open) > 0 {
+		return fmt.Errorf("found %d uncommitted transactions", len(open))
+	}
+
+	return nil
+}
+
+func verifyFile(file string, format wal.Format) (int, *stores.Corruption, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return format.Verify(f, info.Size())
+}
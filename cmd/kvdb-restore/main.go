@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/christianalexander/kvdb/internal/storage"
+	"github.com/christianalexander/kvdb/stores"
+	"github.com/christianalexander/kvdb/wal"
+	"github.com/sirupsen/logrus"
+)
+
+var dataDir string
+var outDir string
+var untilTransactionID int64
+var untilTime string
+
+func init() {
+	flag.StringVar(&dataDir, "data-dir", "", "The directory of the log to restore from, which is not changed")
+	flag.StringVar(&outDir, "out", "", "The directory to write the restored log to, which must not hold a log")
+	flag.Int64Var(&untilTransactionID, "until-tx", 0, "Restore the state from just before a transaction committed")
+	flag.StringVar(&untilTime, "until-time", "", "Restore the state from just before an RFC 3339 time")
+
+	flag.Parse()
+}
+
+func main() {
+	if dataDir == "" || outDir == "" {
+		logrus.Fatalln("Both -data-dir and -out are required")
+	}
+
+	options, err := storage.ReplayOptions(untilTransactionID, untilTime)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(outDir, "MANIFEST")); err == nil {
+		logrus.Fatalf("'%s' already holds a log", outDir)
+	}
+
+	from, err := wal.Open(dataDir, wal.Options{ReadOnly: true})
+	if err != nil {
+		logrus.Fatalf("Failed to open log: %v", err)
+	}
+
+	to, err := wal.Open(outDir, wal.Options{})
+	if err != nil {
+		logrus.Fatalf("Failed to create restored log: %v", err)
+	}
+	defer to.Close()
+
+	result, err := wal.Restore(context.Background(), from, to, stores.NewInMemoryStore(), options)
+	if err != nil {
+		logrus.Fatalf("Failed to restore: %v", err)
+	}
+
+	if result.StoppedAt != nil {
+		logrus.Infof("Restored '%s' into '%s' as of before %s at %s", dataDir, outDir, result.StoppedAt, result.StoppedAt.Timestamp.Format(time.RFC3339Nano))
+	} else {
+		logrus.Infof("Restored all of '%s' into '%s'", dataDir, outDir)
+	}
+}
@@ -8,3 +8,10 @@ type Command interface {
 	Undo(ctx context.Context) error
 	ShouldAutoTransact() bool
 }
+
+// A ReadOnlyCommand is a Command that may report that it only reads. A transaction that executes
+// nothing but reads has no writes to commit, so nothing is written to the log for it.
+type ReadOnlyCommand interface {
+	Command
+	ReadOnly() bool
+}
@@ -13,12 +13,13 @@ import (
 type begin struct {
 	writer     io.Writer
 	transactor transactors.Transactor
+	options    transactors.TxOptions
 	setTxID    func(int64)
 }
 
 // Execute satisfies the command interface.
 func (q begin) Execute(ctx context.Context) error {
-	txID, err := q.transactor.Begin(ctx)
+	txID, err := q.transactor.BeginTx(ctx, q.options)
 	if err == nil {
 		q.writer.Write([]byte("OK\r\n"))
 		logrus.Printf("Begin setting txid to %d", txID)
@@ -36,7 +37,7 @@ func (q begin) ShouldAutoTransact() bool {
 	return false
 }
 
-// NewBegin creates a new begin command.
-func NewBegin(writer io.Writer, transactor transactors.Transactor, setTxID func(int64)) kvdb.Command {
-	return begin{writer, transactor, setTxID}
+// NewBegin creates a new begin command, which begins a transaction with options.
+func NewBegin(writer io.Writer, transactor transactors.Transactor, options transactors.TxOptions, setTxID func(int64)) kvdb.Command {
+	return begin{writer, transactor, options, setTxID}
 }
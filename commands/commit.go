@@ -18,11 +18,12 @@ type commit struct {
 
 // Execute satisfies the command interface.
 func (q commit) Execute(ctx context.Context) error {
+	// A transaction that fails to commit has been rolled back, so it is over either way.
 	err := q.transactor.Commit(ctx)
 	if err == nil {
 		q.writer.Write([]byte("OK\r\n"))
-		q.setTxID(0)
 	}
+	q.setTxID(0)
 
 	return err
 }
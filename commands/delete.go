@@ -3,6 +3,7 @@ package commands
 import (
 	"context"
 	"io"
+	"time"
 
 	"github.com/christianalexander/kvdb"
 	"github.com/christianalexander/kvdb/stores"
@@ -10,18 +11,25 @@ import (
 
 // delete is a command that Deletes a value from the store.
 type delete struct {
-	writer        io.Writer
-	store         stores.Store
-	key           string
-	previousValue string
+	writer         io.Writer
+	store          stores.Store
+	key            string
+	previousValue  string
+	hadPrevious    bool
+	previousExpiry time.Time
 }
 
 // Execute satisfies the command interface.
 func (q *delete) Execute(ctx context.Context) error {
-	val, _ := q.store.Get(ctx, q.key)
-	q.previousValue = val
+	val, err := q.store.Get(ctx, q.key)
+	if isLockError(err) {
+		return err
+	}
+	// Whether the key existed is kept apart from its value, which may be empty.
+	q.previousValue, q.hadPrevious = val, err == nil
+	q.previousExpiry, _ = q.store.Expiry(ctx, q.key)
 
-	err := q.store.Delete(ctx, q.key)
+	err = q.store.Delete(ctx, q.key)
 	if err == nil {
 		q.writer.Write([]byte("OK\r\n"))
 	}
@@ -30,10 +38,16 @@ func (q *delete) Execute(ctx context.Context) error {
 }
 
 func (q *delete) Undo(ctx context.Context) error {
-	if q.previousValue != "" {
-		return q.store.Set(ctx, q.key, q.previousValue)
+	if !q.hadPrevious {
+		return nil
+	}
+
+	err := q.store.Set(ctx, q.key, q.previousValue)
+	if err != nil || q.previousExpiry.IsZero() {
+		return err
 	}
-	return nil
+
+	return q.store.Expire(ctx, q.key, q.previousExpiry)
 }
 
 func (q delete) ShouldAutoTransact() bool {
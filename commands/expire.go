@@ -0,0 +1,67 @@
+package commands
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/christianalexander/kvdb"
+	"github.com/christianalexander/kvdb/stores"
+)
+
+// expire is a command that changes when a key expires.
+type expire struct {
+	writer         io.Writer
+	store          stores.Store
+	key            string
+	ttl            time.Duration
+	previousExpiry time.Time
+}
+
+// Execute satisfies the command interface.
+func (q *expire) Execute(ctx context.Context) error {
+	previous, err := q.store.Expiry(ctx, q.key)
+	if err != nil {
+		return err
+	}
+	q.previousExpiry = previous
+
+	var at time.Time
+	if q.ttl > 0 {
+		at = time.Now().Add(q.ttl)
+	}
+
+	err = q.store.Expire(ctx, q.key, at)
+	if err == nil {
+		q.writer.Write([]byte("OK\r\n"))
+	}
+
+	return err
+}
+
+func (q *expire) Undo(ctx context.Context) error {
+	return q.store.Expire(ctx, q.key, q.previousExpiry)
+}
+
+func (q expire) ShouldAutoTransact() bool {
+	return true
+}
+
+// NewExpire creates a new command that expires a key after ttl.
+func NewExpire(writer io.Writer, store stores.Store, key string, ttl time.Duration) kvdb.Command {
+	return &expire{
+		writer: writer,
+		store:  store,
+		key:    key,
+		ttl:    ttl,
+	}
+}
+
+// NewPersist creates a new command that removes the expiry from a key.
+func NewPersist(writer io.Writer, store stores.Store, key string) kvdb.Command {
+	return &expire{
+		writer: writer,
+		store:  store,
+		key:    key,
+	}
+}
@@ -14,11 +14,33 @@ type get struct {
 	writer io.Writer
 	store  stores.Store
 	key    string
+
+	// lengthPrefixed writes the value as '$<length>\r\n<value>\r\n', so it may contain any bytes.
+	lengthPrefixed bool
 }
 
 // Execute satisfies the command interface.
 func (q get) Execute(ctx context.Context) error {
+	if q.lengthPrefixed {
+		val, err := stores.GetBytes(ctx, q.store, q.key)
+		if isLockError(err) {
+			return err
+		}
+		if err != nil {
+			q.writer.Write([]byte("$-1\r\n"))
+			return nil
+		}
+
+		fmt.Fprintf(q.writer, "$%d\r\n", len(val))
+		q.writer.Write(append(val, '\r', '\n'))
+		return nil
+	}
+
 	val, err := q.store.Get(ctx, q.key)
+	if isLockError(err) {
+		return err
+	}
+
 	if err != nil {
 		q.writer.Write([]byte("\r\n"))
 		return nil
@@ -36,7 +58,17 @@ func (q get) ShouldAutoTransact() bool {
 	return true
 }
 
+// ReadOnly satisfies the kvdb.ReadOnlyCommand interface.
+func (q get) ReadOnly() bool {
+	return true
+}
+
 // NewGet creates a new get command.
 func NewGet(writer io.Writer, store stores.Store, key string) kvdb.Command {
-	return get{writer, store, key}
+	return get{writer: writer, store: store, key: key}
+}
+
+// NewGetLengthPrefixed creates a new get command that writes a binary-safe, length-prefixed response.
+func NewGetLengthPrefixed(writer io.Writer, store stores.Store, key string) kvdb.Command {
+	return get{writer: writer, store: store, key: key, lengthPrefixed: true}
 }
@@ -0,0 +1,13 @@
+package commands
+
+import (
+	"errors"
+
+	"github.com/christianalexander/kvdb/stores"
+)
+
+// isLockError reports whether a read failed because a lock could not be taken, rather than because
+// the key is missing. Such a failure is returned, so that the transaction can be rolled back.
+func isLockError(err error) bool {
+	return stores.AbortsTransaction(err) || errors.Is(err, stores.ErrLockTimeout)
+}
@@ -0,0 +1,102 @@
+package commands
+
+import (
+	"context"
+	"io"
+
+	"github.com/christianalexander/kvdb"
+	"github.com/christianalexander/kvdb/transactors"
+)
+
+// savepoint is a command that marks a point in a transaction to roll back to.
+type savepoint struct {
+	writer     io.Writer
+	transactor transactors.Transactor
+	name       string
+}
+
+// Execute satisfies the command interface.
+func (q savepoint) Execute(ctx context.Context) error {
+	err := q.transactor.Savepoint(ctx, q.name)
+	if err == nil {
+		q.writer.Write([]byte("OK\r\n"))
+	}
+
+	return err
+}
+
+// Undo does nothing, as a savepoint does not change the store.
+func (q savepoint) Undo(ctx context.Context) error {
+	return nil
+}
+
+func (q savepoint) ShouldAutoTransact() bool {
+	return false
+}
+
+// NewSavepoint creates a new savepoint command.
+func NewSavepoint(writer io.Writer, transactor transactors.Transactor, name string) kvdb.Command {
+	return savepoint{writer, transactor, name}
+}
+
+// rollbackTo is a command that undoes a transaction back to a savepoint.
+type rollbackTo struct {
+	writer     io.Writer
+	transactor transactors.Transactor
+	name       string
+}
+
+// Execute satisfies the command interface.
+func (q rollbackTo) Execute(ctx context.Context) error {
+	err := q.transactor.RollbackToSavepoint(ctx, q.name)
+	if err == nil {
+		q.writer.Write([]byte("OK\r\n"))
+	}
+
+	return err
+}
+
+// Undo does nothing, as the commands it rolled back are gone from the transaction.
+func (q rollbackTo) Undo(ctx context.Context) error {
+	return nil
+}
+
+func (q rollbackTo) ShouldAutoTransact() bool {
+	return false
+}
+
+// NewRollbackTo creates a new command to roll back to a savepoint.
+func NewRollbackTo(writer io.Writer, transactor transactors.Transactor, name string) kvdb.Command {
+	return rollbackTo{writer, transactor, name}
+}
+
+// releaseSavepoint is a command that forgets a savepoint.
+type releaseSavepoint struct {
+	writer     io.Writer
+	transactor transactors.Transactor
+	name       string
+}
+
+// Execute satisfies the command interface.
+func (q releaseSavepoint) Execute(ctx context.Context) error {
+	err := q.transactor.ReleaseSavepoint(ctx, q.name)
+	if err == nil {
+		q.writer.Write([]byte("OK\r\n"))
+	}
+
+	return err
+}
+
+// Undo does nothing, as releasing a savepoint does not change the store.
+func (q releaseSavepoint) Undo(ctx context.Context) error {
+	return nil
+}
+
+func (q releaseSavepoint) ShouldAutoTransact() bool {
+	return false
+}
+
+// NewReleaseSavepoint creates a new command to release a savepoint.
+func NewReleaseSavepoint(writer io.Writer, transactor transactors.Transactor, name string) kvdb.Command {
+	return releaseSavepoint{writer, transactor, name}
+}
@@ -3,6 +3,7 @@ package commands
 import (
 	"context"
 	"io"
+	"time"
 
 	"github.com/christianalexander/kvdb"
 	"github.com/christianalexander/kvdb/stores"
@@ -14,14 +15,31 @@ type set struct {
 	writer                    io.Writer
 	store                     stores.Store
 	key, value, previousValue string
+	hadPrevious               bool
+	// valueBytes is set for a value given as bytes, which is set through the store's byte path.
+	valueBytes     []byte
+	ttl            time.Duration
+	previousExpiry time.Time
 }
 
 // Execute satisfies the command interface.
 func (q *set) Execute(ctx context.Context) error {
-	val, _ := q.store.Get(ctx, q.key)
-	q.previousValue = val
+	val, err := q.store.Get(ctx, q.key)
+	if isLockError(err) {
+		return err
+	}
+	// Whether the key existed is kept apart from its value, which may be empty.
+	q.previousValue, q.hadPrevious = val, err == nil
+	q.previousExpiry, _ = q.store.Expiry(ctx, q.key)
 
-	err := q.store.Set(ctx, q.key, q.value)
+	if q.valueBytes != nil {
+		err = stores.SetBytes(ctx, q.store, q.key, q.valueBytes)
+	} else {
+		err = q.store.Set(ctx, q.key, q.value)
+	}
+	if err == nil && q.ttl > 0 {
+		err = q.store.Expire(ctx, q.key, time.Now().Add(q.ttl))
+	}
 	if err == nil {
 		q.writer.Write([]byte("OK\r\n"))
 	}
@@ -31,11 +49,16 @@ func (q *set) Execute(ctx context.Context) error {
 
 func (q *set) Undo(ctx context.Context) error {
 	logrus.Print(q.previousValue)
-	if q.previousValue == "" {
+	if !q.hadPrevious {
 		return q.store.Delete(ctx, q.key)
 	}
 
-	return q.store.Set(ctx, q.key, q.previousValue)
+	err := q.store.Set(ctx, q.key, q.previousValue)
+	if err != nil || q.previousExpiry.IsZero() {
+		return err
+	}
+
+	return q.store.Expire(ctx, q.key, q.previousExpiry)
 }
 
 func (q set) ShouldAutoTransact() bool {
@@ -51,3 +74,24 @@ func NewSet(writer io.Writer, store stores.Store, key, value string) kvdb.Comman
 		value:  value,
 	}
 }
+
+// NewSetBytes creates a new set command for a value held as bytes, which may contain any bytes.
+func NewSetBytes(writer io.Writer, store stores.Store, key string, value []byte) kvdb.Command {
+	return &set{
+		writer:     writer,
+		store:      store,
+		key:        key,
+		valueBytes: value,
+	}
+}
+
+// NewSetWithExpiry creates a new set command for a key that expires after ttl.
+func NewSetWithExpiry(writer io.Writer, store stores.Store, key, value string, ttl time.Duration) kvdb.Command {
+	return &set{
+		writer: writer,
+		store:  store,
+		key:    key,
+		value:  value,
+		ttl:    ttl,
+	}
+}
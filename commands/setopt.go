@@ -0,0 +1,36 @@
+package commands
+
+import (
+	"context"
+	"io"
+
+	"github.com/christianalexander/kvdb"
+)
+
+// setOption is a command that changes a setting of the connection.
+type setOption struct {
+	writer io.Writer
+	apply  func()
+}
+
+// Execute satisfies the command interface.
+func (q setOption) Execute(ctx context.Context) error {
+	q.apply()
+	q.writer.Write([]byte("OK\r\n"))
+
+	return nil
+}
+
+// Undo does nothing, as a setting is not part of the store.
+func (q setOption) Undo(ctx context.Context) error {
+	return nil
+}
+
+func (q setOption) ShouldAutoTransact() bool {
+	return false
+}
+
+// NewSetOption creates a new command that changes a setting with apply.
+func NewSetOption(writer io.Writer, apply func()) kvdb.Command {
+	return setOption{writer, apply}
+}
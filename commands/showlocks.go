@@ -0,0 +1,42 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/christianalexander/kvdb"
+)
+
+// showLocks is a command that reports the locks held and waited for by transactions.
+// The report spans several lines, so it is written as '$<length>\r\n<report>\r\n'.
+type showLocks struct {
+	writer io.Writer
+	locks  func() (string, error)
+}
+
+// Execute satisfies the command interface.
+func (q showLocks) Execute(ctx context.Context) error {
+	report, err := q.locks()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(q.writer, "$%d\r\n%s\r\n", len(report), report)
+
+	return nil
+}
+
+func (q showLocks) Undo(ctx context.Context) error {
+	return nil
+}
+
+func (q showLocks) ShouldAutoTransact() bool {
+	return false
+}
+
+// NewShowLocks creates a new command that writes the report returned by locks, which is left to
+// the caller so that commands does not depend on a store that takes locks.
+func NewShowLocks(writer io.Writer, locks func() (string, error)) kvdb.Command {
+	return showLocks{writer, locks}
+}
@@ -0,0 +1,59 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/christianalexander/kvdb"
+	"github.com/christianalexander/kvdb/stores"
+)
+
+// ttl is a command that reports the seconds remaining before a key expires.
+// It writes -1 for a key without an expiry and -2 for a key that does not exist.
+type ttl struct {
+	writer io.Writer
+	store  stores.Store
+	key    string
+}
+
+// Execute satisfies the command interface.
+func (q ttl) Execute(ctx context.Context) error {
+	at, err := q.store.Expiry(ctx, q.key)
+	if isLockError(err) {
+		return err
+	}
+	if err != nil {
+		fmt.Fprint(q.writer, "-2\r\n")
+		return nil
+	}
+
+	if at.IsZero() {
+		fmt.Fprint(q.writer, "-1\r\n")
+		return nil
+	}
+
+	remaining := math.Ceil(time.Until(at).Seconds())
+	fmt.Fprintf(q.writer, "%d\r\n", int64(remaining))
+	return nil
+}
+
+func (q ttl) Undo(ctx context.Context) error {
+	return nil
+}
+
+func (q ttl) ShouldAutoTransact() bool {
+	return true
+}
+
+// ReadOnly satisfies the kvdb.ReadOnlyCommand interface.
+func (q ttl) ReadOnly() bool {
+	return true
+}
+
+// NewTTL creates a new ttl command.
+func NewTTL(writer io.Writer, store stores.Store, key string) kvdb.Command {
+	return ttl{writer, store, key}
+}
@@ -0,0 +1,229 @@
+// Package storage opens the storage engine and the log of a server from its command-line flags,
+// so that every server is configured, replayed and restored the same way.
+package storage
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/christianalexander/kvdb/stores"
+	"github.com/christianalexander/kvdb/stores/bitcask"
+	"github.com/christianalexander/kvdb/stores/lsm"
+	"github.com/christianalexander/kvdb/wal"
+	"github.com/sirupsen/logrus"
+)
+
+// Flags configure the storage engine and the log.
+type Flags struct {
+	DataDir            string
+	SegmentSize        int64
+	SegmentAge         time.Duration
+	SweepInterval      time.Duration
+	Engine             string
+	EngineDir          string
+	Repair             bool
+	Fsync              string
+	LogFormat          string
+	CheckpointInterval time.Duration
+	UntilTransactionID int64
+	UntilTime          string
+	RestoreFrom        string
+}
+
+// Register defines the flags on a flag set.
+func (f *Flags) Register(fs *flag.FlagSet) {
+	fs.StringVar(&f.DataDir, "data-dir", "", "The directory of the log, which is replayed on startup (no log is kept if empty)")
+	fs.Int64Var(&f.SegmentSize, "segment-size", 64<<20, "The size in bytes at which a new log segment is started")
+	fs.DurationVar(&f.SegmentAge, "segment-age", 0, "How long a log segment is written to before a new one is started (0 disables rotation by age)")
+	fs.DurationVar(&f.SweepInterval, "sweep-interval", time.Second, "How often expired keys are reclaimed")
+	fs.StringVar(&f.Engine, "engine", "memory", "The storage engine: 'memory', 'lsm' or 'bitcask'")
+	fs.StringVar(&f.EngineDir, "engine-dir", "data", "The directory used by on-disk storage engines")
+	fs.StringVar(&f.Fsync, "fsync", string(wal.SyncAlways), "When the log is synced to disk: 'always' (before each commit returns), 'everysec' or 'none'")
+	fs.StringVar(&f.LogFormat, "log-format", string(wal.FormatProtobuf), "The format of the log: 'protobuf' or 'json' (one line of JSON per record). An existing log must already be in it")
+	fs.BoolVar(&f.Repair, "repair", false, "Truncate the log at corruption found before its end, losing the records after it")
+	fs.DurationVar(&f.CheckpointInterval, "checkpoint-interval", 0, "How often a checkpoint is written and the log segments it covers deleted (0 disables checkpoints)")
+	fs.Int64Var(&f.UntilTransactionID, "until-tx", 0, "Restore the state from just before a transaction committed, with -restore-from")
+	fs.StringVar(&f.UntilTime, "until-time", "", "Restore the state from just before an RFC 3339 time, with -restore-from")
+	fs.StringVar(&f.RestoreFrom, "restore-from", "", "The directory of the log to restore from, which is not changed; the restored log is written to -data-dir")
+}
+
+// Storage is a storage engine, and the log it was replayed from and is written to.
+type Storage struct {
+	// Engine is the storage engine without the log, of which checkpoints are taken.
+	Engine stores.Store
+	// Store is the engine, writing to the log if there is one.
+	Store stores.Store
+	// Log and Writer are nil if there is no log.
+	Log    wal.Log
+	Writer stores.Writer
+	// Replayed is what replaying the log found.
+	Replayed stores.ReplayResult
+
+	checkpointInterval time.Duration
+	closers            []io.Closer
+}
+
+// Open opens the storage engine and replays the log into it, or restores it from another log to a
+// point in time. Expired keys are swept until the context ends.
+func Open(ctx context.Context, f Flags) (*Storage, error) {
+	if err := f.validate(); err != nil {
+		return nil, err
+	}
+	options, err := ReplayOptions(f.UntilTransactionID, f.UntilTime)
+	if err != nil {
+		return nil, err
+	}
+
+	engine, err := OpenEngine(f.Engine, f.EngineDir)
+	if err != nil {
+		return nil, err
+	}
+	s := &Storage{Engine: engine, Store: engine, checkpointInterval: f.CheckpointInterval}
+	if disk, ok := engine.(stores.DiskStore); ok {
+		s.closers = append(s.closers, disk)
+	}
+
+	if f.DataDir != "" {
+		if err := s.openLog(ctx, f, options); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	if remover, ok := engine.(stores.ExpiredRemover); ok {
+		go stores.SweepExpired(ctx, remover, f.SweepInterval)
+	}
+
+	return s, nil
+}
+
+func (f Flags) validate() error {
+	pointInTime := f.UntilTransactionID != 0 || f.UntilTime != ""
+	if f.CheckpointInterval > 0 && f.DataDir == "" {
+		return fmt.Errorf("checkpoints require -data-dir")
+	}
+	if pointInTime && (f.DataDir == "" || f.Engine != "memory") {
+		// On-disk engines already hold the latest state, which replaying less of the log can not undo.
+		return fmt.Errorf("point-in-time recovery requires -data-dir and the memory engine")
+	}
+	if pointInTime != (f.RestoreFrom != "") {
+		return fmt.Errorf("-restore-from and one of -until-tx or -until-time must be given together")
+	}
+	if f.RestoreFrom != "" {
+		// The log restored from is left untouched, so that the records after the point in time are not lost.
+		if _, err := os.Stat(filepath.Join(f.DataDir, "MANIFEST")); err == nil {
+			return fmt.Errorf("'%s' already holds a log; point-in-time recovery writes the restored log to a new -data-dir", f.DataDir)
+		}
+	}
+
+	return nil
+}
+
+// openLog opens the log in -data-dir, and replays or restores it into the engine.
+func (s *Storage) openLog(ctx context.Context, f Flags, options stores.ReplayOptions) error {
+	log, err := wal.Open(f.DataDir, wal.Options{MaxSegmentSize: f.SegmentSize, MaxSegmentAge: f.SegmentAge, Repair: f.Repair, Format: wal.Format(f.LogFormat)})
+	if err != nil {
+		return fmt.Errorf("failed to open log: %v", err)
+	}
+	s.closers = append(s.closers, log)
+
+	if f.RestoreFrom == "" {
+		s.Replayed, err = wal.Replay(ctx, log, s.Engine, stores.ReplayOptions{})
+	} else {
+		s.Replayed, err = restore(ctx, f.RestoreFrom, f.DataDir, log, s.Engine, options)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read from persistence: %v", err)
+	}
+
+	w, err := wal.NewSyncWriter(log.Format().NewWriter(log), log, wal.SyncPolicy(f.Fsync))
+	if err != nil {
+		return fmt.Errorf("failed to configure log durability: %v", err)
+	}
+	s.closers = append(s.closers, w)
+
+	s.Log = log
+	s.Writer = w
+	s.Store = stores.WithPersistence(w, s.Engine)
+
+	return nil
+}
+
+// restore replays the log in a directory up to a point in time, then checkpoints the restored state into a new log.
+func restore(ctx context.Context, fromDir, toDir string, to wal.Log, store stores.Store, options stores.ReplayOptions) (stores.ReplayResult, error) {
+	from, err := wal.Open(fromDir, wal.Options{ReadOnly: true})
+	if err != nil {
+		return stores.ReplayResult{}, err
+	}
+	defer from.Close()
+
+	replayed, err := wal.Restore(ctx, from, to, store, options)
+	if err == nil && replayed.StoppedAt != nil {
+		logrus.Infof("Restored '%s' into '%s' as of before %s at %s", fromDir, toDir, replayed.StoppedAt, replayed.StoppedAt.Timestamp.Format(time.RFC3339Nano))
+	}
+
+	return replayed, err
+}
+
+// RunCheckpoints takes a checkpoint every -checkpoint-interval until the context ends, holding off
+// the transactions of the quiescer while it does. It does nothing if checkpoints are disabled.
+func (s *Storage) RunCheckpoints(ctx context.Context, quiescer wal.Quiescer) {
+	if s.checkpointInterval <= 0 {
+		return
+	}
+
+	wal.RunCheckpoints(ctx, s.Log, quiescer, s.Engine, s.checkpointInterval)
+}
+
+// Close syncs and closes the log, then closes the engine.
+func (s *Storage) Close() error {
+	var err error
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		if cerr := s.closers[i].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// ReplayOptions returns the options that replay a log up to a transaction ID or an RFC 3339 time.
+func ReplayOptions(untilTransactionID int64, untilTime string) (stores.ReplayOptions, error) {
+	options := stores.ReplayOptions{UntilTransactionID: untilTransactionID}
+	if untilTime != "" {
+		t, err := time.Parse(time.RFC3339Nano, untilTime)
+		if err != nil {
+			return stores.ReplayOptions{}, fmt.Errorf("invalid -until-time '%s': %v", untilTime, err)
+		}
+		options.UntilTime = t
+	}
+
+	return options, nil
+}
+
+// OpenEngine opens a storage engine by name, with its files in a directory if it keeps them on disk.
+func OpenEngine(engine, dir string) (stores.Store, error) {
+	switch engine {
+	case "memory":
+		return stores.NewInMemoryStore(), nil
+	case "lsm":
+		store, err := lsm.Open(dir, lsm.Options{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to open LSM store: %v", err)
+		}
+		return store, nil
+	case "bitcask":
+		store, err := bitcask.Open(dir, bitcask.Options{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to open bitcask store: %v", err)
+		}
+		return store, nil
+	}
+
+	return nil, fmt.Errorf("unknown storage engine '%s'", engine)
+}
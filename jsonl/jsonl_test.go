@@ -0,0 +1,113 @@
+package jsonl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/christianalexander/kvdb/stores"
+)
+
+var testRecords = []stores.Record{
+	{Kind: stores.RecordKindSet, Key: "a", Value: "1", TransactionID: 1, Timestamp: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+	{Kind: stores.RecordKindCommit, TransactionID: 1},
+	{Kind: stores.RecordKindSet, Key: "b", Value: "line\nbreak \"quoted\""},
+	{Kind: stores.RecordKindSet, Key: "c", Value: "\xff\x00binary"},
+	{Kind: stores.RecordKindExpire, Key: "b", ExpiresAt: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)},
+	{Kind: stores.RecordKindAbort, TransactionID: 2},
+}
+
+// writeLog returns the lines of records, and the offset each one starts at.
+func writeLog(t *testing.T, records []stores.Record) ([]byte, []int64) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var offsets []int64
+	for _, r := range records {
+		offsets = append(offsets, int64(buf.Len()))
+		if err := w.Write(context.Background(), r); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	return buf.Bytes(), offsets
+}
+
+func TestRoundTrip(t *testing.T) {
+	log, _ := writeLog(t, testRecords)
+	if n := bytes.Count(log, []byte("\n")); n != len(testRecords) {
+		t.Fatalf("got %d lines, want one for each record", n)
+	}
+
+	br := bufio.NewReader(bytes.NewReader(log))
+	for i, want := range testRecords {
+		got, err := ReadRecord(br)
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if got.Kind != want.Kind || got.Key != want.Key || got.Value != want.Value || got.TransactionID != want.TransactionID ||
+			!got.ExpiresAt.Equal(want.ExpiresAt) || !got.Timestamp.Equal(want.Timestamp) {
+			t.Errorf("record %d: got %s, want %s", i, got, want)
+		}
+	}
+	if _, err := ReadRecord(br); err != io.EOF {
+		t.Errorf("read past the last record: got %v, want %v", err, io.EOF)
+	}
+}
+
+func TestReadRecord(t *testing.T) {
+	line, _ := writeLog(t, testRecords[:1])
+
+	// Blank lines are skipped.
+	if r, err := ReadRecord(bufio.NewReader(strings.NewReader("\n  \n" + string(line)))); err != nil || r.Key != "a" {
+		t.Errorf("record after blank lines: got %s, %v", r, err)
+	}
+
+	// Every prefix of a line, as a crash part-way through its write could leave, is truncated.
+	for n := 1; n < len(line); n++ {
+		_, err := ReadRecord(bufio.NewReader(bytes.NewReader(line[:n])))
+		if !errors.Is(err, ErrTruncated) {
+			t.Errorf("line cut to %d of %d bytes: got %v, want %v", n, len(line), err, ErrTruncated)
+		}
+	}
+
+	for _, bad := range []string{"{\"kind\":\"SET\"\n", "{\"kind\":\"NOPE\",\"key\":\"a\"}\n"} {
+		if _, err := ReadRecord(bufio.NewReader(strings.NewReader(bad))); err == nil || errors.Is(err, ErrTruncated) {
+			t.Errorf("%q: got %v, want a corrupt record", bad, err)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	log, offsets := writeLog(t, testRecords)
+
+	records, corruption, err := Verify(bytes.NewReader(log), int64(len(log)))
+	if err != nil || corruption != nil || records != len(testRecords) {
+		t.Errorf("intact log: got %d records, %v, %v", records, corruption, err)
+	}
+
+	torn := log[:len(log)-3]
+	records, corruption, err = Verify(bytes.NewReader(torn), int64(len(torn)))
+	last := offsets[len(offsets)-1]
+	if err != nil || corruption == nil || !corruption.Torn() || corruption.Offset != last || records != len(testRecords)-1 {
+		t.Errorf("torn log: got %d records, %v, %v, want a torn record at offset %d", records, corruption, err, last)
+	}
+
+	// A corrupt line in the middle of the log is followed by valid records, so it is not a torn write.
+	middle := append([]byte(nil), log...)
+	middle[offsets[2]] = '['
+	records, corruption, err = Verify(bytes.NewReader(middle), int64(len(middle)))
+	if err != nil || corruption == nil || corruption.Torn() {
+		t.Fatalf("corrupt log: got %d records, %v, %v, want a corrupt record", records, corruption, err)
+	}
+	if records != 2 || corruption.Offset != offsets[2] || corruption.Resume != offsets[3] {
+		t.Errorf("corrupt log: got %d records and corruption at %d resuming at %d, want 2 at %d resuming at %d",
+			records, corruption.Offset, corruption.Resume, offsets[2], offsets[3])
+	}
+}
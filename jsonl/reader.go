@@ -0,0 +1,80 @@
+package jsonl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/christianalexander/kvdb/stores"
+)
+
+type jsonReader struct {
+	reader io.Reader
+}
+
+// NewReader creates a reader of records written as lines of JSON.
+func NewReader(reader io.Reader) stores.Reader {
+	return jsonReader{reader}
+}
+
+func (r jsonReader) Read(ctx context.Context, records chan<- stores.Record) error {
+	br := bufio.NewReader(r.reader)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			record, err := ReadRecord(br)
+			if err != nil {
+				return err
+			}
+
+			records <- record
+		}
+	}
+}
+
+// ErrTruncated is returned for a record that ends before its line break.
+var ErrTruncated = errors.New("record is truncated")
+
+// ReadRecord reads a single record from a line of JSON, skipping blank lines. It returns io.EOF if there are no more records.
+func ReadRecord(r *bufio.Reader) (stores.Record, error) {
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return stores.Record{}, io.EOF
+		}
+		if err == io.EOF {
+			return stores.Record{}, fmt.Errorf("failed to read from record file: %w", ErrTruncated)
+		}
+		if err != nil {
+			return stores.Record{}, fmt.Errorf("failed to read from record file: %v", err)
+		}
+
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		return decodeLine(line)
+	}
+}
+
+func decodeLine(line []byte) (stores.Record, error) {
+	var record Record
+	err := json.Unmarshal(line, &record)
+	if err != nil {
+		return stores.Record{}, fmt.Errorf("failed to unmarshal record: %v", err)
+	}
+
+	r, err := record.ToRecord()
+	if err != nil {
+		return stores.Record{}, err
+	}
+
+	return *r, nil
+}
@@ -0,0 +1,71 @@
+package jsonl
+
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/christianalexander/kvdb/stores"
+)
+
+// A Record is how a record is written as a line of JSON. Unset fields are left out.
+type Record struct {
+	Kind          stores.RecordKind `json:"kind"`
+	TransactionID int64             `json:"transactionId,omitempty"`
+	Key           string            `json:"key,omitempty"`
+	Value         string            `json:"value,omitempty"`
+	ValueBytes    []byte            `json:"valueBytes,omitempty"`
+	ExpiresAt     *time.Time        `json:"expiresAt,omitempty"`
+	Timestamp     *time.Time        `json:"timestamp,omitempty"`
+}
+
+func RecordToJSON(r stores.Record) Record {
+	record := Record{
+		Kind:          r.Kind,
+		TransactionID: r.TransactionID,
+		Key:           r.Key,
+		Value:         r.Value,
+	}
+	if !r.ExpiresAt.IsZero() {
+		expiresAt := r.ExpiresAt.UTC()
+		record.ExpiresAt = &expiresAt
+	}
+	if !r.Timestamp.IsZero() {
+		timestamp := r.Timestamp.UTC()
+		record.Timestamp = &timestamp
+	}
+
+	// JSON strings must be valid UTF-8, so binary values are carried base64-encoded in valueBytes instead.
+	if !utf8.ValidString(r.Value) {
+		record.Value = ""
+		record.ValueBytes = []byte(r.Value)
+	}
+
+	return record
+}
+
+func (r Record) ToRecord() (*stores.Record, error) {
+	switch r.Kind {
+	case stores.RecordKindSet, stores.RecordKindDelete, stores.RecordKindCommit, stores.RecordKindExpire, stores.RecordKindCheckpoint, stores.RecordKindAbort:
+	default:
+		return nil, fmt.Errorf("unknown record kind '%s'", r.Kind)
+	}
+
+	record := &stores.Record{
+		Kind:          r.Kind,
+		TransactionID: r.TransactionID,
+		Key:           r.Key,
+		Value:         r.Value,
+	}
+	if len(r.ValueBytes) > 0 {
+		record.Value = string(r.ValueBytes)
+	}
+	if r.ExpiresAt != nil {
+		record.ExpiresAt = *r.ExpiresAt
+	}
+	if r.Timestamp != nil {
+		record.Timestamp = *r.Timestamp
+	}
+
+	return record, nil
+}
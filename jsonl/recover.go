@@ -0,0 +1,67 @@
+package jsonl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/christianalexander/kvdb/stores"
+)
+
+// Verify reads every record of a log, returning the number of valid records before the first corruption, if any.
+func Verify(r io.ReaderAt, size int64) (records int, corruption *stores.Corruption, err error) {
+	br := bufio.NewReader(io.NewSectionReader(r, 0, size))
+
+	var offset int64
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return records, nil, fmt.Errorf("failed to read log: %v", err)
+		}
+		if len(line) == 0 {
+			return records, nil, nil
+		}
+
+		var rerr error
+		switch {
+		case line[len(line)-1] != '\n':
+			rerr = ErrTruncated
+		case len(bytes.TrimSpace(line)) > 0:
+			_, rerr = decodeLine(line)
+		}
+		if rerr != nil {
+			resume, err := resync(br, offset+int64(len(line)))
+			if err != nil {
+				return records, nil, err
+			}
+
+			return records, &stores.Corruption{Offset: offset, Resume: resume, Err: rerr}, nil
+		}
+
+		if len(bytes.TrimSpace(line)) > 0 {
+			records++
+		}
+		offset += int64(len(line))
+	}
+}
+
+// resync finds the offset of the first complete, valid line after a corrupt one, or -1 if there is none.
+func resync(br *bufio.Reader, offset int64) (int64, error) {
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			return -1, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read log: %v", err)
+		}
+
+		if len(bytes.TrimSpace(line)) > 0 {
+			if _, err := decodeLine(line); err == nil {
+				return offset, nil
+			}
+		}
+		offset += int64(len(line))
+	}
+}
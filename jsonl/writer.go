@@ -0,0 +1,35 @@
+package jsonl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/christianalexander/kvdb/stores"
+)
+
+type jsonWriter struct {
+	writer io.Writer
+}
+
+// NewWriter creates a writer of records as lines of JSON.
+func NewWriter(writer io.Writer) stores.Writer {
+	return jsonWriter{writer}
+}
+
+// Write writes a record as a single line. The line is written with a single call, so a crash
+// can only leave a prefix of it behind, which is missing its line break.
+func (w jsonWriter) Write(ctx context.Context, record stores.Record) error {
+	out, err := json.Marshal(RecordToJSON(record))
+	if err != nil {
+		return fmt.Errorf("failed to marshal record %s: %v", record, err)
+	}
+
+	_, err = w.writer.Write(append(out, '\n'))
+	if err != nil {
+		return fmt.Errorf("failed to write record to log: %v", err)
+	}
+
+	return nil
+}
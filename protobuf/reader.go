@@ -4,13 +4,21 @@ import (
 	"bufio"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 
 	"github.com/christianalexander/kvdb/stores"
 	"github.com/gogo/protobuf/proto"
 )
 
+// A ByteReader is a source of framed records, such as a *bufio.Reader.
+type ByteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
 type protoReader struct {
 	reader io.Reader
 }
@@ -27,21 +35,83 @@ func (r protoReader) Read(ctx context.Context, records chan<- stores.Record) err
 		case <-ctx.Done():
 			return ctx.Err()
 		default:
-			l, err := binary.ReadUvarint(br)
+			record, err := ReadRecord(br)
 			if err != nil {
-				return fmt.Errorf("failed to read from record file: %v", err)
+				return err
 			}
 
-			buf := make([]byte, l)
-			br.Read(buf)
+			records <- record
+		}
+	}
+}
 
-			var record Record
-			err = proto.Unmarshal(buf, &record)
-			if err != nil {
-				return fmt.Errorf("failed to unmarshal record: %v", err)
-			}
+// maxRecordLength bounds the length of a record, so that a corrupt length can not exhaust memory.
+const maxRecordLength = 256 << 20
 
-			records <- *record.ToRecord()
-		}
+var (
+	// ErrTruncated is returned for a record that ends before its frame is complete.
+	ErrTruncated = errors.New("record is truncated")
+	// ErrChecksumMismatch is returned for a record whose contents do not match its checksum.
+	ErrChecksumMismatch = errors.New("record checksum mismatch")
+)
+
+// ReadRecord reads a single varint-delimited, checksummed record. It returns io.EOF if there are no more records.
+func ReadRecord(r ByteReader) (stores.Record, error) {
+	var header [binary.MaxVarintLen64]byte
+	hr := &headerReader{r: r, buf: header[:0]}
+	l, err := binary.ReadUvarint(hr)
+	if err == io.EOF {
+		return stores.Record{}, err
+	}
+	if err == io.ErrUnexpectedEOF {
+		return stores.Record{}, fmt.Errorf("failed to read from record file: %w", ErrTruncated)
+	}
+	if err != nil {
+		return stores.Record{}, fmt.Errorf("failed to read from record file: %v", err)
+	}
+	if l > maxRecordLength {
+		return stores.Record{}, fmt.Errorf("record length %d exceeds the limit of %d bytes", l, maxRecordLength)
+	}
+
+	buf := make([]byte, len(hr.buf)+int(l)+crc32.Size)
+	copy(buf, hr.buf)
+	_, err = io.ReadFull(r, buf[len(hr.buf):])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return stores.Record{}, fmt.Errorf("failed to read from record file: %w", ErrTruncated)
+	}
+	if err != nil {
+		return stores.Record{}, fmt.Errorf("failed to read from record file: %v", err)
+	}
+
+	return decodeFrame(buf, len(hr.buf))
+}
+
+// decodeFrame checks the checksum of a complete frame and unmarshals the record in it.
+func decodeFrame(frame []byte, headerLength int) (stores.Record, error) {
+	body := frame[:len(frame)-crc32.Size]
+	if crc32.Checksum(body, castagnoli) != binary.LittleEndian.Uint32(frame[len(body):]) {
+		return stores.Record{}, ErrChecksumMismatch
+	}
+
+	var record Record
+	err := proto.Unmarshal(body[headerLength:], &record)
+	if err != nil {
+		return stores.Record{}, fmt.Errorf("failed to unmarshal record: %v", err)
+	}
+
+	return *record.ToRecord(), nil
+}
+
+// headerReader keeps the bytes of a record's length, as they are covered by its checksum.
+type headerReader struct {
+	r   io.ByteReader
+	buf []byte
+}
+
+func (h *headerReader) ReadByte() (byte, error) {
+	b, err := h.r.ReadByte()
+	if err == nil {
+		h.buf = append(h.buf, b)
 	}
+	return b, err
 }
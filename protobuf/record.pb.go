@@ -26,18 +26,27 @@ const (
 	Record_SET Record_RecordKind = 0
 	Record_DEL Record_RecordKind = 1
 	Record_CMT Record_RecordKind = 2
+	Record_EXP Record_RecordKind = 3
+	Record_CKP Record_RecordKind = 4
+	Record_ABT Record_RecordKind = 5
 )
 
 var Record_RecordKind_name = map[int32]string{
 	0: "SET",
 	1: "DEL",
 	2: "CMT",
+	3: "EXP",
+	4: "CKP",
+	5: "ABT",
 }
 
 var Record_RecordKind_value = map[string]int32{
 	"SET": 0,
 	"DEL": 1,
 	"CMT": 2,
+	"EXP": 3,
+	"CKP": 4,
+	"ABT": 5,
 }
 
 func (x Record_RecordKind) String() string {
@@ -53,6 +62,9 @@ type Record struct {
 	Key                  string            `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
 	Value                string            `protobuf:"bytes,3,opt,name=value,proto3" json:"value,omitempty"`
 	TransactionId        int64             `protobuf:"varint,4,opt,name=transactionId,proto3" json:"transactionId,omitempty"`
+	ExpiresAt            int64             `protobuf:"varint,5,opt,name=expiresAt,proto3" json:"expiresAt,omitempty"`
+	ValueBytes           []byte            `protobuf:"bytes,6,opt,name=valueBytes,proto3" json:"valueBytes,omitempty"`
+	Timestamp            int64             `protobuf:"varint,7,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
 	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
 	XXX_unrecognized     []byte            `json:"-"`
 	XXX_sizecache        int32             `json:"-"`
@@ -111,6 +123,27 @@ func (m *Record) GetTransactionId() int64 {
 	return 0
 }
 
+func (m *Record) GetExpiresAt() int64 {
+	if m != nil {
+		return m.ExpiresAt
+	}
+	return 0
+}
+
+func (m *Record) GetValueBytes() []byte {
+	if m != nil {
+		return m.ValueBytes
+	}
+	return nil
+}
+
+func (m *Record) GetTimestamp() int64 {
+	if m != nil {
+		return m.Timestamp
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterEnum("protobuf.Record_RecordKind", Record_RecordKind_name, Record_RecordKind_value)
 	proto.RegisterType((*Record)(nil), "protobuf.Record")
@@ -119,16 +152,21 @@ func init() {
 func init() { proto.RegisterFile("record.proto", fileDescriptor_bf94fd919e302a1d) }
 
 var fileDescriptor_bf94fd919e302a1d = []byte{
-	// 173 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x29, 0x4a, 0x4d, 0xce,
-	0x2f, 0x4a, 0xd1, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0xe2, 0x00, 0x53, 0x49, 0xa5, 0x69, 0x4a,
-	0x1b, 0x18, 0xb9, 0xd8, 0x82, 0xc0, 0x52, 0x42, 0xfa, 0x5c, 0x2c, 0xd9, 0x99, 0x79, 0x29, 0x12,
-	0x8c, 0x0a, 0x8c, 0x1a, 0x7c, 0x46, 0xd2, 0x7a, 0x30, 0x35, 0x7a, 0x10, 0x79, 0x28, 0xe5, 0x9d,
-	0x99, 0x97, 0x12, 0x04, 0x56, 0x28, 0x24, 0xc0, 0xc5, 0x9c, 0x9d, 0x5a, 0x29, 0xc1, 0xa4, 0xc0,
-	0xa8, 0xc1, 0x19, 0x04, 0x62, 0x0a, 0x89, 0x70, 0xb1, 0x96, 0x25, 0xe6, 0x94, 0xa6, 0x4a, 0x30,
-	0x83, 0xc5, 0x20, 0x1c, 0x21, 0x15, 0x2e, 0xde, 0x92, 0xa2, 0xc4, 0xbc, 0xe2, 0xc4, 0xe4, 0x92,
-	0xcc, 0xfc, 0x3c, 0xcf, 0x14, 0x09, 0x16, 0x05, 0x46, 0x0d, 0xe6, 0x20, 0x54, 0x41, 0x25, 0x75,
-	0x2e, 0x2e, 0x84, 0x0d, 0x42, 0xec, 0x5c, 0xcc, 0xc1, 0xae, 0x21, 0x02, 0x0c, 0x20, 0x86, 0x8b,
-	0xab, 0x8f, 0x00, 0x23, 0x88, 0xe1, 0xec, 0x1b, 0x22, 0xc0, 0x94, 0xc4, 0x06, 0x76, 0x98, 0x31,
-	0x20, 0x00, 0x00, 0xff, 0xff, 0xc7, 0x7a, 0x8e, 0x71, 0xd3, 0x00, 0x00, 0x00,
+	// 244 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x54, 0x90, 0x41, 0x4b, 0xc3, 0x30,
+	0x14, 0xc7, 0x4d, 0xd3, 0x76, 0xee, 0x31, 0x25, 0x3c, 0x3c, 0x04, 0x14, 0x29, 0xc3, 0x43, 0x4f,
+	0x15, 0xf4, 0x13, 0xac, 0xda, 0x83, 0x4c, 0x61, 0xc4, 0x1e, 0xbc, 0x76, 0x6b, 0x84, 0x30, 0xd7,
+	0x96, 0x34, 0x13, 0xf7, 0x89, 0xfc, 0x9a, 0x92, 0x57, 0xb5, 0x7a, 0x7a, 0xbf, 0xfc, 0xde, 0xff,
+	0x1f, 0x42, 0x60, 0x66, 0xf5, 0xa6, 0xb5, 0x75, 0xd6, 0xd9, 0xd6, 0xb5, 0x78, 0x4c, 0x63, 0xbd,
+	0x7f, 0x9d, 0x7f, 0x06, 0x10, 0x2b, 0x5a, 0xe1, 0x35, 0x84, 0x5b, 0xd3, 0xd4, 0x92, 0x25, 0x2c,
+	0x3d, 0xbd, 0x39, 0xcf, 0x7e, 0x32, 0xd9, 0xb0, 0xff, 0x1e, 0x4b, 0xd3, 0xd4, 0x8a, 0x82, 0x28,
+	0x80, 0x6f, 0xf5, 0x41, 0x06, 0x09, 0x4b, 0xa7, 0xca, 0x23, 0x9e, 0x41, 0xf4, 0x5e, 0xbd, 0xed,
+	0xb5, 0xe4, 0xe4, 0x86, 0x03, 0x5e, 0xc1, 0x89, 0xb3, 0x55, 0xd3, 0x57, 0x1b, 0x67, 0xda, 0xe6,
+	0xa1, 0x96, 0x61, 0xc2, 0x52, 0xae, 0xfe, 0x4b, 0xbc, 0x80, 0xa9, 0xfe, 0xe8, 0x8c, 0xd5, 0xfd,
+	0xc2, 0xc9, 0x88, 0x12, 0xa3, 0xc0, 0x4b, 0x00, 0xba, 0x2c, 0x3f, 0x38, 0xdd, 0xcb, 0x38, 0x61,
+	0xe9, 0x4c, 0xfd, 0x31, 0xbe, 0xed, 0xcc, 0x4e, 0xf7, 0xae, 0xda, 0x75, 0x72, 0x32, 0xb4, 0x7f,
+	0xc5, 0x3c, 0x07, 0x18, 0x5f, 0x8f, 0x13, 0xe0, 0xcf, 0x45, 0x29, 0x8e, 0x3c, 0xdc, 0x17, 0x8f,
+	0x82, 0x79, 0xb8, 0x7b, 0x2a, 0x45, 0xe0, 0xa1, 0x78, 0x59, 0x09, 0x4e, 0x66, 0xb9, 0x12, 0xa1,
+	0x87, 0x45, 0x5e, 0x8a, 0x68, 0x1d, 0xd3, 0x7f, 0xdc, 0x7e, 0x0d, 0x00, 0x8d, 0x5f, 0x5a, 0xc8,
+	0x4a, 0x01, 0x00, 0x00,
 }
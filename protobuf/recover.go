@@ -0,0 +1,84 @@
+package protobuf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/christianalexander/kvdb/stores"
+)
+
+// Verify reads every record of a log, returning the number of valid records before the first corruption, if any.
+func Verify(r io.ReaderAt, size int64) (records int, corruption *stores.Corruption, err error) {
+	cr := &countingReader{r: bufio.NewReader(io.NewSectionReader(r, 0, size))}
+	for {
+		offset := cr.n
+		_, err := ReadRecord(cr)
+		if err == io.EOF {
+			return records, nil, nil
+		}
+		if err != nil {
+			resume, rerr := resync(r, offset+1, size)
+			if rerr != nil {
+				return records, nil, rerr
+			}
+
+			return records, &stores.Corruption{Offset: offset, Resume: resume, Err: err}, nil
+		}
+		records++
+	}
+}
+
+// resync finds the first offset from start at which a valid record begins, or -1 if there is none.
+func resync(r io.ReaderAt, start, size int64) (int64, error) {
+	if start >= size {
+		return -1, nil
+	}
+
+	rest := make([]byte, size-start)
+	_, err := r.ReadAt(rest, start)
+	if err != nil && err != io.EOF {
+		return 0, fmt.Errorf("failed to read log: %v", err)
+	}
+
+	for i := range rest {
+		l, n := binary.Uvarint(rest[i:])
+		if n <= 0 || len(rest)-i-n < crc32.Size || l > uint64(len(rest)-i-n-crc32.Size) {
+			continue
+		}
+
+		if _, err := decodeFrame(rest[i:i+n+int(l)+crc32.Size], n); err == nil {
+			return start + int64(i), nil
+		}
+	}
+
+	return -1, nil
+}
+
+// RecoverLog verifies a log file and truncates it at the first corruption, as stores.RecoverLog does.
+func RecoverLog(f *os.File, repair bool) (*stores.Corruption, error) {
+	return stores.RecoverLog(f, Verify, repair)
+}
+
+// countingReader counts the bytes consumed through a buffered reader.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
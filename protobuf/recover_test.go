@@ -0,0 +1,168 @@
+package protobuf
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/christianalexander/kvdb/stores"
+)
+
+var testRecords = []stores.Record{
+	{Kind: stores.RecordKindSet, Key: "a", Value: "1", TransactionID: 1},
+	{Kind: stores.RecordKindCommit, TransactionID: 1},
+	{Kind: stores.RecordKindSet, Key: "b", Value: "line\r\nbreak\x00", TransactionID: 2},
+	{Kind: stores.RecordKindCommit, TransactionID: 2},
+}
+
+// writeLog returns the frames of records, and the offset each one starts at.
+func writeLog(t *testing.T, records []stores.Record) ([]byte, []int64) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var offsets []int64
+	for _, r := range records {
+		offsets = append(offsets, int64(buf.Len()))
+		if err := w.Write(context.Background(), r); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	return buf.Bytes(), offsets
+}
+
+func TestRoundTrip(t *testing.T) {
+	log, _ := writeLog(t, testRecords)
+
+	br := bufio.NewReader(bytes.NewReader(log))
+	for i, want := range testRecords {
+		got, err := ReadRecord(br)
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if got.Kind != want.Kind || got.Key != want.Key || got.Value != want.Value || got.TransactionID != want.TransactionID {
+			t.Errorf("record %d: got %s, want %s", i, got, want)
+		}
+	}
+	if _, err := ReadRecord(br); err != io.EOF {
+		t.Errorf("read past the last record: got %v, want %v", err, io.EOF)
+	}
+}
+
+func TestReadRecordTorn(t *testing.T) {
+	frame, _ := writeLog(t, testRecords[:1])
+
+	// Every prefix of a frame, as a crash part-way through its write could leave, is truncated.
+	for n := 1; n < len(frame); n++ {
+		_, err := ReadRecord(bufio.NewReader(bytes.NewReader(frame[:n])))
+		if !errors.Is(err, ErrTruncated) {
+			t.Errorf("frame cut to %d of %d bytes: got %v, want %v", n, len(frame), err, ErrTruncated)
+		}
+	}
+}
+
+func TestReadRecordChecksum(t *testing.T) {
+	frame, _ := writeLog(t, testRecords[:1])
+
+	// A flipped bit anywhere after the length, including in the checksum itself, is caught.
+	for i := 1; i < len(frame); i++ {
+		corrupt := append([]byte(nil), frame...)
+		corrupt[i] ^= 0x10
+		_, err := ReadRecord(bufio.NewReader(bytes.NewReader(corrupt)))
+		if !errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf("bit flipped in byte %d: got %v, want %v", i, err, ErrChecksumMismatch)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	log, offsets := writeLog(t, testRecords)
+
+	records, corruption, err := Verify(bytes.NewReader(log), int64(len(log)))
+	if err != nil || corruption != nil || records != len(testRecords) {
+		t.Errorf("intact log: got %d records, %v, %v", records, corruption, err)
+	}
+
+	torn := log[:len(log)-3]
+	records, corruption, err = Verify(bytes.NewReader(torn), int64(len(torn)))
+	if err != nil || corruption == nil || !corruption.Torn() || corruption.Offset != offsets[3] || records != 3 {
+		t.Errorf("torn log: got %d records, %v, %v, want a torn record at offset %d", records, corruption, err, offsets[3])
+	}
+
+	// A bad checksum in the middle of the log is followed by valid records, so it is not a torn write.
+	middle := append([]byte(nil), log...)
+	middle[offsets[2]+3] ^= 0xff
+	records, corruption, err = Verify(bytes.NewReader(middle), int64(len(middle)))
+	if err != nil || corruption == nil || corruption.Torn() || !errors.Is(corruption.Err, ErrChecksumMismatch) {
+		t.Fatalf("corrupt log: got %d records, %v, %v, want a checksum mismatch", records, corruption, err)
+	}
+	if records != 2 || corruption.Offset != offsets[2] || corruption.Resume != offsets[3] {
+		t.Errorf("corrupt log: got %d records and corruption at %d resuming at %d, want 2 at %d resuming at %d",
+			records, corruption.Offset, corruption.Resume, offsets[2], offsets[3])
+	}
+}
+
+func TestRecoverLog(t *testing.T) {
+	log, offsets := writeLog(t, testRecords)
+
+	recoverFile := func(t *testing.T, contents []byte, repair bool) (*stores.Corruption, []byte, error) {
+		t.Helper()
+
+		path := filepath.Join(t.TempDir(), "log")
+		if err := ioutil.WriteFile(path, contents, 0664); err != nil {
+			t.Fatalf("write log: %v", err)
+		}
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatalf("open log: %v", err)
+		}
+		defer f.Close()
+
+		corruption, err := RecoverLog(f, repair)
+		after, rerr := ioutil.ReadFile(path)
+		if rerr != nil {
+			t.Fatalf("read log: %v", rerr)
+		}
+
+		return corruption, after, err
+	}
+
+	t.Run("intact", func(t *testing.T) {
+		corruption, after, err := recoverFile(t, log, false)
+		if err != nil || corruption != nil || !bytes.Equal(after, log) {
+			t.Errorf("got %v, %v, and %d of %d bytes left", corruption, err, len(after), len(log))
+		}
+	})
+
+	t.Run("torn tail", func(t *testing.T) {
+		corruption, after, err := recoverFile(t, log[:len(log)-1], false)
+		if err != nil || corruption == nil || !bytes.Equal(after, log[:offsets[3]]) {
+			t.Errorf("got %v, %v, and %d bytes left, want truncation to %d", corruption, err, len(after), offsets[3])
+		}
+	})
+
+	middle := append([]byte(nil), log...)
+	middle[offsets[1]+2] ^= 0xff
+
+	t.Run("corruption in the middle", func(t *testing.T) {
+		// Records after the corruption would be lost, so the log is left alone unless asked to repair it.
+		corruption, after, err := recoverFile(t, middle, false)
+		if err == nil || corruption != nil || !bytes.Equal(after, middle) {
+			t.Errorf("got %v, %v, and %d of %d bytes left, want an error and the log unchanged", corruption, err, len(after), len(middle))
+		}
+	})
+
+	t.Run("repair", func(t *testing.T) {
+		corruption, after, err := recoverFile(t, middle, true)
+		if err != nil || corruption == nil || corruption.Torn() || !bytes.Equal(after, log[:offsets[1]]) {
+			t.Errorf("got %v, %v, and %d bytes left, want truncation to %d", corruption, err, len(after), offsets[1])
+		}
+	})
+}
@@ -1,14 +1,38 @@
 package protobuf
 
-import "github.com/christianalexander/kvdb/stores"
+import (
+	"time"
+	"unicode/utf8"
+
+	"github.com/christianalexander/kvdb/stores"
+)
 
 func RecordToProto(r stores.Record) *Record {
-	return &Record{
+	var expiresAt int64
+	if !r.ExpiresAt.IsZero() {
+		expiresAt = r.ExpiresAt.UnixNano()
+	}
+	var timestamp int64
+	if !r.Timestamp.IsZero() {
+		timestamp = r.Timestamp.UnixNano()
+	}
+
+	record := &Record{
 		Kind:          recordKindToProto(r.Kind),
 		TransactionId: r.TransactionID,
 		Key:           r.Key,
 		Value:         r.Value,
+		ExpiresAt:     expiresAt,
+		Timestamp:     timestamp,
 	}
+
+	// Proto strings must be valid UTF-8, so binary values are carried in the bytes field instead.
+	if !utf8.ValidString(r.Value) {
+		record.Value = ""
+		record.ValueBytes = []byte(r.Value)
+	}
+
+	return record
 }
 
 func recordKindToProto(k stores.RecordKind) Record_RecordKind {
@@ -19,6 +43,12 @@ func recordKindToProto(k stores.RecordKind) Record_RecordKind {
 		return Record_DEL
 	case stores.RecordKindCommit:
 		return Record_CMT
+	case stores.RecordKindExpire:
+		return Record_EXP
+	case stores.RecordKindCheckpoint:
+		return Record_CKP
+	case stores.RecordKindAbort:
+		return Record_ABT
 	}
 
 	return Record_SET
@@ -32,16 +62,38 @@ func recordKindFromProto(k Record_RecordKind) stores.RecordKind {
 		return stores.RecordKindDelete
 	case Record_CMT:
 		return stores.RecordKindCommit
+	case Record_EXP:
+		return stores.RecordKindExpire
+	case Record_CKP:
+		return stores.RecordKindCheckpoint
+	case Record_ABT:
+		return stores.RecordKindAbort
 	}
 
 	return stores.RecordKindSet
 }
 
 func (r Record) ToRecord() *stores.Record {
+	var expiresAt time.Time
+	if r.ExpiresAt != 0 {
+		expiresAt = time.Unix(0, r.ExpiresAt)
+	}
+	var timestamp time.Time
+	if r.Timestamp != 0 {
+		timestamp = time.Unix(0, r.Timestamp)
+	}
+
+	value := r.Value
+	if len(r.ValueBytes) > 0 {
+		value = string(r.ValueBytes)
+	}
+
 	return &stores.Record{
 		Kind:          recordKindFromProto(r.Kind),
 		TransactionID: r.TransactionId,
 		Key:           r.Key,
-		Value:         r.Value,
+		Value:         value,
+		ExpiresAt:     expiresAt,
+		Timestamp:     timestamp,
 	}
 }
@@ -1,16 +1,19 @@
 package protobuf
 
 import (
-	"bytes"
 	"context"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
 
 	"github.com/christianalexander/kvdb/stores"
 	proto "github.com/golang/protobuf/proto"
 )
 
+// castagnoli is the CRC32C table used to checksum records.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
 type protoWriter struct {
 	writer io.Writer
 }
@@ -19,6 +22,8 @@ func NewWriter(writer io.Writer) stores.Writer {
 	return protoWriter{writer}
 }
 
+// Write frames a record as its varint length, the marshalled record and a CRC32C of both.
+// The frame is written with a single call, so a crash can only leave a prefix of it behind.
 func (w protoWriter) Write(ctx context.Context, record stores.Record) error {
 	protoRecord := RecordToProto(record)
 
@@ -27,12 +32,13 @@ func (w protoWriter) Write(ctx context.Context, record stores.Record) error {
 		return fmt.Errorf("failed to marshal record %s: %v", record, err)
 	}
 
-	lBuf := make([]byte, binary.MaxVarintLen64)
-	n := binary.PutUvarint(lBuf, uint64(len(out)))
-
-	mr := io.MultiReader(bytes.NewBuffer(lBuf[:n]), bytes.NewBuffer(out))
+	frame := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(out)+crc32.Size)
+	n := binary.PutUvarint(frame, uint64(len(out)))
+	frame = append(frame[:n], out...)
+	frame = frame[:len(frame)+crc32.Size]
+	binary.LittleEndian.PutUint32(frame[len(frame)-crc32.Size:], crc32.Checksum(frame[:len(frame)-crc32.Size], castagnoli))
 
-	_, err = io.Copy(w.writer, mr)
+	_, err = w.writer.Write(frame)
 	if err != nil {
 		return fmt.Errorf("failed to write record to log: %v", err)
 	}
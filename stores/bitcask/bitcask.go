@@ -0,0 +1,367 @@
+package bitcask
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/christianalexander/kvdb/protobuf"
+	"github.com/christianalexander/kvdb/stores"
+	"github.com/sirupsen/logrus"
+)
+
+// Options configures a bitcask store.
+type Options struct {
+	// MaxSegmentSize is the size in bytes at which the active segment is closed and a new one started.
+	MaxSegmentSize int64
+	// MergeThreshold is the number of closed segments that triggers a merge.
+	MergeThreshold int
+}
+
+const (
+	defaultMaxSegmentSize = 64 << 20
+	defaultMergeThreshold = 4
+)
+
+// bitcaskStore is a hash-indexed log store in the style of Bitcask.
+//
+// The data files are append-only protobuf logs, framed like the binary log. An in-memory
+// keydir maps each live key to the segment and offset of its latest record, so values
+// stay on disk and every read is a single seek. Closed segments are merged in the
+// background, which rewrites only the records the keydir still points to.
+type bitcaskStore struct {
+	dir     string
+	options Options
+
+	mu       sync.RWMutex
+	keydir   map[string]location
+	segments map[uint64]*segment
+	active   *segment
+	writer   stores.Writer
+
+	merging int32
+	wg      sync.WaitGroup
+}
+
+// A location is where the latest value of a key is stored.
+type location struct {
+	segment   uint64
+	offset    int64
+	length    int64
+	expiresAt time.Time
+}
+
+func (l location) live(now time.Time) bool {
+	return l.expiresAt.IsZero() || now.Before(l.expiresAt)
+}
+
+// Open opens or creates a bitcask store in a directory, rebuilding the keydir from its segments.
+func Open(dir string, options Options) (stores.DiskStore, error) {
+	if options.MaxSegmentSize <= 0 {
+		options.MaxSegmentSize = defaultMaxSegmentSize
+	}
+	if options.MergeThreshold <= 0 {
+		options.MergeThreshold = defaultMergeThreshold
+	}
+
+	err := os.MkdirAll(dir, 0775)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bitcask directory '%s': %v", dir, err)
+	}
+
+	ids, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &bitcaskStore{
+		dir:      dir,
+		options:  options,
+		keydir:   make(map[string]location),
+		segments: make(map[uint64]*segment),
+	}
+
+	for _, id := range ids {
+		seg, err := openSegment(dir, id)
+		if err != nil {
+			s.closeSegments()
+			return nil, err
+		}
+		s.segments[id] = seg
+
+		// Only the newest segment was being written to, so only it can have a torn tail.
+		if id == ids[len(ids)-1] {
+			corruption, err := protobuf.RecoverLog(seg.file, false)
+			if err != nil {
+				s.closeSegments()
+				return nil, err
+			}
+			if corruption != nil {
+				logrus.Warnf("Truncated segment %d at the %v", id, corruption)
+				seg.size = corruption.Offset
+			}
+		}
+
+		err = seg.scan(func(r stores.Record, offset, length int64) {
+			s.index(r, id, offset, length)
+		})
+		if err != nil {
+			s.closeSegments()
+			return nil, fmt.Errorf("failed to rebuild keydir: %v", err)
+		}
+	}
+
+	var next uint64
+	if len(ids) > 0 {
+		next = ids[len(ids)-1] + 1
+	}
+	err = s.startSegment(next)
+	if err != nil {
+		s.closeSegments()
+		return nil, err
+	}
+
+	logrus.Infof("Opened bitcask store in '%s' with %d segments and %d keys", dir, len(s.segments), len(s.keydir))
+
+	return s, nil
+}
+
+// index applies a record read from a segment to the keydir.
+func (s *bitcaskStore) index(r stores.Record, segmentID uint64, offset, length int64) {
+	switch r.Kind {
+	case stores.RecordKindSet:
+		s.keydir[r.Key] = location{segment: segmentID, offset: offset, length: length}
+	case stores.RecordKindDelete:
+		delete(s.keydir, r.Key)
+	case stores.RecordKindExpire:
+		if l, ok := s.keydir[r.Key]; ok {
+			l.expiresAt = r.ExpiresAt
+			s.keydir[r.Key] = l
+		}
+	}
+}
+
+// startSegment makes a new, empty segment the active one. The caller must hold the write lock.
+func (s *bitcaskStore) startSegment(id uint64) error {
+	seg, err := openSegment(s.dir, id)
+	if err != nil {
+		return err
+	}
+
+	s.segments[id] = seg
+	s.active = seg
+	s.writer = protobuf.NewWriter(seg)
+
+	return nil
+}
+
+// append writes a record to the active segment, returning where it was written.
+// The caller must hold the write lock.
+func (s *bitcaskStore) append(ctx context.Context, r stores.Record) (location, error) {
+	if s.active.size >= s.options.MaxSegmentSize {
+		err := s.startSegment(s.active.id + 1)
+		if err != nil {
+			return location{}, err
+		}
+		s.maybeMerge()
+	}
+
+	offset := s.active.size
+	err := s.writer.Write(ctx, r)
+	if err != nil {
+		return location{}, err
+	}
+
+	return location{segment: s.active.id, offset: offset, length: s.active.size - offset}, nil
+}
+
+// lookup returns the location of a live key. The caller must hold the lock.
+func (s *bitcaskStore) lookup(key string) (location, bool) {
+	l, ok := s.keydir[key]
+	if !ok || !l.live(time.Now()) {
+		return location{}, false
+	}
+
+	return l, true
+}
+
+// read loads the value at a location from disk. The caller must hold the lock.
+func (s *bitcaskStore) read(l location) (string, error) {
+	r, err := s.segments[l.segment].readAt(l.offset, l.length)
+	if err != nil {
+		return "", err
+	}
+
+	return r.Value, nil
+}
+
+func (s *bitcaskStore) Set(ctx context.Context, key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, err := s.append(ctx, stores.Record{Kind: stores.RecordKindSet, Key: key, Value: value})
+	if err != nil {
+		return fmt.Errorf("failed to write value for key '%s': %v", key, err)
+	}
+	s.keydir[key] = l
+
+	return nil
+}
+
+func (s *bitcaskStore) Get(ctx context.Context, key string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	l, ok := s.lookup(key)
+	if !ok {
+		return "", fmt.Errorf("value for key '%s' not found", key)
+	}
+
+	return s.read(l)
+}
+
+// SetBytes sets a value held as a byte slice. Values that are not valid UTF-8 are written to the
+// bytes field of their record, so they may hold any bytes.
+func (s *bitcaskStore) SetBytes(ctx context.Context, key string, value []byte) error {
+	return s.Set(ctx, key, string(value))
+}
+
+func (s *bitcaskStore) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	v, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(v), nil
+}
+
+func (s *bitcaskStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.keydir[key]; !ok {
+		return nil
+	}
+
+	_, err := s.append(ctx, stores.Record{Kind: stores.RecordKindDelete, Key: key})
+	if err != nil {
+		return fmt.Errorf("failed to delete key '%s': %v", key, err)
+	}
+	delete(s.keydir, key)
+
+	return nil
+}
+
+func (s *bitcaskStore) Expire(ctx context.Context, key string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.lookup(key)
+	if !ok {
+		return fmt.Errorf("value for key '%s' not found", key)
+	}
+
+	_, err := s.append(ctx, stores.Record{Kind: stores.RecordKindExpire, Key: key, ExpiresAt: at})
+	if err != nil {
+		return fmt.Errorf("failed to expire key '%s': %v", key, err)
+	}
+	l.expiresAt = at
+	s.keydir[key] = l
+
+	return nil
+}
+
+func (s *bitcaskStore) Expiry(ctx context.Context, key string) (time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	l, ok := s.lookup(key)
+	if !ok {
+		return time.Time{}, fmt.Errorf("value for key '%s' not found", key)
+	}
+
+	return l.expiresAt, nil
+}
+
+// sortedKeys returns the live keys within a range in order. The caller must hold the lock.
+func (s *bitcaskStore) sortedKeys(start, end string) []string {
+	now := time.Now()
+	var keys []string
+	for k, l := range s.keydir {
+		if stores.InRange(k, start, end) && l.live(now) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func (s *bitcaskStore) Keys(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.sortedKeys("", ""), nil
+}
+
+// Scan sorts the matching keys, as the keydir is a hash index.
+func (s *bitcaskStore) Scan(ctx context.Context, start, end string, limit int) (stores.Iterator, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := s.sortedKeys(start, end)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	result := make([]stores.KeyValue, 0, len(keys))
+	for _, k := range keys {
+		v, err := s.read(s.keydir[k])
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, stores.KeyValue{Key: k, Value: v})
+	}
+
+	return stores.NewIterator(result), nil
+}
+
+// RemoveExpired drops expired keys from the keydir. Their records are reclaimed by the next merge.
+func (s *bitcaskStore) RemoveExpired(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for k, l := range s.keydir {
+		if !l.live(now) {
+			delete(s.keydir, k)
+			n++
+		}
+	}
+
+	return n
+}
+
+func (s *bitcaskStore) Release(context.Context) {}
+
+// Close waits for any merge to finish, then syncs and closes every segment.
+func (s *bitcaskStore) Close() error {
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.active.file.Sync()
+	s.closeSegments()
+
+	return err
+}
+
+func (s *bitcaskStore) closeSegments() {
+	for _, seg := range s.segments {
+		seg.file.Close()
+	}
+}
@@ -0,0 +1,216 @@
+package bitcask
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/christianalexander/kvdb/stores"
+)
+
+func open(t *testing.T, dir string, options Options) *bitcaskStore {
+	t.Helper()
+
+	s, err := Open(dir, options)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	return s.(*bitcaskStore)
+}
+
+func reopen(t *testing.T, s *bitcaskStore) *bitcaskStore {
+	t.Helper()
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	return open(t, s.dir, s.options)
+}
+
+// assertContents checks the keys and values a scan returns, and that each can be read on its own.
+func assertContents(t *testing.T, s stores.Store, when string, want map[string]string) {
+	t.Helper()
+	ctx := context.Background()
+
+	it, err := s.Scan(ctx, "", "", 0)
+	if err != nil {
+		t.Fatalf("%s: scan: %v", when, err)
+	}
+	defer it.Close()
+
+	got := make(map[string]string)
+	for it.Next() {
+		got[it.Key()] = it.Value()
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: got %v, want %v", when, got, want)
+	}
+
+	for k, v := range want {
+		if got, err := s.Get(ctx, k); err != nil || got != v {
+			t.Errorf("%s: get %s: got %q, %v, want %q", when, k, got, err, v)
+		}
+	}
+}
+
+func TestReopen(t *testing.T) {
+	ctx := context.Background()
+	s := open(t, t.TempDir(), Options{})
+
+	s.Set(ctx, "a", "1")
+	s.Set(ctx, "b", "1")
+	s.Set(ctx, "c", "1")
+	s.Set(ctx, "b", "2")
+	s.Delete(ctx, "c")
+	at := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := s.Expire(ctx, "a", at); err != nil {
+		t.Fatalf("expire: %v", err)
+	}
+
+	s = reopen(t, s)
+	defer s.Close()
+
+	assertContents(t, s, "after reopening", map[string]string{"a": "1", "b": "2"})
+	if expiresAt, err := s.Expiry(ctx, "a"); err != nil || !expiresAt.Equal(at) {
+		t.Errorf("expiry after reopening: got %v, %v, want %v", expiresAt, err, at)
+	}
+}
+
+func TestReopenTornTail(t *testing.T) {
+	ctx := context.Background()
+	s := open(t, t.TempDir(), Options{})
+
+	s.Set(ctx, "a", "1")
+	s.Set(ctx, "b", "2")
+	active := segmentPath(s.dir, s.active.id)
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// A crash part-way through a write leaves the start of a record at the end of the active segment.
+	info, err := os.Stat(active)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	f, err := os.OpenFile(active, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("open segment: %v", err)
+	}
+	f.Write([]byte{0x20, 0x0a, 0x01})
+	f.Close()
+
+	s = open(t, s.dir, Options{})
+	assertContents(t, s, "after reopening a torn segment", map[string]string{"a": "1", "b": "2"})
+
+	if info2, err := os.Stat(active); err != nil || info2.Size() != info.Size() {
+		t.Errorf("torn segment was not truncated: %v, %v", info2.Size(), err)
+	}
+	s.Set(ctx, "c", "3")
+	s = reopen(t, s)
+	defer s.Close()
+	assertContents(t, s, "after writing past the truncated tail", map[string]string{"a": "1", "b": "2", "c": "3"})
+}
+
+func TestMerge(t *testing.T) {
+	ctx := context.Background()
+	// Segments are small, so that the writes span many of them, and are only merged when asked.
+	s := open(t, t.TempDir(), Options{MaxSegmentSize: 128, MergeThreshold: 1 << 30})
+
+	want := make(map[string]string)
+	for round := 0; round < 5; round++ {
+		for i := round; i < 40; i += 2 {
+			k, v := fmt.Sprintf("key-%02d", i), fmt.Sprintf("%d", round)
+			s.Set(ctx, k, v)
+			want[k] = v
+		}
+		for i := round; i < 40; i += 7 {
+			k := fmt.Sprintf("key-%02d", i)
+			s.Delete(ctx, k)
+			delete(want, k)
+		}
+	}
+	s.Set(ctx, "expiring", "x")
+	at := time.Now().Add(time.Hour).Truncate(time.Second)
+	s.Expire(ctx, "expiring", at)
+	want["expiring"] = "x"
+	s.Set(ctx, "expired", "x")
+	s.Expire(ctx, "expired", time.Now().Add(-time.Second))
+
+	before := len(s.segments)
+	if before < 3 {
+		t.Fatalf("got %d segments, want the writes to span several", before)
+	}
+	s.mu.Lock()
+	// The merge takes every segment written so far, as a new one is started.
+	if err := s.startSegment(s.active.id + 1); err != nil {
+		t.Fatalf("start segment: %v", err)
+	}
+	s.mu.Unlock()
+
+	if err := s.merge(); err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	if len(s.segments) != 2 {
+		t.Fatalf("got %d segments after merging %d, want the merged one and the active one", len(s.segments), before)
+	}
+	assertContents(t, s, "after merging", want)
+
+	// The merged segment holds only the latest value of each live key, and the expiries they carry.
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"))
+	if err != nil || len(files) != 2 {
+		t.Errorf("files after merging: got %v, %v, want two segments", files, err)
+	}
+	merged := 0
+	for id, seg := range s.segments {
+		if id == s.active.id {
+			continue
+		}
+		seg.scan(func(r stores.Record, offset, length int64) {
+			if r.Kind == stores.RecordKindSet {
+				merged++
+			}
+		})
+	}
+	if merged != len(want) {
+		t.Errorf("merged segment holds %d values, want %d", merged, len(want))
+	}
+
+	s = reopen(t, s)
+	defer s.Close()
+	assertContents(t, s, "after merging and reopening", want)
+	if expiresAt, err := s.Expiry(ctx, "expiring"); err != nil || !expiresAt.Equal(at) {
+		t.Errorf("expiry after merging and reopening: got %v, %v, want %v", expiresAt, err, at)
+	}
+}
+
+func TestInterruptedMerge(t *testing.T) {
+	ctx := context.Background()
+	s := open(t, t.TempDir(), Options{MaxSegmentSize: 64, MergeThreshold: 1 << 30})
+	for i := 0; i < 20; i++ {
+		s.Set(ctx, fmt.Sprintf("key-%02d", i%5), fmt.Sprintf("%d", i))
+	}
+	dir := s.dir
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// Incomplete merge output is thrown away, leaving the segments it was merging.
+	if err := ioutil.WriteFile(mergedPath(dir, 0)+tmpSuffix, []byte("partial"), 0664); err != nil {
+		t.Fatalf("write merge output: %v", err)
+	}
+	s = open(t, dir, Options{})
+	defer s.Close()
+	assertContents(t, s, "after an incomplete merge", map[string]string{
+		"key-00": "15", "key-01": "16", "key-02": "17", "key-03": "18", "key-04": "19",
+	})
+	if _, err := os.Stat(mergedPath(dir, 0) + tmpSuffix); !os.IsNotExist(err) {
+		t.Errorf("incomplete merge output was left behind: %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package bitcask
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/christianalexander/kvdb/protobuf"
+	"github.com/christianalexander/kvdb/stores"
+	"github.com/sirupsen/logrus"
+)
+
+// maybeMerge starts a background merge once enough segments are closed.
+// The caller must hold the write lock.
+func (s *bitcaskStore) maybeMerge() {
+	if len(s.segments)-1 < s.options.MergeThreshold {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&s.merging, 0, 1) {
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer atomic.StoreInt32(&s.merging, 0)
+
+		err := s.merge()
+		if err != nil {
+			logrus.Errorf("Failed to merge bitcask segments: %v", err)
+		}
+	}()
+}
+
+// merge rewrites the live records of every closed segment into one segment, which takes
+// the ID of the newest segment it replaces so that it still sorts before the active one.
+//
+// The output is written to a temporary file, then renamed to mark it complete. If the
+// process stops before the old segments are replaced, Open finishes the job.
+func (s *bitcaskStore) merge() error {
+	s.mu.RLock()
+	var inputs []*segment
+	byID := make(map[uint64]*segment)
+	for id, seg := range s.segments {
+		if id != s.active.id {
+			inputs = append(inputs, seg)
+			byID[id] = seg
+		}
+	}
+	sort.Slice(inputs, func(i, j int) bool { return inputs[i].id < inputs[j].id })
+	if len(inputs) == 0 {
+		s.mu.RUnlock()
+		return nil
+	}
+	target := inputs[len(inputs)-1].id
+
+	live := make(map[string]location)
+	for k, l := range s.keydir {
+		if l.segment <= target {
+			live[k] = l
+		}
+	}
+	s.mu.RUnlock()
+
+	keys := make([]string, 0, len(live))
+	for k := range live {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	tmp := mergedPath(s.dir, target) + tmpSuffix
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
+	if err != nil {
+		return fmt.Errorf("failed to create merge output: %v", err)
+	}
+	out := &segment{id: target, file: f}
+	writer := protobuf.NewWriter(out)
+
+	// Closed segments are only closed by a merge, so they can be read without the lock.
+	ctx := context.Background()
+	now := time.Now()
+	moved := make(map[string]location, len(keys))
+	for _, k := range keys {
+		old := live[k]
+		if !old.live(now) {
+			continue
+		}
+
+		r, err := byID[old.segment].readAt(old.offset, old.length)
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+
+		offset := out.size
+		err = writer.Write(ctx, stores.Record{Kind: stores.RecordKindSet, Key: k, Value: r.Value})
+		if err == nil && !old.expiresAt.IsZero() {
+			err = writer.Write(ctx, stores.Record{Kind: stores.RecordKindExpire, Key: k, ExpiresAt: old.expiresAt})
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return fmt.Errorf("failed to write merge output: %v", err)
+		}
+
+		moved[k] = location{segment: target, offset: offset, length: out.size - offset}
+	}
+
+	err = f.Sync()
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to sync merge output: %v", err)
+	}
+
+	err = os.Rename(tmp, mergedPath(s.dir, target))
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to complete merge output: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, seg := range inputs {
+		seg.file.Close()
+		delete(s.segments, seg.id)
+		os.Remove(segmentPath(s.dir, seg.id))
+	}
+
+	err = os.Rename(mergedPath(s.dir, target), segmentPath(s.dir, target))
+	if err != nil {
+		return fmt.Errorf("failed to replace merged segments: %v", err)
+	}
+
+	seg, err := openSegment(s.dir, target)
+	if err != nil {
+		return err
+	}
+	s.segments[target] = seg
+
+	// Keys written since the merge began already point at the active segment, and keep their expiry.
+	for k, l := range moved {
+		cur, ok := s.keydir[k]
+		if !ok || cur.segment != live[k].segment || cur.offset != live[k].offset {
+			continue
+		}
+		l.expiresAt = cur.expiresAt
+		s.keydir[k] = l
+	}
+
+	logrus.Debugf("Merged %d segments into segment %d with %d keys", len(inputs), target, len(moved))
+	return nil
+}
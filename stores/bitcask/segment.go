@@ -0,0 +1,160 @@
+package bitcask
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/christianalexander/kvdb/protobuf"
+	"github.com/christianalexander/kvdb/stores"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	segmentSuffix = ".data"
+	mergedSuffix  = ".merged"
+	tmpSuffix     = ".tmp"
+)
+
+// A segment is one data file. Only the newest segment is written to.
+type segment struct {
+	id   uint64
+	file *os.File
+	size int64
+}
+
+func segmentPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+func parseSegmentID(name, suffix string) (uint64, bool) {
+	if !strings.HasSuffix(name, suffix) {
+		return 0, false
+	}
+
+	id, err := strconv.ParseUint(strings.TrimSuffix(name, suffix), 10, 64)
+	return id, err == nil
+}
+
+func openSegment(dir string, id uint64) (*segment, error) {
+	f, err := os.OpenFile(segmentPath(dir, id), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0664)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open segment %d: %v", id, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to stat segment %d: %v", id, err)
+	}
+
+	return &segment{id: id, file: f, size: info.Size()}, nil
+}
+
+// Write appends to the segment, keeping track of its size so records can be located.
+func (s *segment) Write(p []byte) (int, error) {
+	n, err := s.file.Write(p)
+	s.size += int64(n)
+	return n, err
+}
+
+// readAt reads the record framed at an offset.
+func (s *segment) readAt(offset, length int64) (stores.Record, error) {
+	r := bufio.NewReaderSize(io.NewSectionReader(s.file, offset, length), int(length))
+	return protobuf.ReadRecord(r)
+}
+
+// scan calls fn with each record of the segment and the offset and length of its frame.
+func (s *segment) scan(fn func(r stores.Record, offset, length int64)) error {
+	cr := &countingReader{r: bufio.NewReader(io.NewSectionReader(s.file, 0, s.size))}
+	for {
+		offset := cr.n
+		record, err := protobuf.ReadRecord(cr)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("segment %d at offset %d: %v", s.id, offset, err)
+		}
+
+		fn(record, offset, cr.n-offset)
+	}
+}
+
+// countingReader counts the bytes consumed through a buffered reader.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// listSegments returns the IDs of the data files in a directory, oldest first.
+// A merge that was interrupted after its output was complete is finished first.
+func listSegments(dir string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list bitcask directory '%s': %v", dir, err)
+	}
+
+	var ids []uint64
+	var merged []uint64
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), tmpSuffix) {
+			logrus.Warnf("Removing incomplete merge output '%s'", f.Name())
+			os.Remove(filepath.Join(dir, f.Name()))
+			continue
+		}
+		if id, ok := parseSegmentID(f.Name(), segmentSuffix); ok {
+			ids = append(ids, id)
+		}
+		if id, ok := parseSegmentID(f.Name(), mergedSuffix); ok {
+			merged = append(merged, id)
+		}
+	}
+
+	for _, m := range merged {
+		logrus.Warnf("Finishing interrupted merge into segment %d", m)
+		kept := ids[:0]
+		for _, id := range ids {
+			if id <= m {
+				os.Remove(segmentPath(dir, id))
+				continue
+			}
+			kept = append(kept, id)
+		}
+		ids = kept
+
+		err := os.Rename(mergedPath(dir, m), segmentPath(dir, m))
+		if err != nil {
+			return nil, fmt.Errorf("failed to finish merge into segment %d: %v", m, err)
+		}
+		ids = append(ids, m)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids, nil
+}
+
+func mergedPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", id, mergedSuffix))
+}
@@ -0,0 +1,34 @@
+package stores
+
+import "context"
+
+// A ByteStore is a Store that takes and returns values as byte slices, which may hold any bytes,
+// including CR, LF and NUL. Values set as bytes read back unchanged through Get, and the other way around.
+type ByteStore interface {
+	Store
+	SetBytes(ctx context.Context, key string, value []byte) error
+	GetBytes(ctx context.Context, key string) ([]byte, error)
+}
+
+// SetBytes sets a value held as a byte slice, through the store's ByteStore methods if it has them.
+func SetBytes(ctx context.Context, store Store, key string, value []byte) error {
+	if bs, ok := store.(ByteStore); ok {
+		return bs.SetBytes(ctx, key, value)
+	}
+
+	return store.Set(ctx, key, string(value))
+}
+
+// GetBytes gets a value as a byte slice, through the store's ByteStore methods if it has them.
+func GetBytes(ctx context.Context, store Store, key string) ([]byte, error) {
+	if bs, ok := store.(ByteStore); ok {
+		return bs.GetBytes(ctx, key)
+	}
+
+	v, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(v), nil
+}
@@ -0,0 +1,126 @@
+package stores_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/christianalexander/kvdb/stores"
+	"github.com/christianalexander/kvdb/stores/bitcask"
+	"github.com/christianalexander/kvdb/stores/lsm"
+	"github.com/christianalexander/kvdb/wal"
+)
+
+// binaryValues are values a line protocol or a text format could not carry as they are.
+var binaryValues = map[string][]byte{
+	"crlf":    []byte("first line\r\nsecond line\r\n"),
+	"nul":     {0},
+	"mixed":   {'a', 0, '\r', '\n', 0xff, 0xfe, 0, 'z'},
+	"invalid": {0xc3, 0x28},
+	"empty":   {},
+}
+
+func setBinaryValues(t *testing.T, store stores.Store) {
+	t.Helper()
+
+	ctx := context.WithValue(context.Background(), stores.ContextKeyTransactionID, int64(0))
+	for k, v := range binaryValues {
+		// The value is changed afterwards, to check that the store kept a copy.
+		value := append([]byte(nil), v...)
+		if err := stores.SetBytes(ctx, store, k, value); err != nil {
+			t.Fatalf("set %s: %v", k, err)
+		}
+		for i := range value {
+			value[i] = '?'
+		}
+	}
+}
+
+func assertBinaryValues(t *testing.T, store stores.Store) {
+	t.Helper()
+
+	ctx := context.WithValue(context.Background(), stores.ContextKeyTransactionID, int64(0))
+	for k, want := range binaryValues {
+		got, err := stores.GetBytes(ctx, store, k)
+		if err != nil {
+			t.Fatalf("get %s: %v", k, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got %q, want %q", k, got, want)
+		}
+
+		s, err := store.Get(ctx, k)
+		if err != nil || s != string(want) {
+			t.Errorf("%s as a string: got %q, %v, want %q", k, s, err, want)
+		}
+	}
+}
+
+func TestByteStores(t *testing.T) {
+	for name, open := range map[string]func(dir string) (stores.Store, error){
+		"memory": func(string) (stores.Store, error) { return stores.NewInMemoryStore(), nil },
+		"lsm":    func(dir string) (stores.Store, error) { return lsm.Open(dir, lsm.Options{}) },
+		"bitcask": func(dir string) (stores.Store, error) {
+			return bitcask.Open(dir, bitcask.Options{})
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := open(dir)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			if _, ok := store.(stores.ByteStore); !ok {
+				t.Fatalf("%T is not a ByteStore", store)
+			}
+
+			setBinaryValues(t, store)
+			assertBinaryValues(t, store)
+
+			disk, ok := store.(stores.DiskStore)
+			if !ok {
+				return
+			}
+			if err := disk.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+			store, err = open(dir)
+			if err != nil {
+				t.Fatalf("reopen: %v", err)
+			}
+			defer store.(stores.DiskStore).Close()
+			assertBinaryValues(t, store)
+		})
+	}
+}
+
+func TestByteStoreReplay(t *testing.T) {
+	for _, format := range []wal.Format{wal.FormatProtobuf, wal.FormatJSON} {
+		t.Run(string(format), func(t *testing.T) {
+			dir := t.TempDir()
+			log, err := wal.Open(dir, wal.Options{Format: format})
+			if err != nil {
+				t.Fatalf("open log: %v", err)
+			}
+
+			store := stores.WithPersistence(format.NewWriter(log), stores.NewInMemoryStore())
+			if _, ok := store.(stores.ByteStore); !ok {
+				t.Fatalf("%T is not a ByteStore", store)
+			}
+			setBinaryValues(t, store)
+			log.Close()
+
+			log, err = wal.Open(dir, wal.Options{})
+			if err != nil {
+				t.Fatalf("reopen log: %v", err)
+			}
+			defer log.Close()
+
+			replayed := stores.NewInMemoryStore()
+			if _, err := wal.Replay(context.Background(), log, replayed, stores.ReplayOptions{}); err != nil {
+				t.Fatalf("replay: %v", err)
+			}
+			assertBinaryValues(t, replayed)
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package stores
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// WriteCheckpoint writes the state of a store as a checkpoint: a set record for every live key,
+// an expire record for every key with an expiry, and a closing checkpoint record carrying the
+// ID of the last transaction the state includes.
+//
+// The store must not be written to while the checkpoint is taken, and must not hold
+// uncommitted writes, or they would be captured as committed state.
+func WriteCheckpoint(ctx context.Context, store Store, writer Writer, lastTransactionID int64) error {
+	it, err := store.Scan(ctx, "", "", 0)
+	if err != nil {
+		return fmt.Errorf("failed to scan store for checkpoint: %v", err)
+	}
+	defer it.Close()
+
+	count := 0
+	for it.Next() {
+		err := writer.Write(ctx, Record{Kind: RecordKindSet, Key: it.Key(), Value: it.Value()})
+		if err != nil {
+			return fmt.Errorf("failed to write checkpoint record: %v", err)
+		}
+
+		expiresAt, err := store.Expiry(ctx, it.Key())
+		if err != nil {
+			return fmt.Errorf("failed to read expiry for checkpoint: %v", err)
+		}
+		if !expiresAt.IsZero() {
+			err = writer.Write(ctx, Record{Kind: RecordKindExpire, Key: it.Key(), ExpiresAt: expiresAt})
+			if err != nil {
+				return fmt.Errorf("failed to write checkpoint record: %v", err)
+			}
+		}
+		count++
+	}
+	if err := it.Err(); err != nil {
+		return fmt.Errorf("failed to scan store for checkpoint: %v", err)
+	}
+
+	err = writer.Write(ctx, Record{Kind: RecordKindCheckpoint, TransactionID: lastTransactionID, Timestamp: time.Now()})
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint record: %v", err)
+	}
+
+	logrus.Infof("Wrote checkpoint of %d keys at txID %d", count, lastTransactionID)
+	return nil
+}
+
+// FromCheckpoint loads a checkpoint into a store, returning its closing checkpoint record, which
+// holds the ID of the last transaction it includes and when it was written.
+// A checkpoint that does not end with a checkpoint record was not completely written, and is rejected.
+func FromCheckpoint(ctx context.Context, reader Reader, store Store) (Record, error) {
+	readCtx, cancel := context.WithCancel(ctx)
+	records := make(chan Record)
+	readErr := make(chan error, 1)
+
+	go func() {
+		readErr <- reader.Read(readCtx, records)
+		close(records)
+	}()
+
+	// On an early return, the reader is cancelled and the records it still sends are discarded,
+	// so that it is not left blocked.
+	defer func() {
+		cancel()
+		go func() {
+			for range records {
+			}
+		}()
+	}()
+
+	var checkpoint *Record
+	for {
+		select {
+		case <-ctx.Done():
+			return Record{}, ctx.Err()
+		case r, ok := <-records:
+			if !ok {
+				if err := <-readErr; err != nil && err != io.EOF {
+					return Record{}, fmt.Errorf("failed to read checkpoint: %v", err)
+				}
+				if checkpoint == nil {
+					return Record{}, fmt.Errorf("checkpoint is incomplete")
+				}
+				return *checkpoint, nil
+			}
+
+			var err error
+			switch r.Kind {
+			case RecordKindSet:
+				err = store.Set(ctx, r.Key, r.Value)
+			case RecordKindExpire:
+				err = store.Expire(ctx, r.Key, r.ExpiresAt)
+			case RecordKindCheckpoint:
+				checkpoint = &r
+			default:
+				err = fmt.Errorf("unexpected '%s' record in checkpoint", r.Kind)
+			}
+			if err != nil {
+				return Record{}, fmt.Errorf("failed to load checkpoint: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package stores_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/christianalexander/kvdb/stores"
+)
+
+// sliceReader sends its records, then returns err. done is closed when Read returns.
+type sliceReader struct {
+	records []stores.Record
+	err     error
+	done    chan struct{}
+}
+
+func (r sliceReader) Read(ctx context.Context, records chan<- stores.Record) error {
+	defer close(r.done)
+
+	for _, record := range r.records {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case records <- record:
+		}
+	}
+
+	return r.err
+}
+
+// failingStore fails every Set.
+type failingStore struct {
+	stores.Store
+}
+
+func (s failingStore) Set(ctx context.Context, key, value string) error {
+	return errors.New("disk full")
+}
+
+func TestFromCheckpoint(t *testing.T) {
+	closing := stores.Record{Kind: stores.RecordKindCheckpoint, TransactionID: 7}
+	set := stores.Record{Kind: stores.RecordKindSet, Key: "k", Value: "v"}
+	readErr := errors.New("bad checksum")
+
+	for name, tc := range map[string]struct {
+		records []stores.Record
+		err     error
+		store   stores.Store
+		wantErr bool
+	}{
+		"complete":   {records: []stores.Record{set, closing}, store: stores.NewInMemoryStore()},
+		"incomplete": {records: []stores.Record{set}, store: stores.NewInMemoryStore(), wantErr: true},
+		"read error": {records: []stores.Record{set, closing}, err: readErr, store: stores.NewInMemoryStore(), wantErr: true},
+		// The store fails on the first record, with the rest of the checkpoint still to be read.
+		"store error": {records: []stores.Record{set, set, set, closing}, store: failingStore{stores.NewInMemoryStore()}, wantErr: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			reader := sliceReader{tc.records, tc.err, make(chan struct{})}
+			checkpoint, err := stores.FromCheckpoint(context.Background(), reader, tc.store)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("got checkpoint %+v, want an error", checkpoint)
+				}
+			} else if err != nil || checkpoint.TransactionID != 7 {
+				t.Errorf("got %+v, %v, want the checkpoint at txID 7", checkpoint, err)
+			}
+
+			select {
+			case <-reader.done:
+			case <-time.After(time.Second):
+				t.Fatal("the reader was left running")
+			}
+		})
+	}
+}
@@ -6,3 +6,14 @@ type contextKey struct {
 
 // ContextKeyTransactionID is a context key for the transaction ID.
 var ContextKeyTransactionID = contextKey{"TXID"}
+
+// ContextKeyLockTimeout is a context key for how long a lock is waited for, as a time.Duration.
+// Zero waits for as long as the context lasts.
+var ContextKeyLockTimeout = contextKey{"LOCK_TIMEOUT"}
+
+// ContextKeyIsolationLevel is a context key for the IsolationLevel of the transaction.
+// Stores use their own level when it is missing.
+var ContextKeyIsolationLevel = contextKey{"ISOLATION_LEVEL"}
+
+// ContextKeyReadOnly is a context key for whether the transaction is read-only, as a bool.
+var ContextKeyReadOnly = contextKey{"READ_ONLY"}
@@ -0,0 +1,61 @@
+package stores
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// A Corruption describes the first invalid record found in a log.
+type Corruption struct {
+	// Offset is where the invalid record starts.
+	Offset int64
+	// Resume is where the next valid record starts, or -1 if no valid record follows.
+	Resume int64
+	Err    error
+}
+
+// Torn reports whether the corruption runs to the end of the log, as a crash part-way through a write leaves it.
+func (c *Corruption) Torn() bool {
+	return c.Resume < 0
+}
+
+func (c *Corruption) Error() string {
+	if c.Torn() {
+		return fmt.Sprintf("torn record at offset %d: %v", c.Offset, c.Err)
+	}
+
+	return fmt.Sprintf("corrupt record at offset %d, valid records resume at offset %d: %v", c.Offset, c.Resume, c.Err)
+}
+
+// A VerifyFunc reads every record of a log, returning the number of valid records before the first corruption, if any.
+type VerifyFunc func(r io.ReaderAt, size int64) (records int, corruption *Corruption, err error)
+
+// RecoverLog verifies a log file and truncates it at the first corruption, returning the
+// corruption that was removed. A torn tail is always removed. Corruption followed by valid
+// records is only removed if repair is set, as the records after it are lost; otherwise it
+// is returned as an error.
+func RecoverLog(f *os.File, verify VerifyFunc, repair bool) (*Corruption, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat log '%s': %v", f.Name(), err)
+	}
+
+	_, corruption, err := verify(f, info.Size())
+	if err != nil || corruption == nil {
+		return nil, err
+	}
+	if !corruption.Torn() && !repair {
+		return nil, fmt.Errorf("log '%s' has a %v", f.Name(), corruption)
+	}
+
+	err = f.Truncate(corruption.Offset)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to truncate log '%s': %v", f.Name(), err)
+	}
+
+	return corruption, nil
+}
@@ -0,0 +1,402 @@
+package deferred
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/christianalexander/kvdb/stores"
+	"github.com/sirupsen/logrus"
+)
+
+// deferredStore gives every transaction a private write buffer, making transactions redo-only.
+//
+// Writes are held in the buffer of the transaction that made them, which reads them back over
+// the inner store. Nothing reaches the inner store, and so the log, until Commit applies the
+// whole buffer. A transaction that rolls back only has its buffer discarded, so nothing needs to
+// be undone, and a crash can not leave part of a transaction applied.
+//
+// The store does not isolate transactions from each other's commits; wrap it in a locking store
+// for that.
+type deferredStore struct {
+	inner stores.Store
+
+	mu  sync.Mutex
+	txs map[int64]map[string]write
+	// savepoints holds copies of the write buffer of each transaction, oldest first.
+	savepoints map[int64][]map[string]write
+}
+
+// A write is the buffered change to a key.
+type write struct {
+	deleted bool
+	// set is whether the value was written. Otherwise, only the expiry was changed.
+	set   bool
+	value string
+	// expire is whether expiresAt was set after the value, or instead of it.
+	expire    bool
+	expiresAt time.Time
+}
+
+func (w write) visible(now time.Time) bool {
+	return !w.deleted && (w.expiresAt.IsZero() || now.Before(w.expiresAt))
+}
+
+// NewStore returns a store that buffers the writes of each transaction until it commits.
+// The returned store is a stores.TransactionalStore, and commits its writes to store.
+func NewStore(store stores.Store) stores.Store {
+	return &deferredStore{
+		inner:      store,
+		txs:        make(map[int64]map[string]write),
+		savepoints: make(map[int64][]map[string]write),
+	}
+}
+
+func txIDFromContext(ctx context.Context) int64 {
+	txID, _ := ctx.Value(stores.ContextKeyTransactionID).(int64)
+	return txID
+}
+
+func (s *deferredStore) Begin(ctx context.Context) error {
+	txID := txIDFromContext(ctx)
+	if txID == 0 {
+		return fmt.Errorf("deferred store could not begin without a transaction ID")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.buffer(txID)
+
+	return nil
+}
+
+// buffer returns the write buffer of a transaction, creating it if needed. The caller must hold the lock.
+func (s *deferredStore) buffer(txID int64) map[string]write {
+	writes, ok := s.txs[txID]
+	if !ok {
+		writes = make(map[string]write)
+		s.txs[txID] = writes
+	}
+
+	return writes
+}
+
+// lookup returns the buffered write to a key by the transaction in the context, if there is one.
+func (s *deferredStore) lookup(ctx context.Context, key string) (write, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w, ok := s.txs[txIDFromContext(ctx)][key]
+	return w, ok
+}
+
+func (s *deferredStore) Get(ctx context.Context, key string) (string, error) {
+	w, ok := s.lookup(ctx, key)
+	if !ok {
+		return s.inner.Get(ctx, key)
+	}
+
+	w, err := s.resolve(ctx, key, w)
+	return w.value, err
+}
+
+func (s *deferredStore) Expiry(ctx context.Context, key string) (time.Time, error) {
+	w, ok := s.lookup(ctx, key)
+	if !ok {
+		return s.inner.Expiry(ctx, key)
+	}
+
+	w, err := s.resolve(ctx, key, w)
+	return w.expiresAt, err
+}
+
+// resolve returns a buffered write with the value it leaves the key with, or an error if the key is gone.
+func (s *deferredStore) resolve(ctx context.Context, key string, w write) (write, error) {
+	if !w.set && !w.deleted {
+		// Only the expiry was changed, so the value is still that of the inner store.
+		value, err := s.inner.Get(ctx, key)
+		if err != nil {
+			return write{}, err
+		}
+		w.value = value
+	}
+	if !w.visible(time.Now()) {
+		return write{}, fmt.Errorf("value for key '%s' not found", key)
+	}
+
+	return w, nil
+}
+
+func (s *deferredStore) Set(ctx context.Context, key, value string) error {
+	txID := txIDFromContext(ctx)
+	if txID == 0 {
+		return fmt.Errorf("deferred store could not set without a transaction ID")
+	}
+
+	s.mu.Lock()
+	s.buffer(txID)[key] = write{set: true, value: value}
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *deferredStore) Delete(ctx context.Context, key string) error {
+	txID := txIDFromContext(ctx)
+	if txID == 0 {
+		return fmt.Errorf("deferred store could not delete without a transaction ID")
+	}
+
+	s.mu.Lock()
+	s.buffer(txID)[key] = write{deleted: true}
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *deferredStore) Expire(ctx context.Context, key string, at time.Time) error {
+	txID := txIDFromContext(ctx)
+	if txID == 0 {
+		return fmt.Errorf("deferred store could not expire without a transaction ID")
+	}
+
+	// The key must exist as the transaction sees it, as it must for the inner store.
+	if _, err := s.Get(ctx, key); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	writes := s.buffer(txID)
+	w := writes[key]
+	w.expire = true
+	w.expiresAt = at
+	writes[key] = w
+
+	return nil
+}
+
+func (s *deferredStore) Keys(ctx context.Context) ([]string, error) {
+	it, err := s.Scan(ctx, "", "", 0)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+
+	return keys, it.Err()
+}
+
+// Scan merges the keys of the inner store with the writes buffered by the transaction in the context.
+func (s *deferredStore) Scan(ctx context.Context, start, end string, limit int) (stores.Iterator, error) {
+	s.mu.Lock()
+	var writes map[string]write
+	for k, w := range s.txs[txIDFromContext(ctx)] {
+		if stores.InRange(k, start, end) {
+			if writes == nil {
+				writes = make(map[string]write)
+			}
+			writes[k] = w
+		}
+	}
+	s.mu.Unlock()
+
+	if len(writes) == 0 {
+		return s.inner.Scan(ctx, start, end, limit)
+	}
+
+	values := make(map[string]string)
+	it, err := s.inner.Scan(ctx, start, end, 0)
+	if err != nil {
+		return nil, err
+	}
+	for it.Next() {
+		values[it.Key()] = it.Value()
+	}
+	err = it.Err()
+	it.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for k, w := range writes {
+		if _, ok := values[k]; !ok && !w.set {
+			continue
+		}
+		switch {
+		case !w.visible(now):
+			delete(values, k)
+		case w.set:
+			values[k] = w.value
+		}
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	result := make([]stores.KeyValue, 0, len(keys))
+	for _, k := range keys {
+		result = append(result, stores.KeyValue{Key: k, Value: values[k]})
+	}
+
+	return stores.NewIterator(result), nil
+}
+
+// Commit applies the buffered writes of the transaction to the inner store, in key order.
+// If the inner store fails a write, the keys already written are put back as they were, so
+// that the transaction is not left partly applied.
+func (s *deferredStore) Commit(ctx context.Context) error {
+	txID := txIDFromContext(ctx)
+
+	s.mu.Lock()
+	writes := s.txs[txID]
+	delete(s.txs, txID)
+	delete(s.savepoints, txID)
+	s.mu.Unlock()
+
+	keys := make([]string, 0, len(writes))
+	for k := range writes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	images := make([]image, 0, len(keys))
+	for i, k := range keys {
+		images = append(images, s.image(ctx, k))
+
+		err := s.apply(ctx, k, writes[k])
+		if err != nil {
+			// The failed write may have set the value before failing to set its expiry, so it is undone too.
+			s.undo(ctx, keys[:i+1], images)
+			return fmt.Errorf("failed to apply committed write for key '%s': %v", k, err)
+		}
+	}
+
+	logrus.WithField("txID", txID).Debugf("Applied %d deferred writes", len(keys))
+
+	return nil
+}
+
+// An image is the state of a key in the inner store from before a commit wrote to it.
+type image struct {
+	exists    bool
+	value     string
+	expiresAt time.Time
+}
+
+func (s *deferredStore) image(ctx context.Context, key string) image {
+	value, err := s.inner.Get(ctx, key)
+	if err != nil {
+		return image{}
+	}
+	expiresAt, _ := s.inner.Expiry(ctx, key)
+
+	return image{exists: true, value: value, expiresAt: expiresAt}
+}
+
+// undo puts keys back in the inner store as they were before a commit failed, newest write first.
+func (s *deferredStore) undo(ctx context.Context, keys []string, images []image) {
+	for i := len(keys) - 1; i >= 0; i-- {
+		err := s.restore(ctx, keys[i], images[i])
+		if err != nil {
+			logrus.Errorf("Failed to undo write for key '%s' of a failed commit: %v", keys[i], err)
+		}
+	}
+}
+
+// restore writes an image of a key back to the inner store.
+func (s *deferredStore) restore(ctx context.Context, key string, img image) error {
+	if !img.exists {
+		return s.inner.Delete(ctx, key)
+	}
+
+	err := s.inner.Set(ctx, key, img.value)
+	if err != nil || img.expiresAt.IsZero() {
+		return err
+	}
+
+	return s.inner.Expire(ctx, key, img.expiresAt)
+}
+
+// apply writes a buffered write to the inner store.
+func (s *deferredStore) apply(ctx context.Context, key string, w write) error {
+	if w.deleted {
+		return s.inner.Delete(ctx, key)
+	}
+
+	if w.set {
+		err := s.inner.Set(ctx, key, w.value)
+		if err != nil || !w.expire || w.expiresAt.IsZero() {
+			return err
+		}
+	}
+
+	return s.inner.Expire(ctx, key, w.expiresAt)
+}
+
+// Savepoint keeps a copy of the write buffer of the transaction in the context.
+func (s *deferredStore) Savepoint(ctx context.Context) (int, error) {
+	txID := txIDFromContext(ctx)
+	if txID == 0 {
+		return 0, fmt.Errorf("deferred store could not take a savepoint without a transaction ID")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.savepoints[txID] = append(s.savepoints[txID], copyWrites(s.buffer(txID)))
+
+	return len(s.savepoints[txID]) - 1, nil
+}
+
+// RollbackTo restores the write buffer of the transaction in the context from a savepoint.
+func (s *deferredStore) RollbackTo(ctx context.Context, savepoint int) error {
+	txID := txIDFromContext(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	savepoints := s.savepoints[txID]
+	if savepoint < 0 || savepoint >= len(savepoints) {
+		return fmt.Errorf("transaction %d has no savepoint %d", txID, savepoint)
+	}
+
+	// The savepoint is kept, so that the transaction can roll back to it again.
+	s.txs[txID] = copyWrites(savepoints[savepoint])
+	s.savepoints[txID] = savepoints[:savepoint+1]
+
+	return nil
+}
+
+func copyWrites(writes map[string]write) map[string]write {
+	c := make(map[string]write, len(writes))
+	for k, w := range writes {
+		c[k] = w
+	}
+
+	return c
+}
+
+// Release discards any writes the transaction did not commit.
+func (s *deferredStore) Release(ctx context.Context) {
+	s.mu.Lock()
+	delete(s.txs, txIDFromContext(ctx))
+	delete(s.savepoints, txIDFromContext(ctx))
+	s.mu.Unlock()
+
+	s.inner.Release(ctx)
+}
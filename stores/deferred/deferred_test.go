@@ -0,0 +1,77 @@
+package deferred
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/christianalexander/kvdb/stores"
+)
+
+func txContext(txID int64) context.Context {
+	return context.WithValue(context.Background(), stores.ContextKeyTransactionID, txID)
+}
+
+// failingStore fails to set one key.
+type failingStore struct {
+	stores.Store
+	key string
+}
+
+func (s failingStore) Set(ctx context.Context, key, value string) error {
+	if key == s.key {
+		return errors.New("disk full")
+	}
+
+	return s.Store.Set(ctx, key, value)
+}
+
+func TestCommitIsAtomic(t *testing.T) {
+	inner := stores.NewInMemoryStore()
+	expiresAt := time.Now().Add(time.Hour)
+	setup := txContext(1)
+	for _, k := range []string{"a", "b"} {
+		if err := inner.Set(setup, k, "old"); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	if err := inner.Expire(setup, "a", expiresAt); err != nil {
+		t.Fatalf("expire: %v", err)
+	}
+
+	// Keys are applied in order, so a, b and c are written before d fails.
+	s := NewStore(failingStore{inner, "d"}).(stores.TransactionalStore)
+	ctx := txContext(2)
+	if err := s.Begin(ctx); err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	for _, write := range []func() error{
+		func() error { return s.Set(ctx, "a", "new") },
+		func() error { return s.Delete(ctx, "b") },
+		func() error { return s.Set(ctx, "c", "new") },
+		func() error { return s.Set(ctx, "d", "new") },
+	} {
+		if err := write(); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if err := s.Commit(ctx); err == nil {
+		t.Fatal("commit succeeded, although a write failed")
+	}
+	s.Release(ctx)
+
+	for _, k := range []string{"a", "b"} {
+		if v, err := inner.Get(setup, k); err != nil || v != "old" {
+			t.Errorf("%s after a failed commit: got %s, %v, want old", k, v, err)
+		}
+	}
+	if at, err := inner.Expiry(setup, "a"); err != nil || !at.Equal(expiresAt) {
+		t.Errorf("expiry of a after a failed commit: got %v, %v, want %v", at, err, expiresAt)
+	}
+	for _, k := range []string{"c", "d"} {
+		if v, err := inner.Get(setup, k); err == nil {
+			t.Errorf("%s=%s after a failed commit", k, v)
+		}
+	}
+}
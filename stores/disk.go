@@ -0,0 +1,9 @@
+package stores
+
+import "io"
+
+// A DiskStore is a Store kept in files, which must be closed to flush what it buffers in memory.
+type DiskStore interface {
+	Store
+	io.Closer
+}
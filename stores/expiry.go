@@ -0,0 +1,31 @@
+package stores
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// An ExpiredRemover is a store that can reclaim the space used by expired keys.
+type ExpiredRemover interface {
+	RemoveExpired(now time.Time) int
+}
+
+// SweepExpired periodically removes expired keys from a store until the context is done.
+// Expired keys are already invisible to readers, so sweeping only reclaims space and is not logged.
+func SweepExpired(ctx context.Context, store ExpiredRemover, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if n := store.RemoveExpired(now); n > 0 {
+				logrus.Debugf("Swept %d expired keys", n)
+			}
+		}
+	}
+}
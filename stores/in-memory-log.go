@@ -4,16 +4,28 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
+
+	"github.com/christianalexander/kvdb/stores/skiplist"
 )
 
 type inMemoryStore struct {
 	mu     sync.RWMutex
-	values map[string]string
+	values *skiplist.List
+}
+
+type inMemoryEntry struct {
+	value     string
+	expiresAt time.Time
+}
+
+func (e inMemoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
 }
 
 func NewInMemoryStore() Store {
 	return &inMemoryStore{
-		values: make(map[string]string),
+		values: skiplist.New(),
 	}
 }
 
@@ -21,28 +33,57 @@ func (s *inMemoryStore) Set(ctx context.Context, key string, value string) error
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.values[key] = value
+	s.values.Set(key, inMemoryEntry{value: value})
 
 	return nil
 }
 
+// get returns the live entry for a key. The caller must hold the lock.
+func (s *inMemoryStore) get(key string) (inMemoryEntry, bool) {
+	v, ok := s.values.Get(key)
+	if !ok {
+		return inMemoryEntry{}, false
+	}
+
+	e := v.(inMemoryEntry)
+	if e.expired(time.Now()) {
+		return inMemoryEntry{}, false
+	}
+
+	return e, true
+}
+
 func (s *inMemoryStore) Get(ctx context.Context, key string) (string, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	v, ok := s.values[key]
+	e, ok := s.get(key)
 	if !ok {
 		return "", fmt.Errorf("value for key '%s' not found", key)
 	}
 
-	return v, nil
+	return e.value, nil
+}
+
+// SetBytes sets a value held as a byte slice, which is copied, so the caller may reuse it.
+func (s *inMemoryStore) SetBytes(ctx context.Context, key string, value []byte) error {
+	return s.Set(ctx, key, string(value))
+}
+
+func (s *inMemoryStore) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	v, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(v), nil
 }
 
 func (s *inMemoryStore) Delete(ctx context.Context, key string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	delete(s.values, key)
+	s.values.Delete(key)
 
 	return nil
 }
@@ -51,12 +92,83 @@ func (s *inMemoryStore) Keys(ctx context.Context) ([]string, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	now := time.Now()
 	var result []string
-	for k := range s.values {
-		result = append(result, k)
+	for e := s.values.Front(); e != nil; e = e.Next() {
+		if e.Value.(inMemoryEntry).expired(now) {
+			continue
+		}
+		result = append(result, e.Key)
 	}
 
 	return result, nil
 }
 
+func (s *inMemoryStore) Scan(ctx context.Context, start, end string, limit int) (Iterator, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	var result []KeyValue
+	for e := s.values.Seek(start); e != nil && InRange(e.Key, start, end); e = e.Next() {
+		if limit > 0 && len(result) == limit {
+			break
+		}
+
+		entry := e.Value.(inMemoryEntry)
+		if entry.expired(now) {
+			continue
+		}
+		result = append(result, KeyValue{e.Key, entry.value})
+	}
+
+	return NewIterator(result), nil
+}
+
+func (s *inMemoryStore) Expire(ctx context.Context, key string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.get(key)
+	if !ok {
+		return fmt.Errorf("value for key '%s' not found", key)
+	}
+
+	e.expiresAt = at
+	s.values.Set(key, e)
+
+	return nil
+}
+
+func (s *inMemoryStore) Expiry(ctx context.Context, key string) (time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.get(key)
+	if !ok {
+		return time.Time{}, fmt.Errorf("value for key '%s' not found", key)
+	}
+
+	return e.expiresAt, nil
+}
+
+// RemoveExpired deletes every key whose expiry has passed, returning how many were removed.
+func (s *inMemoryStore) RemoveExpired(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expired []string
+	for e := s.values.Front(); e != nil; e = e.Next() {
+		if e.Value.(inMemoryEntry).expired(now) {
+			expired = append(expired, e.Key)
+		}
+	}
+
+	for _, k := range expired {
+		s.values.Delete(k)
+	}
+
+	return len(expired)
+}
+
 func (s *inMemoryStore) Release(context.Context) {}
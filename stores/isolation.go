@@ -0,0 +1,52 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrReadOnlyTransaction is returned by a write in a read-only transaction.
+var ErrReadOnlyTransaction = errors.New("cannot write in a read-only transaction")
+
+// An IsolationLevel is how far a transaction is isolated from concurrent transactions, as named by SQL.
+type IsolationLevel string
+
+const (
+	// IsolationReadCommitted sees only committed writes, but may see a different value each time it reads a key.
+	IsolationReadCommitted IsolationLevel = "READ COMMITTED"
+	// IsolationRepeatableRead sees the same value each time it reads a key, but may not be serializable.
+	IsolationRepeatableRead IsolationLevel = "REPEATABLE READ"
+	// IsolationSerializable has the same result as some serial order of the transactions.
+	IsolationSerializable IsolationLevel = "SERIALIZABLE"
+)
+
+// ParseIsolationLevel parses the name of an isolation level, in any case.
+func ParseIsolationLevel(name string) (IsolationLevel, error) {
+	switch l := IsolationLevel(strings.ToUpper(strings.Join(strings.Fields(name), " "))); l {
+	case IsolationReadCommitted, IsolationRepeatableRead, IsolationSerializable:
+		return l, nil
+	}
+
+	return "", fmt.Errorf("unknown isolation level '%s': expected '%s', '%s' or '%s'", name, IsolationReadCommitted, IsolationRepeatableRead, IsolationSerializable)
+}
+
+// IsolationLevelFromContext returns the isolation level of the transaction in a context, or a store's own level if it has none.
+func IsolationLevelFromContext(ctx context.Context, own IsolationLevel) IsolationLevel {
+	if level, ok := ctx.Value(ContextKeyIsolationLevel).(IsolationLevel); ok && level != "" {
+		return level
+	}
+
+	return own
+}
+
+// CheckWritable returns ErrReadOnlyTransaction if the transaction in a context is read-only.
+func CheckWritable(ctx context.Context, key string) error {
+	if readOnly, _ := ctx.Value(ContextKeyReadOnly).(bool); readOnly {
+		txID, _ := ctx.Value(ContextKeyTransactionID).(int64)
+		return fmt.Errorf("%w: transaction %d can not write '%s'", ErrReadOnlyTransaction, txID, key)
+	}
+
+	return nil
+}
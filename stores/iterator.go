@@ -0,0 +1,79 @@
+package stores
+
+import "context"
+
+// An Iterator walks over key/value pairs in key order.
+type Iterator interface {
+	// Next advances the iterator, returning false once it is exhausted.
+	Next() bool
+	Key() string
+	Value() string
+	Err() error
+	Close() error
+}
+
+// A KeyValue is a single entry of a store.
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+type sliceIterator struct {
+	pairs []KeyValue
+	pos   int
+}
+
+// NewIterator returns an Iterator over an already sorted slice of pairs.
+func NewIterator(pairs []KeyValue) Iterator {
+	return &sliceIterator{pairs: pairs, pos: -1}
+}
+
+func (it *sliceIterator) Next() bool {
+	if it.pos+1 >= len(it.pairs) {
+		it.pos = len(it.pairs)
+		return false
+	}
+	it.pos++
+
+	return true
+}
+
+func (it *sliceIterator) Key() string {
+	return it.pairs[it.pos].Key
+}
+
+func (it *sliceIterator) Value() string {
+	return it.pairs[it.pos].Value
+}
+
+func (it *sliceIterator) Err() error {
+	return nil
+}
+
+func (it *sliceIterator) Close() error {
+	return nil
+}
+
+// ScanPrefix returns the keys of a store that begin with prefix, in ascending order.
+func ScanPrefix(ctx context.Context, store Store, prefix string, limit int) (Iterator, error) {
+	return store.Scan(ctx, prefix, PrefixEnd(prefix), limit)
+}
+
+// PrefixEnd returns the smallest key greater than every key beginning with prefix.
+// It returns an empty string, meaning no upper bound, if there is no such key.
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+
+	return ""
+}
+
+// InRange reports whether key falls within [start, end), where an empty end is unbounded.
+func InRange(key, start, end string) bool {
+	return key >= start && (end == "" || key < end)
+}
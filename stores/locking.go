@@ -0,0 +1,21 @@
+package stores
+
+import "errors"
+
+// ErrLockTimeout is returned by a store that takes locks when a lock is not granted within the lock
+// timeout. Only the statement waiting for the lock fails, so the transaction may retry it after backing off.
+var ErrLockTimeout = errors.New("lock wait timed out")
+
+// An AbortError is an error that aborts the transaction given it, such as the victim of a deadlock.
+// The transaction must be rolled back, releasing its locks, and can then be retried.
+type AbortError interface {
+	error
+	AbortsTransaction() bool
+}
+
+// AbortsTransaction reports whether an error means that the transaction given it must be rolled
+// back, releasing its locks, before it can be retried.
+func AbortsTransaction(err error) bool {
+	var abort AbortError
+	return errors.As(err, &abort) && abort.AbortsTransaction()
+}
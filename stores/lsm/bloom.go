@@ -0,0 +1,96 @@
+package lsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+)
+
+const (
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+)
+
+// A bloomFilter answers whether a key may be in a table, so that most lookups
+// for absent keys never touch the table's data.
+type bloomFilter struct {
+	hashes uint64
+	bits   []byte
+}
+
+func newBloomFilter(keys int) bloomFilter {
+	n := keys * bloomBitsPerKey
+	if n < 64 {
+		n = 64
+	}
+
+	return bloomFilter{
+		hashes: bloomHashes,
+		bits:   make([]byte, (n+7)/8),
+	}
+}
+
+// locations uses double hashing to derive every bit position from one 64-bit hash.
+func (f bloomFilter) locations(key string) (h1, h2, m uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+
+	return sum & 0xffffffff, sum >> 32, uint64(len(f.bits)) * 8
+}
+
+func (f bloomFilter) add(key string) {
+	h1, h2, m := f.locations(key)
+	for i := uint64(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % m
+		f.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+func (f bloomFilter) mayContain(key string) bool {
+	if len(f.bits) == 0 {
+		return true
+	}
+
+	h1, h2, m := f.locations(key)
+	for i := uint64(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % m
+		if f.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f bloomFilter) writeTo(w io.Writer) (int64, error) {
+	buf := make([]byte, 0, 2*binary.MaxVarintLen64+len(f.bits))
+	buf = appendUvarint(buf, f.hashes)
+	buf = appendUvarint(buf, uint64(len(f.bits)))
+	buf = append(buf, f.bits...)
+
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+func readBloomFilter(r *bufio.Reader) (bloomFilter, error) {
+	hashes, err := binary.ReadUvarint(r)
+	if err != nil {
+		return bloomFilter{}, fmt.Errorf("failed to read bloom filter: %v", err)
+	}
+
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return bloomFilter{}, fmt.Errorf("failed to read bloom filter: %v", err)
+	}
+
+	bits := make([]byte, n)
+	_, err = io.ReadFull(r, bits)
+	if err != nil {
+		return bloomFilter{}, fmt.Errorf("failed to read bloom filter: %v", err)
+	}
+
+	return bloomFilter{hashes: hashes, bits: bits}, nil
+}
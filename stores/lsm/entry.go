@@ -0,0 +1,210 @@
+package lsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/christianalexander/kvdb/stores/skiplist"
+)
+
+const flagDeleted = 1
+
+// An entry is the state of a key in a memtable or table. Deleted entries are
+// tombstones, which hide older values of the key until compaction drops them.
+type entry struct {
+	value     string
+	expiresAt time.Time
+	deleted   bool
+}
+
+// live reports whether the entry holds a value that has not expired.
+func (e entry) live(now time.Time) bool {
+	return !e.deleted && (e.expiresAt.IsZero() || now.Before(e.expiresAt))
+}
+
+func (e entry) size(key string) int {
+	return len(key) + len(e.value) + 32
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+// appendEntry encodes an entry as its key, flags, expiry and value.
+func appendEntry(buf []byte, key string, e entry) []byte {
+	var flags byte
+	if e.deleted {
+		flags |= flagDeleted
+	}
+
+	var expiresAt int64
+	if !e.expiresAt.IsZero() {
+		expiresAt = e.expiresAt.UnixNano()
+	}
+
+	buf = appendUvarint(buf, uint64(len(key)))
+	buf = append(buf, key...)
+	buf = append(buf, flags)
+	buf = appendVarint(buf, expiresAt)
+	buf = appendUvarint(buf, uint64(len(e.value)))
+	buf = append(buf, e.value...)
+
+	return buf
+}
+
+// readEntry decodes an entry written by appendEntry.
+func readEntry(r *bufio.Reader) (key string, e entry, err error) {
+	kl, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", entry{}, err
+	}
+	k := make([]byte, kl)
+	if _, err := io.ReadFull(r, k); err != nil {
+		return "", entry{}, fmt.Errorf("failed to read key: %v", err)
+	}
+
+	flags, err := r.ReadByte()
+	if err != nil {
+		return "", entry{}, fmt.Errorf("failed to read flags: %v", err)
+	}
+
+	expiresAt, err := binary.ReadVarint(r)
+	if err != nil {
+		return "", entry{}, fmt.Errorf("failed to read expiry: %v", err)
+	}
+
+	vl, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", entry{}, fmt.Errorf("failed to read value length: %v", err)
+	}
+	v := make([]byte, vl)
+	if _, err := io.ReadFull(r, v); err != nil {
+		return "", entry{}, fmt.Errorf("failed to read value: %v", err)
+	}
+
+	e = entry{value: string(v), deleted: flags&flagDeleted != 0}
+	if expiresAt != 0 {
+		e.expiresAt = time.Unix(0, expiresAt)
+	}
+
+	return string(k), e, nil
+}
+
+// An entryIterator walks entries in key order.
+type entryIterator interface {
+	next() bool
+	key() string
+	entry() entry
+	err() error
+}
+
+// memtableIterator walks a memtable. The memtable must not change while it is in use.
+type memtableIterator struct {
+	e       *skiplist.Element
+	started bool
+	end     string
+}
+
+func newMemtableIterator(memtable *skiplist.List, start, end string) *memtableIterator {
+	return &memtableIterator{e: memtable.Seek(start), end: end}
+}
+
+func (it *memtableIterator) next() bool {
+	if it.started && it.e != nil {
+		it.e = it.e.Next()
+	}
+	it.started = true
+
+	return it.e != nil && (it.end == "" || it.e.Key < it.end)
+}
+
+func (it *memtableIterator) key() string {
+	return it.e.Key
+}
+
+func (it *memtableIterator) entry() entry {
+	return it.e.Value.(entry)
+}
+
+func (it *memtableIterator) err() error {
+	return nil
+}
+
+// mergeIterator merges iterators ordered from newest to oldest. When several hold
+// the same key, the newest entry wins and the others are skipped.
+type mergeIterator struct {
+	sources []entryIterator
+	valid   []bool
+	k       string
+	e       entry
+	started bool
+	failure error
+}
+
+func newMergeIterator(sources []entryIterator) *mergeIterator {
+	return &mergeIterator{
+		sources: sources,
+		valid:   make([]bool, len(sources)),
+	}
+}
+
+func (it *mergeIterator) next() bool {
+	if !it.started {
+		for i, s := range it.sources {
+			it.valid[i] = s.next()
+		}
+		it.started = true
+	} else {
+		for i, s := range it.sources {
+			if it.valid[i] && s.key() == it.k {
+				it.valid[i] = s.next()
+			}
+		}
+	}
+
+	for _, s := range it.sources {
+		if err := s.err(); err != nil {
+			it.failure = err
+			return false
+		}
+	}
+
+	// Ties keep the earliest, and so newest, source.
+	found := -1
+	for i, s := range it.sources {
+		if it.valid[i] && (found < 0 || s.key() < it.sources[found].key()) {
+			found = i
+		}
+	}
+	if found < 0 {
+		return false
+	}
+
+	it.k = it.sources[found].key()
+	it.e = it.sources[found].entry()
+
+	return true
+}
+
+func (it *mergeIterator) key() string {
+	return it.k
+}
+
+func (it *mergeIterator) entry() entry {
+	return it.e
+}
+
+func (it *mergeIterator) err() error {
+	return it.failure
+}
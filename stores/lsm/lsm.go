@@ -0,0 +1,414 @@
+package lsm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/christianalexander/kvdb/stores"
+	"github.com/christianalexander/kvdb/stores/skiplist"
+	"github.com/sirupsen/logrus"
+)
+
+// Options configures an LSM store.
+type Options struct {
+	// MemtableSize is the approximate number of bytes buffered in memory before they are flushed to a table.
+	MemtableSize int
+	// CompactionThreshold is the number of tables that triggers a compaction into a single table.
+	CompactionThreshold int
+}
+
+const (
+	defaultMemtableSize        = 4 << 20
+	defaultCompactionThreshold = 4
+)
+
+// lsmStore is a log-structured merge-tree.
+//
+// Writes go to an in-memory memtable. A full memtable becomes immutable and is flushed
+// to a sorted table file in the background. Reads check the memtable, then the immutable
+// memtables and tables from newest to oldest. Once enough tables build up, they are
+// compacted into one, which drops overwritten values, tombstones and expired keys.
+//
+// The memtable is not logged, so the store relies on the binary log to replay writes
+// that had not been flushed when the process stopped.
+type lsmStore struct {
+	dir     string
+	options Options
+
+	mu         sync.RWMutex
+	memtable   *skiplist.List
+	memSize    int
+	immutables []*skiplist.List // oldest first
+	tables     []*table         // oldest first
+	nextSeq    uint64
+
+	work chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Open opens or creates an LSM store in a directory.
+func Open(dir string, options Options) (stores.DiskStore, error) {
+	if options.MemtableSize <= 0 {
+		options.MemtableSize = defaultMemtableSize
+	}
+	if options.CompactionThreshold <= 1 {
+		options.CompactionThreshold = defaultCompactionThreshold
+	}
+
+	err := os.MkdirAll(dir, 0775)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create LSM directory '%s': %v", dir, err)
+	}
+
+	names, nextSeq, err := loadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &lsmStore{
+		dir:      dir,
+		options:  options,
+		memtable: skiplist.New(),
+		nextSeq:  nextSeq,
+		work:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	for _, name := range names {
+		t, err := openTable(dir, name)
+		if err != nil {
+			s.closeTables()
+			return nil, err
+		}
+		s.tables = append(s.tables, t)
+	}
+
+	removeUnlistedTables(dir, names)
+	logrus.Infof("Opened LSM store in '%s' with %d tables", dir, len(s.tables))
+
+	s.wg.Add(1)
+	go s.run()
+
+	return s, nil
+}
+
+// put writes an entry to the memtable.
+func (s *lsmStore) put(key string, e entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.putLocked(key, e)
+}
+
+// putLocked writes an entry to the memtable, rotating it once it is full. The caller must hold the write lock.
+func (s *lsmStore) putLocked(key string, e entry) {
+	s.memtable.Set(key, e)
+	s.memSize += e.size(key)
+
+	if s.memSize >= s.options.MemtableSize {
+		s.immutables = append(s.immutables, s.memtable)
+		s.memtable = skiplist.New()
+		s.memSize = 0
+		s.signal()
+	}
+}
+
+// lookup finds the newest entry for a key. The caller must hold the lock.
+func (s *lsmStore) lookup(key string) (entry, bool, error) {
+	if v, ok := s.memtable.Get(key); ok {
+		return v.(entry), true, nil
+	}
+
+	for i := len(s.immutables) - 1; i >= 0; i-- {
+		if v, ok := s.immutables[i].Get(key); ok {
+			return v.(entry), true, nil
+		}
+	}
+
+	for i := len(s.tables) - 1; i >= 0; i-- {
+		e, ok, err := s.tables[i].get(key)
+		if err != nil || ok {
+			return e, ok, err
+		}
+	}
+
+	return entry{}, false, nil
+}
+
+func (s *lsmStore) get(key string) (entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok, err := s.lookup(key)
+	if err != nil {
+		return entry{}, err
+	}
+	if !ok || !e.live(time.Now()) {
+		return entry{}, fmt.Errorf("value for key '%s' not found", key)
+	}
+
+	return e, nil
+}
+
+func (s *lsmStore) Set(ctx context.Context, key, value string) error {
+	s.put(key, entry{value: value})
+	return nil
+}
+
+func (s *lsmStore) Get(ctx context.Context, key string) (string, error) {
+	e, err := s.get(key)
+	if err != nil {
+		return "", err
+	}
+
+	return e.value, nil
+}
+
+// SetBytes sets a value held as a byte slice. Tables store values length-prefixed, so they may hold any bytes.
+func (s *lsmStore) SetBytes(ctx context.Context, key string, value []byte) error {
+	s.put(key, entry{value: string(value)})
+	return nil
+}
+
+func (s *lsmStore) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	e, err := s.get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(e.value), nil
+}
+
+func (s *lsmStore) Delete(ctx context.Context, key string) error {
+	s.put(key, entry{deleted: true})
+	return nil
+}
+
+func (s *lsmStore) Expire(ctx context.Context, key string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok, err := s.lookup(key)
+	if err != nil {
+		return err
+	}
+	if !ok || !e.live(time.Now()) {
+		return fmt.Errorf("value for key '%s' not found", key)
+	}
+
+	e.expiresAt = at
+	s.putLocked(key, e)
+
+	return nil
+}
+
+func (s *lsmStore) Expiry(ctx context.Context, key string) (time.Time, error) {
+	e, err := s.get(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return e.expiresAt, nil
+}
+
+func (s *lsmStore) Keys(ctx context.Context) ([]string, error) {
+	it, err := s.Scan(ctx, "", "", 0)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+
+	return keys, it.Err()
+}
+
+func (s *lsmStore) Scan(ctx context.Context, start, end string, limit int) (stores.Iterator, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sources := []entryIterator{newMemtableIterator(s.memtable, start, end)}
+	for i := len(s.immutables) - 1; i >= 0; i-- {
+		sources = append(sources, newMemtableIterator(s.immutables[i], start, end))
+	}
+	for i := len(s.tables) - 1; i >= 0; i-- {
+		sources = append(sources, s.tables[i].iterator(start, end))
+	}
+
+	now := time.Now()
+	var result []stores.KeyValue
+	it := newMergeIterator(sources)
+	for it.next() {
+		if limit > 0 && len(result) == limit {
+			break
+		}
+
+		if e := it.entry(); e.live(now) {
+			result = append(result, stores.KeyValue{Key: it.key(), Value: e.value})
+		}
+	}
+	if err := it.err(); err != nil {
+		return nil, err
+	}
+
+	return stores.NewIterator(result), nil
+}
+
+func (s *lsmStore) Release(context.Context) {}
+
+// Close flushes the memtable and stops background work.
+func (s *lsmStore) Close() error {
+	close(s.done)
+	s.wg.Wait()
+
+	s.mu.Lock()
+	if s.memtable.Len() > 0 {
+		s.immutables = append(s.immutables, s.memtable)
+		s.memtable = skiplist.New()
+		s.memSize = 0
+	}
+	s.mu.Unlock()
+
+	err := s.flush()
+	s.closeTables()
+
+	return err
+}
+
+func (s *lsmStore) closeTables() {
+	for _, t := range s.tables {
+		t.close()
+	}
+}
+
+// signal wakes the background worker without blocking.
+func (s *lsmStore) signal() {
+	select {
+	case s.work <- struct{}{}:
+	default:
+	}
+}
+
+// run flushes immutable memtables and compacts tables until the store is closed.
+func (s *lsmStore) run() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.work:
+			if err := s.flush(); err != nil {
+				logrus.Errorf("Failed to flush memtable: %v", err)
+				continue
+			}
+
+			s.mu.RLock()
+			n := len(s.tables)
+			s.mu.RUnlock()
+			if n >= s.options.CompactionThreshold {
+				if err := s.compact(); err != nil {
+					logrus.Errorf("Failed to compact tables: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// flush writes each immutable memtable to a new table, oldest first.
+func (s *lsmStore) flush() error {
+	for {
+		s.mu.Lock()
+		if len(s.immutables) == 0 {
+			s.mu.Unlock()
+			return nil
+		}
+		memtable := s.immutables[0]
+		name := tableName(s.nextSeq)
+		s.nextSeq++
+		s.mu.Unlock()
+
+		// Immutable memtables are never written to, so they can be read without the lock.
+		err := writeTable(tablePath(s.dir, name), newMemtableIterator(memtable, "", ""), false)
+		if err != nil {
+			return err
+		}
+
+		t, err := openTable(s.dir, name)
+		if err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		tables := append(append([]*table(nil), s.tables...), t)
+		err = writeManifest(s.dir, tables)
+		if err == nil {
+			s.tables = tables
+			s.immutables = s.immutables[1:]
+		}
+		s.mu.Unlock()
+		if err != nil {
+			t.close()
+			return err
+		}
+
+		logrus.Debugf("Flushed memtable with %d keys to table '%s'", memtable.Len(), name)
+	}
+}
+
+// compact merges every table into one. As no older data remains, tombstones and
+// expired entries can be dropped.
+func (s *lsmStore) compact() error {
+	s.mu.Lock()
+	inputs := append([]*table(nil), s.tables...)
+	name := tableName(s.nextSeq)
+	s.nextSeq++
+	s.mu.Unlock()
+
+	// Tables are immutable, and are only closed by compaction, so they can be read without the lock.
+	sources := make([]entryIterator, 0, len(inputs))
+	for i := len(inputs) - 1; i >= 0; i-- {
+		sources = append(sources, inputs[i].iterator("", ""))
+	}
+
+	err := writeTable(tablePath(s.dir, name), newMergeIterator(sources), true)
+	if err != nil {
+		os.Remove(tablePath(s.dir, name))
+		return err
+	}
+
+	t, err := openTable(s.dir, name)
+	if err != nil {
+		return err
+	}
+
+	// Tables flushed while compacting are newer than the merged table.
+	s.mu.Lock()
+	tables := append([]*table{t}, s.tables[len(inputs):]...)
+	err = writeManifest(s.dir, tables)
+	if err == nil {
+		s.tables = tables
+	}
+	s.mu.Unlock()
+	if err != nil {
+		t.close()
+		return err
+	}
+
+	for _, input := range inputs {
+		input.close()
+		if err := os.Remove(tablePath(s.dir, input.name)); err != nil {
+			logrus.Warnf("Failed to remove compacted table '%s': %v", input.name, err)
+		}
+	}
+
+	logrus.Debugf("Compacted %d tables into '%s' with %d keys", len(inputs), name, t.count)
+	return nil
+}
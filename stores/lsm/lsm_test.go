@@ -0,0 +1,169 @@
+package lsm
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/christianalexander/kvdb/stores"
+)
+
+// open opens a store whose memtable is only flushed on Close, so that each session writes one table.
+func open(t *testing.T, dir string) *lsmStore {
+	t.Helper()
+
+	s, err := Open(dir, Options{MemtableSize: 1 << 30, CompactionThreshold: 1 << 30})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	return s.(*lsmStore)
+}
+
+func reopen(t *testing.T, s *lsmStore) *lsmStore {
+	t.Helper()
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	return open(t, s.dir)
+}
+
+// assertContents checks the keys and values a scan returns, and that each can be read on its own.
+func assertContents(t *testing.T, s stores.Store, when string, want map[string]string) {
+	t.Helper()
+	ctx := context.Background()
+
+	it, err := s.Scan(ctx, "", "", 0)
+	if err != nil {
+		t.Fatalf("%s: scan: %v", when, err)
+	}
+	defer it.Close()
+
+	got := make(map[string]string)
+	var keys []string
+	for it.Next() {
+		got[it.Key()] = it.Value()
+		keys = append(keys, it.Key())
+	}
+	if !sort.StringsAreSorted(keys) {
+		t.Errorf("%s: scan is out of order: %v", when, keys)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: got %v, want %v", when, got, want)
+	}
+
+	for k, v := range want {
+		if got, err := s.Get(ctx, k); err != nil || got != v {
+			t.Errorf("%s: get %s: got %q, %v, want %q", when, k, got, err, v)
+		}
+	}
+}
+
+func TestReopen(t *testing.T) {
+	ctx := context.Background()
+	s := open(t, t.TempDir())
+
+	s.Set(ctx, "a", "1")
+	s.Set(ctx, "b", "1")
+	s.Set(ctx, "c", "1")
+	s.Set(ctx, "b", "2")
+	s.Delete(ctx, "c")
+	at := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := s.Expire(ctx, "a", at); err != nil {
+		t.Fatalf("expire: %v", err)
+	}
+
+	s = reopen(t, s)
+	defer s.Close()
+
+	assertContents(t, s, "after reopening", map[string]string{"a": "1", "b": "2"})
+	if expiresAt, err := s.Expiry(ctx, "a"); err != nil || !expiresAt.Equal(at) {
+		t.Errorf("expiry after reopening: got %v, %v, want %v", expiresAt, err, at)
+	}
+	if _, err := s.Get(ctx, "c"); err == nil {
+		t.Errorf("a deleted key was read back after reopening")
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	ctx := context.Background()
+	s := open(t, t.TempDir())
+
+	// Each session is flushed to a table of its own, and later tables shadow earlier ones.
+	want := make(map[string]string)
+	for session := 0; session < 4; session++ {
+		for i := session; i < 100; i += 2 {
+			k, v := fmt.Sprintf("key-%03d", i), fmt.Sprintf("%d", session)
+			s.Set(ctx, k, v)
+			want[k] = v
+		}
+		for i := session; i < 100; i += 7 {
+			k := fmt.Sprintf("key-%03d", i)
+			s.Delete(ctx, k)
+			delete(want, k)
+		}
+		s = reopen(t, s)
+	}
+	s.Set(ctx, "expired", "x")
+	s.Expire(ctx, "expired", time.Now().Add(-time.Second))
+	s = reopen(t, s)
+
+	if len(s.tables) != 5 {
+		t.Fatalf("got %d tables, want one for each session", len(s.tables))
+	}
+	assertContents(t, s, "before compacting", want)
+
+	if err := s.compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if len(s.tables) != 1 {
+		t.Fatalf("got %d tables after compacting, want 1", len(s.tables))
+	}
+	// Overwritten values, tombstones and expired keys are dropped.
+	if count := s.tables[0].count; count != uint64(len(want)) {
+		t.Errorf("compacted table holds %d entries, want %d", count, len(want))
+	}
+	assertContents(t, s, "after compacting", want)
+
+	// Only the compacted table is left on disk, and it is the one listed in the manifest.
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+tableSuffix))
+	if err != nil || len(files) != 1 || filepath.Base(files[0]) != s.tables[0].name {
+		t.Errorf("table files after compacting: got %v, %v, want only %s", files, err, s.tables[0].name)
+	}
+	manifest, err := ioutil.ReadFile(filepath.Join(s.dir, manifestName))
+	if err != nil || string(manifest) != s.tables[0].name+"\n" {
+		t.Errorf("manifest after compacting: got %q, %v", manifest, err)
+	}
+
+	s = reopen(t, s)
+	defer s.Close()
+	assertContents(t, s, "after compacting and reopening", want)
+}
+
+func TestBackgroundFlush(t *testing.T) {
+	ctx := context.Background()
+	s, err := Open(t.TempDir(), Options{MemtableSize: 256, CompactionThreshold: 3})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	want := make(map[string]string)
+	for i := 0; i < 500; i++ {
+		k, v := fmt.Sprintf("key-%03d", i%150), fmt.Sprintf("%d", i)
+		s.Set(ctx, k, v)
+		want[k] = v
+	}
+	// Reads see every write while memtables are flushed and tables compacted underneath them.
+	assertContents(t, s, "while flushing", want)
+
+	s = reopen(t, s.(*lsmStore))
+	defer s.Close()
+	assertContents(t, s, "after reopening", want)
+}
@@ -0,0 +1,106 @@
+package lsm
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	manifestName = "MANIFEST"
+	tableSuffix  = ".sst"
+)
+
+func tableName(seq uint64) string {
+	return fmt.Sprintf("%020d%s", seq, tableSuffix)
+}
+
+func tablePath(dir, name string) string {
+	return filepath.Join(dir, name)
+}
+
+// loadManifest returns the live tables, oldest first, and the next free table sequence number.
+func loadManifest(dir string) ([]string, uint64, error) {
+	f, err := os.Open(filepath.Join(dir, manifestName))
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open manifest: %v", err)
+	}
+	defer f.Close()
+
+	var names []string
+	var nextSeq uint64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name := strings.TrimSpace(scanner.Text())
+		if name == "" {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, tableSuffix), 10, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("manifest lists invalid table '%s'", name)
+		}
+		if seq >= nextSeq {
+			nextSeq = seq + 1
+		}
+		names = append(names, name)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to read manifest: %v", err)
+	}
+
+	return names, nextSeq, nil
+}
+
+// writeManifest atomically replaces the manifest with a list of tables, oldest first.
+func writeManifest(dir string, tables []*table) error {
+	var b strings.Builder
+	for _, t := range tables {
+		b.WriteString(t.name)
+		b.WriteString("\n")
+	}
+
+	tmp := filepath.Join(dir, manifestName+".tmp")
+	err := ioutil.WriteFile(tmp, []byte(b.String()), 0664)
+	if err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+
+	err = os.Rename(tmp, filepath.Join(dir, manifestName))
+	if err != nil {
+		return fmt.Errorf("failed to replace manifest: %v", err)
+	}
+
+	return nil
+}
+
+// removeUnlistedTables deletes table files left behind by an interrupted flush or compaction.
+func removeUnlistedTables(dir string, names []string) {
+	listed := make(map[string]bool, len(names))
+	for _, name := range names {
+		listed[name] = true
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), tableSuffix) || listed[f.Name()] {
+			continue
+		}
+
+		logrus.Warnf("Removing table '%s', which is not in the manifest", f.Name())
+		os.Remove(filepath.Join(dir, f.Name()))
+	}
+}
@@ -0,0 +1,288 @@
+package lsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	// indexInterval is how many entries share one sparse index entry.
+	indexInterval = 16
+
+	footerLength = 32
+	tableMagic   = 0x6b7664622d737374 // "kvdb-sst"
+)
+
+// A table is an immutable, sorted file of entries, laid out as:
+//
+//	data   - every entry in key order
+//	index  - the key and offset of every indexInterval'th entry
+//	bloom  - a bloom filter of every key
+//	footer - the index offset, bloom offset, entry count and magic number
+//
+// Only the sparse index and bloom filter are held in memory.
+type table struct {
+	name    string
+	file    *os.File
+	dataLen int64
+	count   uint64
+	index   []indexEntry
+	bloom   bloomFilter
+}
+
+type indexEntry struct {
+	key    string
+	offset int64
+}
+
+// writeTable writes the entries of an iterator to a new table file at path.
+// When dropDead is set, tombstones and expired entries are left out.
+func writeTable(path string, it entryIterator, dropDead bool) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
+	if err != nil {
+		return fmt.Errorf("failed to create table '%s': %v", path, err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+
+	now := time.Now()
+	var keys []string
+	var index []indexEntry
+	var offset int64
+	var buf []byte
+	for it.next() {
+		k, e := it.key(), it.entry()
+		if dropDead && !e.live(now) {
+			continue
+		}
+
+		if len(keys)%indexInterval == 0 {
+			index = append(index, indexEntry{k, offset})
+		}
+		keys = append(keys, k)
+
+		buf = appendEntry(buf[:0], k, e)
+		n, err := w.Write(buf)
+		if err != nil {
+			return fmt.Errorf("failed to write table '%s': %v", path, err)
+		}
+		offset += int64(n)
+	}
+	if err := it.err(); err != nil {
+		return err
+	}
+
+	indexOffset := offset
+	buf = appendUvarint(buf[:0], uint64(len(index)))
+	for _, ie := range index {
+		buf = appendUvarint(buf, uint64(len(ie.key)))
+		buf = append(buf, ie.key...)
+		buf = appendUvarint(buf, uint64(ie.offset))
+	}
+	n, err := w.Write(buf)
+	if err != nil {
+		return fmt.Errorf("failed to write table index '%s': %v", path, err)
+	}
+	offset += int64(n)
+
+	bloomOffset := offset
+	bloom := newBloomFilter(len(keys))
+	for _, k := range keys {
+		bloom.add(k)
+	}
+	if _, err := bloom.writeTo(w); err != nil {
+		return fmt.Errorf("failed to write table bloom filter '%s': %v", path, err)
+	}
+
+	var footer [footerLength]byte
+	binary.LittleEndian.PutUint64(footer[0:], uint64(indexOffset))
+	binary.LittleEndian.PutUint64(footer[8:], uint64(bloomOffset))
+	binary.LittleEndian.PutUint64(footer[16:], uint64(len(keys)))
+	binary.LittleEndian.PutUint64(footer[24:], tableMagic)
+	if _, err := w.Write(footer[:]); err != nil {
+		return fmt.Errorf("failed to write table footer '%s': %v", path, err)
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write table '%s': %v", path, err)
+	}
+
+	return f.Sync()
+}
+
+// openTable opens a table file and loads its index and bloom filter.
+func openTable(dir, name string) (*table, error) {
+	f, err := os.Open(tablePath(dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open table '%s': %v", name, err)
+	}
+
+	t, err := loadTable(f, name)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func loadTable(f *os.File, name string) (*table, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat table '%s': %v", name, err)
+	}
+	if info.Size() < footerLength {
+		return nil, fmt.Errorf("table '%s' is too short", name)
+	}
+
+	var footer [footerLength]byte
+	if _, err := f.ReadAt(footer[:], info.Size()-footerLength); err != nil {
+		return nil, fmt.Errorf("failed to read footer of table '%s': %v", name, err)
+	}
+	if binary.LittleEndian.Uint64(footer[24:]) != tableMagic {
+		return nil, fmt.Errorf("table '%s' has a bad magic number", name)
+	}
+
+	indexOffset := int64(binary.LittleEndian.Uint64(footer[0:]))
+	bloomOffset := int64(binary.LittleEndian.Uint64(footer[8:]))
+
+	r := bufio.NewReader(io.NewSectionReader(f, indexOffset, info.Size()-footerLength-indexOffset))
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index of table '%s': %v", name, err)
+	}
+	index := make([]indexEntry, 0, n)
+	for i := uint64(0); i < n; i++ {
+		kl, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read index of table '%s': %v", name, err)
+		}
+		k := make([]byte, kl)
+		if _, err := io.ReadFull(r, k); err != nil {
+			return nil, fmt.Errorf("failed to read index of table '%s': %v", name, err)
+		}
+		offset, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read index of table '%s': %v", name, err)
+		}
+		index = append(index, indexEntry{string(k), int64(offset)})
+	}
+
+	bloom, err := readBloomFilter(bufio.NewReader(io.NewSectionReader(f, bloomOffset, info.Size()-footerLength-bloomOffset)))
+	if err != nil {
+		return nil, fmt.Errorf("table '%s': %v", name, err)
+	}
+
+	return &table{
+		name:    name,
+		file:    f,
+		dataLen: indexOffset,
+		count:   binary.LittleEndian.Uint64(footer[16:]),
+		index:   index,
+		bloom:   bloom,
+	}, nil
+}
+
+// seek returns the offset of the index entry at or before key.
+func (t *table) seek(key string) int64 {
+	i := sort.Search(len(t.index), func(i int) bool { return t.index[i].key > key })
+	if i == 0 {
+		return 0
+	}
+
+	return t.index[i-1].offset
+}
+
+// get looks up a key, reading at most one index interval of entries.
+func (t *table) get(key string) (entry, bool, error) {
+	if !t.bloom.mayContain(key) || len(t.index) == 0 || key < t.index[0].key {
+		return entry{}, false, nil
+	}
+
+	offset := t.seek(key)
+	r := bufio.NewReader(io.NewSectionReader(t.file, offset, t.dataLen-offset))
+	for i := 0; i < indexInterval; i++ {
+		k, e, err := readEntry(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return entry{}, false, fmt.Errorf("failed to read table '%s': %v", t.name, err)
+		}
+
+		if k == key {
+			return e, true, nil
+		}
+		if k > key {
+			break
+		}
+	}
+
+	return entry{}, false, nil
+}
+
+func (t *table) close() error {
+	return t.file.Close()
+}
+
+// tableIterator reads the entries of a table in order.
+type tableIterator struct {
+	t       *table
+	r       *bufio.Reader
+	start   string
+	end     string
+	k       string
+	e       entry
+	failure error
+}
+
+func (t *table) iterator(start, end string) *tableIterator {
+	offset := t.seek(start)
+	return &tableIterator{
+		t:     t,
+		r:     bufio.NewReader(io.NewSectionReader(t.file, offset, t.dataLen-offset)),
+		start: start,
+		end:   end,
+	}
+}
+
+func (it *tableIterator) next() bool {
+	for {
+		k, e, err := readEntry(it.r)
+		if err == io.EOF {
+			return false
+		}
+		if err != nil {
+			it.failure = fmt.Errorf("failed to read table '%s': %v", it.t.name, err)
+			return false
+		}
+
+		if k < it.start {
+			continue
+		}
+		if it.end != "" && k >= it.end {
+			return false
+		}
+
+		it.k, it.e = k, e
+		return true
+	}
+}
+
+func (it *tableIterator) key() string {
+	return it.k
+}
+
+func (it *tableIterator) entry() entry {
+	return it.e
+}
+
+func (it *tableIterator) err() error {
+	return it.failure
+}
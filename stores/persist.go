@@ -3,6 +3,9 @@ package stores
 import (
 	"context"
 	"fmt"
+	"io"
+	"sort"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -26,6 +29,7 @@ func (s *withPersistence) Set(ctx context.Context, key string, value string) err
 		TransactionID: txID,
 		Key:           key,
 		Value:         value,
+		Timestamp:     time.Now(),
 	})
 	if err != nil {
 		return fmt.Errorf("failed to write set operation: %v", err)
@@ -34,12 +38,35 @@ func (s *withPersistence) Set(ctx context.Context, key string, value string) err
 	return s.Store.Set(ctx, key, value)
 }
 
+// SetBytes logs and sets a value held as a byte slice. Log formats carry values that are not valid
+// UTF-8 in a bytes field, so replay sets them back unchanged.
+func (s *withPersistence) SetBytes(ctx context.Context, key string, value []byte) error {
+	txID := ctx.Value(ContextKeyTransactionID).(int64)
+	err := s.writer.Write(ctx, Record{
+		Kind:          RecordKindSet,
+		TransactionID: txID,
+		Key:           key,
+		Value:         string(value),
+		Timestamp:     time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write set operation: %v", err)
+	}
+
+	return SetBytes(ctx, s.Store, key, value)
+}
+
+func (s *withPersistence) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	return GetBytes(ctx, s.Store, key)
+}
+
 func (s *withPersistence) Delete(ctx context.Context, key string) error {
 	txID := ctx.Value(ContextKeyTransactionID).(int64)
 	err := s.writer.Write(ctx, Record{
 		Kind:          RecordKindDelete,
 		TransactionID: txID,
 		Key:           key,
+		Timestamp:     time.Now(),
 	})
 	if err != nil {
 		return fmt.Errorf("failed to write delete operation: %v", err)
@@ -48,6 +75,27 @@ func (s *withPersistence) Delete(ctx context.Context, key string) error {
 	return s.Store.Delete(ctx, key)
 }
 
+func (s *withPersistence) Expire(ctx context.Context, key string, at time.Time) error {
+	// A key that does not exist can not be expired, so nothing is logged for it.
+	if _, err := s.Store.Expiry(ctx, key); err != nil {
+		return err
+	}
+
+	txID := ctx.Value(ContextKeyTransactionID).(int64)
+	err := s.writer.Write(ctx, Record{
+		Kind:          RecordKindExpire,
+		TransactionID: txID,
+		Key:           key,
+		ExpiresAt:     at,
+		Timestamp:     time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write expire operation: %v", err)
+	}
+
+	return s.Store.Expire(ctx, key, at)
+}
+
 func applyRecord(ctx context.Context, pendingTransactionRecords map[int64][]Record, store Store, record Record) {
 	logrus.Debugln(record.String())
 	switch record.Kind {
@@ -69,37 +117,136 @@ func applyRecord(ctx context.Context, pendingTransactionRecords map[int64][]Reco
 				logrus.Warnf("Failed to replay delete record: %v", err)
 			}
 		}
+	case RecordKindExpire:
+		if record.TransactionID != 0 {
+			pendingTransactionRecords[record.TransactionID] = append(pendingTransactionRecords[record.TransactionID], record)
+		} else {
+			err := store.Expire(ctx, record.Key, record.ExpiresAt)
+			if err != nil {
+				logrus.Warnf("Failed to replay expire record: %v", err)
+			}
+		}
 	case RecordKindCommit:
 		if records, ok := pendingTransactionRecords[record.TransactionID]; ok {
 			for _, r := range records {
 				r.TransactionID = 0
 				applyRecord(ctx, pendingTransactionRecords, store, r)
 			}
+			delete(pendingTransactionRecords, record.TransactionID)
 		}
+	case RecordKindAbort:
+		// The writes of an aborted transaction were undone, so they are dropped without being applied.
+		delete(pendingTransactionRecords, record.TransactionID)
+	case RecordKindCheckpoint:
+		// Checkpoint markers only end a checkpoint file, and carry nothing to apply.
 	default:
 		logrus.Warnf("Received record of unknown type '%s'", record.Kind)
 	}
 }
 
-func FromPersistence(ctx context.Context, reader Reader, store Store) (Store, error) {
+// ReplayOptions limits how much of a log is replayed, to recover the state at a point in time.
+type ReplayOptions struct {
+	// UntilTransactionID stops replay at the commit of a transaction, leaving it and every later commit out.
+	UntilTransactionID int64
+	// UntilTime stops replay at the first commit written at or after a time.
+	UntilTime time.Time
+}
+
+// A ReplayResult describes how much of a log was replayed.
+type ReplayResult struct {
+	// StoppedAt is the record replay stopped at, if it stopped before the end of the log.
+	StoppedAt *Record
+	// LastTransactionID is the highest ID of a transaction committed by the replay.
+	LastTransactionID int64
+	// HighestTransactionID is the highest ID of any transaction replayed, whether it committed or not.
+	// New transactions must be given higher IDs, so that their records are not mistaken for its.
+	HighestTransactionID int64
+	// InFlight holds the IDs of transactions with writes in the log that were neither committed
+	// nor aborted where replay ended, in order. Their writes were not applied.
+	InFlight []int64
+}
+
+// stopsAt reports whether a record is past the point a replay is limited to.
+// Records of a transaction only take effect when it commits, so only commits and records without a transaction are checked.
+func (o ReplayOptions) stopsAt(r Record) bool {
+	if r.Kind != RecordKindCommit && r.TransactionID != 0 {
+		return false
+	}
+	if o.UntilTransactionID != 0 && r.Kind == RecordKindCommit && r.TransactionID == o.UntilTransactionID {
+		return true
+	}
+
+	return !o.UntilTime.IsZero() && !r.Timestamp.IsZero() && !r.Timestamp.Before(o.UntilTime)
+}
+
+// Replay applies the committed writes of a log to a store, stopping early if the options say so.
+func Replay(ctx context.Context, reader Reader, store Store, options ReplayOptions) (ReplayResult, error) {
 	records := make(chan Record)
+	readErr := make(chan error, 1)
 	pendingTransactionRecords := make(map[int64][]Record)
 
 	go func() {
-		reader.Read(ctx, records)
+		readErr <- reader.Read(ctx, records)
 		close(records)
 	}()
 
+	var result ReplayResult
 	for {
 		select {
 		case <-ctx.Done():
-			return nil, ctx.Err()
+			return result, ctx.Err()
 		case r, ok := <-records:
 			if !ok {
-				return store, nil
+				if err := <-readErr; err != nil && err != io.EOF {
+					return result, fmt.Errorf("failed to read log: %v", err)
+				}
+				result.InFlight = inFlight(pendingTransactionRecords)
+				return result, nil
+			}
+
+			if options.stopsAt(r) {
+				// The rest of the log is read and discarded, so that the reader is not left blocked.
+				go func() {
+					for range records {
+					}
+				}()
+				result.StoppedAt = &r
+				result.InFlight = inFlight(pendingTransactionRecords)
+				return result, nil
 			}
 
+			if r.Kind == RecordKindCommit && r.TransactionID > result.LastTransactionID {
+				result.LastTransactionID = r.TransactionID
+			}
+			if r.TransactionID > result.HighestTransactionID {
+				result.HighestTransactionID = r.TransactionID
+			}
 			applyRecord(ctx, pendingTransactionRecords, store, r)
 		}
 	}
 }
+
+// inFlight returns the IDs of the transactions that still have pending records, in order, warning about them.
+func inFlight(pendingTransactionRecords map[int64][]Record) []int64 {
+	if len(pendingTransactionRecords) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, 0, len(pendingTransactionRecords))
+	for id := range pendingTransactionRecords {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	logrus.Warnf("Discarded the writes of %d transactions that were in flight: %v", len(ids), ids)
+	return ids
+}
+
+func FromPersistence(ctx context.Context, reader Reader, store Store) (Store, error) {
+	_, err := Replay(ctx, reader, store, ReplayOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
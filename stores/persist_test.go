@@ -0,0 +1,45 @@
+package stores_test
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/christianalexander/kvdb/stores"
+)
+
+func TestReplayAbort(t *testing.T) {
+	ctx := context.Background()
+	records := []stores.Record{
+		{Kind: stores.RecordKindSet, Key: "a", Value: "1", TransactionID: 1},
+		{Kind: stores.RecordKindSet, Key: "b", Value: "2", TransactionID: 2},
+		{Kind: stores.RecordKindDelete, Key: "kept", TransactionID: 1},
+		{Kind: stores.RecordKindSet, Key: "kept", Value: "yes"},
+		{Kind: stores.RecordKindAbort, TransactionID: 1},
+		{Kind: stores.RecordKindCommit, TransactionID: 2},
+		{Kind: stores.RecordKindSet, Key: "c", Value: "3", TransactionID: 3},
+		// A commit after an abort has nothing left to apply.
+		{Kind: stores.RecordKindCommit, TransactionID: 1},
+		{Kind: stores.RecordKindSet, Key: "d", Value: "4", TransactionID: 4},
+		{Kind: stores.RecordKindAbort, TransactionID: 4},
+	}
+
+	store := stores.NewInMemoryStore()
+	result, err := stores.Replay(ctx, sliceReader{records, io.EOF, make(chan struct{})}, store, stores.ReplayOptions{})
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+
+	// The writes of aborted transactions are dropped, and those of transaction 3 are still waiting for its commit.
+	keys, _ := store.Keys(ctx)
+	if want := []string{"b", "kept"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys: got %v, want %v", keys, want)
+	}
+	if want := []int64{3}; !reflect.DeepEqual(result.InFlight, want) {
+		t.Errorf("in flight: got %v, want %v", result.InFlight, want)
+	}
+	if result.HighestTransactionID != 4 {
+		t.Errorf("highest transaction: got %d, want 4", result.HighestTransactionID)
+	}
+}
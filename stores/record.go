@@ -1,13 +1,19 @@
 package stores
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 type RecordKind string
 
 const (
-	RecordKindSet    RecordKind = "SET"
-	RecordKindDelete            = "DEL"
-	RecordKindCommit            = "COMMIT"
+	RecordKindSet        RecordKind = "SET"
+	RecordKindDelete                = "DEL"
+	RecordKindCommit                = "COMMIT"
+	RecordKindExpire                = "EXPIRE"
+	RecordKindCheckpoint            = "CHECKPOINT"
+	RecordKindAbort                 = "ABORT"
 )
 
 type Record struct {
@@ -15,8 +21,24 @@ type Record struct {
 	TransactionID int64
 	Key           string
 	Value         string
+	// ExpiresAt is the deadline set by an expire record. A zero time removes the expiry.
+	ExpiresAt time.Time
+	// Timestamp is when the record was written.
+	Timestamp time.Time
 }
 
 func (r Record) String() string {
+	if r.Kind == RecordKindExpire {
+		return fmt.Sprintf("%s:%d:%s:%s", r.Kind, r.TransactionID, r.Key, formatExpiry(r.ExpiresAt))
+	}
+
 	return fmt.Sprintf("%s:%d:%s:%s", r.Kind, r.TransactionID, r.Key, r.Value)
 }
+
+func formatExpiry(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+
+	return t.UTC().Format(time.RFC3339Nano)
+}
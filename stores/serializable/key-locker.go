@@ -2,16 +2,69 @@ package serializable
 
 import (
 	"context"
+	"fmt"
 	"sync"
+	"time"
 
+	"github.com/christianalexander/kvdb/stores"
 	"github.com/sirupsen/logrus"
 )
 
+// ErrDeadlock is returned to the transaction chosen as the victim of a deadlock. The transaction
+// must be rolled back, releasing its locks, and can then be retried.
+var ErrDeadlock error = abortError("deadlock detected")
+
+// ErrLockTimeout is returned when a lock is not granted within the lock timeout. Only the statement
+// waiting for the lock fails, so the transaction may retry it after backing off.
+var ErrLockTimeout = stores.ErrLockTimeout
+
+// An abortError aborts the transaction given it, as a stores.AbortError.
+type abortError string
+
+func (e abortError) Error() string {
+	return string(e)
+}
+
+// AbortsTransaction satisfies the stores.AbortError interface.
+func (e abortError) AbortsTransaction() bool {
+	return true
+}
+
 // A lockerMap holds a locker for each key, and the keys for each transaction.
 type lockerMap struct {
 	mu      sync.RWMutex
 	lockers map[string]*keyLocker
 	keys    map[int64][]string
+
+	// lockTimeout is how long a lock is waited for when the context does not say. Zero waits indefinitely.
+	lockTimeout time.Duration
+
+	// policy decides whether a transaction may wait for a lock, and onWound is told of wounded
+	// transactions that are not waiting.
+	policy  Policy
+	onWound func(txID int64, err error)
+
+	// waitsMu guards waits, the wait-for graph of the transactions queued for a lock, and wounded.
+	// It may be taken while holding the mutex of a keyLocker, but not the other way around.
+	waitsMu sync.Mutex
+	waits   map[int64]*wait
+	wounded map[int64]error
+
+	// rangesMu guards the range locks, the keys written by each transaction, and rangesChanged, which
+	// is closed and replaced when any of them are released. It may be taken before waitsMu.
+	rangesMu      sync.Mutex
+	ranges        []rangeLock
+	writeKeys     map[int64]map[string]struct{}
+	rangesChanged chan struct{}
+}
+
+// A wait is a transaction queued for the lock on a key, and the transactions it waits for.
+type wait struct {
+	key     string
+	waitsOn []int64
+	// abort is closed when the wait is aborted, for the reason in err.
+	abort chan struct{}
+	err   error
 }
 
 // A keyLocker is the implementation of a lock for a given key.
@@ -31,6 +84,8 @@ type keyLocker struct {
 type waiter struct {
 	txID  int64
 	ready chan struct{}
+	// since is when the transaction first asked for the lock.
+	since time.Time
 }
 
 func (lm *lockerMap) getKeyLocker(key string) *keyLocker {
@@ -58,10 +113,25 @@ func (lm *lockerMap) setTxKey(txID int64, key string) {
 	lm.mu.Unlock()
 }
 
-// Acquire gets an exclusive lock on a key for a transaction.
+// Acquire gets an exclusive lock on a key for a transaction, once no other transaction holds a range lock over it.
 func (lm *lockerMap) Acquire(ctx context.Context, txID int64, key string) error {
 	locker := lm.getKeyLocker(key)
 	logrus.WithField("txID", txID).Debugf("Acquiring write lock for %s", key)
+	since := time.Now()
+	if err := lm.woundedError(txID); err != nil {
+		return err
+	}
+	if err := lm.acquireGap(ctx, txID, key); err != nil {
+		return err
+	}
+
+	// The timeout covers the whole wait, however many times the transaction is woken to try again.
+	var timedOut <-chan time.Time
+	if timeout := lm.timeout(ctx); timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timedOut = timer.C
+	}
 
 	for {
 		locker.mu.Lock()
@@ -87,25 +157,28 @@ func (lm *lockerMap) Acquire(ctx context.Context, txID int64, key string) error
 			}
 		}
 
+		// A writer waits for every other holder of the lock to release it.
+		var waitsOn []int64
+		for holder := range locker.activeTransactions {
+			if holder != txID {
+				waitsOn = append(waitsOn, holder)
+			}
+		}
+		w, err := lm.wait(txID, key, waitsOn)
+		if err != nil {
+			locker.mu.Unlock()
+			return err
+		}
+
 		ready := make(chan struct{})
-		me := waiter{txID, ready}
+		me := waiter{txID, ready, since}
 		locker.waitingWriters = append(locker.waitingWriters, me)
 		locker.mu.Unlock()
 
 		logrus.WithField("txID", txID).Debugf("Entering write wait for '%s'", key)
-		select {
-		case <-ctx.Done():
-			locker.mu.Lock()
-			ww := locker.waitingWriters
-			for i, w := range ww {
-				if w.txID == txID {
-					locker.waitingWriters = append(locker.waitingWriters[:i], locker.waitingWriters[i+1:]...)
-				}
-			}
-			locker.mu.Unlock()
-			return ctx.Err()
-		case <-ready:
-			break
+		err = lm.await(ctx, locker, txID, ready, w, timedOut)
+		if err != nil {
+			return err
 		}
 	}
 }
@@ -114,6 +187,18 @@ func (lm *lockerMap) Acquire(ctx context.Context, txID int64, key string) error
 func (lm *lockerMap) RAcquire(ctx context.Context, txID int64, key string) error {
 	locker := lm.getKeyLocker(key)
 	logrus.WithField("txID", txID).Debugf("Acquiring read lock for %s", key)
+	since := time.Now()
+	if err := lm.woundedError(txID); err != nil {
+		return err
+	}
+
+	// The timeout covers the whole wait, however many times the transaction is woken to try again.
+	var timedOut <-chan time.Time
+	if timeout := lm.timeout(ctx); timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timedOut = timer.C
+	}
 
 	for {
 		locker.mu.Lock()
@@ -132,33 +217,208 @@ func (lm *lockerMap) RAcquire(ctx context.Context, txID int64, key string) error
 			return nil
 		}
 
+		// A reader waits for the writer holding the lock, and for the writers queued ahead of it.
+		var waitsOn []int64
+		if locker.writeLockTxID != 0 {
+			waitsOn = append(waitsOn, locker.writeLockTxID)
+		}
+		if !txExists {
+			for _, w := range locker.waitingWriters {
+				waitsOn = append(waitsOn, w.txID)
+			}
+		}
+		w, err := lm.wait(txID, key, waitsOn)
+		if err != nil {
+			locker.mu.Unlock()
+			return err
+		}
+
 		ready := make(chan struct{})
-		me := waiter{txID, ready}
+		me := waiter{txID, ready, since}
 		locker.waitingReaders = append(locker.waitingReaders, me)
 		locker.mu.Unlock()
 
 		logrus.WithField("txID", txID).Debugf("Entering read wait for '%s'", key)
-		select {
-		case <-ctx.Done():
-			wr := locker.waitingReaders
-			for i, w := range wr {
-				if w.txID == txID {
-					locker.waitingReaders = append(locker.waitingReaders[:i], locker.waitingReaders[i+1:]...)
+		err = lm.await(ctx, locker, txID, ready, w, timedOut)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// timeout returns how long a lock is waited for by the transaction in a context.
+func (lm *lockerMap) timeout(ctx context.Context) time.Duration {
+	if timeout, ok := ctx.Value(stores.ContextKeyLockTimeout).(time.Duration); ok {
+		return timeout
+	}
+
+	return lm.lockTimeout
+}
+
+// await blocks a queued transaction until it is woken to try for the lock again, or gives up its place
+// in the queue if the context ends, the wait times out or the wait is aborted.
+func (lm *lockerMap) await(ctx context.Context, locker *keyLocker, txID int64, ready chan struct{}, w *wait, timedOut <-chan time.Time) error {
+	var err error
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timedOut:
+		err = fmt.Errorf("%w: transaction %d gave up waiting for '%s'", ErrLockTimeout, txID, w.key)
+	case <-w.abort:
+		err = w.err
+	}
+	lm.unwait(txID)
+
+	if err == nil {
+		return nil
+	}
+
+	locker.mu.Lock()
+	defer locker.mu.Unlock()
+
+	select {
+	case <-ready:
+		// The lock was handed over while giving up, so the transaction tries for it again, as no
+		// other waiter will be woken until it does.
+		return nil
+	default:
+	}
+
+	locker.waitingWriters = removeWaiter(locker.waitingWriters, txID)
+	locker.waitingReaders = removeWaiter(locker.waitingReaders, txID)
+
+	// Readers queued behind a writer that gave up would otherwise wait for a release that never comes.
+	if locker.writeLockTxID == 0 && len(locker.waitingWriters) == 0 {
+		for _, r := range locker.waitingReaders {
+			close(r.ready)
+		}
+		locker.waitingReaders = nil
+	}
+
+	return err
+}
+
+func removeWaiter(waiters []waiter, txID int64) []waiter {
+	for i, w := range waiters {
+		if w.txID == txID {
+			return append(waiters[:i], waiters[i+1:]...)
+		}
+	}
+
+	return waiters
+}
+
+// wait adds the edges from a transaction about to be queued for a lock to the wait-for graph,
+// once the policy allows the transaction to wait. If the edges close a cycle, the youngest
+// transaction in the cycle, which has done the least work, is chosen as the victim. When that is
+// the queuing transaction, it is not queued and ErrDeadlock is returned. Otherwise, the victim's
+// wait is aborted.
+func (lm *lockerMap) wait(txID int64, key string, waitsOn []int64) (*wait, error) {
+	lm.waitsMu.Lock()
+	defer lm.waitsMu.Unlock()
+
+	// The transaction may have been wounded since it asked for the lock.
+	if err := lm.wounded[txID]; err != nil {
+		return nil, err
+	}
+	if err := lm.prevent(txID, key, waitsOn); err != nil {
+		return nil, err
+	}
+
+	w := &wait{key: key, waitsOn: waitsOn, abort: make(chan struct{})}
+	lm.waits[txID] = w
+
+	for {
+		cycle := lm.findCycle(txID)
+		if cycle == nil {
+			return w, nil
+		}
+
+		victim := cycle[0]
+		for _, id := range cycle {
+			if id > victim {
+				victim = id
+			}
+		}
+		logrus.WithField("txID", victim).Warnf("Deadlock between transactions %v, aborting the youngest", cycle)
+
+		err := fmt.Errorf("%w: transaction %d was chosen as the victim while waiting for '%s'", ErrDeadlock, victim, lm.waits[victim].key)
+		if victim == txID {
+			delete(lm.waits, txID)
+			return nil, err
+		}
+
+		// Removing the victim from the graph breaks the cycle. The requester may be in another.
+		lm.abortWait(victim, err)
+	}
+}
+
+// abortWait wakes a queued transaction with an error, and removes it from the wait-for graph.
+// The caller must hold waitsMu.
+func (lm *lockerMap) abortWait(txID int64, err error) {
+	w := lm.waits[txID]
+	w.err = err
+	close(w.abort)
+	delete(lm.waits, txID)
+}
+
+// findCycle returns the transactions on a cycle in the wait-for graph through a transaction, if there is one.
+// The caller must hold waitsMu.
+func (lm *lockerMap) findCycle(txID int64) []int64 {
+	visited := make(map[int64]bool)
+	var path []int64
+
+	var visit func(id int64) bool
+	visit = func(id int64) bool {
+		w, ok := lm.waits[id]
+		if !ok {
+			return false
+		}
+		path = append(path, id)
+		for _, next := range w.waitsOn {
+			if next == txID {
+				return true
+			}
+			if !visited[next] {
+				visited[next] = true
+				if visit(next) {
+					return true
 				}
 			}
-			locker.mu.Unlock()
-			return ctx.Err()
-		case <-ready:
-			break
 		}
+		path = path[:len(path)-1]
+
+		return false
 	}
+
+	if visit(txID) {
+		return path
+	}
+
+	return nil
+}
+
+// unwait removes a transaction that is no longer queued from the wait-for graph.
+func (lm *lockerMap) unwait(txID int64) {
+	lm.waitsMu.Lock()
+	delete(lm.waits, txID)
+	lm.waitsMu.Unlock()
 }
 
 // Release gives up all locks held by a transaction.
 func (lm *lockerMap) Release(txID int64) {
 	logrus.WithField("txID", txID).Debug("Releasing transaction")
-	keys, ok := lm.keys[txID]
-	if !ok {
+	lm.waitsMu.Lock()
+	delete(lm.wounded, txID)
+	lm.waitsMu.Unlock()
+	lm.releaseRanges(txID)
+
+	// The keys are copied out, as setTxKey may append to them while they are released.
+	lm.mu.RLock()
+	keys := append([]string(nil), lm.keys[txID]...)
+	lm.mu.RUnlock()
+	if len(keys) == 0 {
 		return
 	}
 
@@ -183,25 +443,7 @@ func (lm *lockerMap) Release(txID int64) {
 			locker.waitingReaders = nil
 		}
 
-		if len(locker.activeTransactions) == 0 && len(locker.waitingWriters) != 0 {
-			w := locker.waitingWriters[0]
-			locker.waitingWriters = locker.waitingWriters[1:]
-			close(w.ready)
-		} else if len(locker.activeTransactions) == 1 {
-			var activeTxID int64
-			for k := range locker.activeTransactions {
-				activeTxID = k
-			}
-
-			ww := locker.waitingWriters
-			for i, w := range ww {
-				if w.txID == activeTxID {
-					close(w.ready)
-					locker.waitingWriters = append(locker.waitingWriters[:i], locker.waitingWriters[i+1:]...)
-				}
-			}
-		}
-
+		locker.wakeWriter()
 		locker.mu.Unlock()
 	}
 
@@ -209,3 +451,43 @@ func (lm *lockerMap) Release(txID int64) {
 	delete(lm.keys, txID)
 	lm.mu.Unlock()
 }
+
+// ReleaseRead gives up a transaction's shared lock on a key before the transaction ends, as one that
+// does not need repeatable reads does once it has read the key. An exclusive lock is kept.
+func (lm *lockerMap) ReleaseRead(txID int64, key string) {
+	locker := lm.getKeyLocker(key)
+
+	locker.mu.Lock()
+	defer locker.mu.Unlock()
+
+	if _, ok := locker.activeTransactions[txID]; !ok || locker.writeLockTxID == txID {
+		return
+	}
+	logrus.WithField("txID", txID).Debugf("Releasing read lock for %s", key)
+	delete(locker.activeTransactions, txID)
+	locker.wakeWriter()
+}
+
+// wakeWriter wakes the writer that can take the lock now that a holder has released it: the first
+// queued writer once the lock is free, or the only remaining holder if it is waiting to upgrade.
+// The caller must hold the lock's mutex.
+func (locker *keyLocker) wakeWriter() {
+	if len(locker.activeTransactions) == 0 && len(locker.waitingWriters) != 0 {
+		w := locker.waitingWriters[0]
+		locker.waitingWriters = locker.waitingWriters[1:]
+		close(w.ready)
+	} else if len(locker.activeTransactions) == 1 {
+		var activeTxID int64
+		for k := range locker.activeTransactions {
+			activeTxID = k
+		}
+
+		ww := locker.waitingWriters
+		for i, w := range ww {
+			if w.txID == activeTxID {
+				close(w.ready)
+				locker.waitingWriters = append(locker.waitingWriters[:i], locker.waitingWriters[i+1:]...)
+			}
+		}
+	}
+}
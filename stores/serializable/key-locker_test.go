@@ -0,0 +1,134 @@
+package serializable
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/christianalexander/kvdb/stores"
+)
+
+// setAsync sets a key on a goroutine of its own, as a transaction that may have to wait for a lock.
+func setAsync(s stores.Store, ctx context.Context, key, value string) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Set(ctx, key, value)
+	}()
+
+	return done
+}
+
+// awaitQueued waits until a transaction is queued for a lock.
+func awaitQueued(t *testing.T, s stores.Store, txID int64) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		for _, w := range s.(LockInspector).Locks().WaitsFor {
+			if w.TransactionID == txID {
+				return
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("transaction %d was not queued for a lock", txID)
+}
+
+// result returns the error a transaction waiting for a lock was given.
+func result(t *testing.T, done <-chan error) error {
+	t.Helper()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(time.Second):
+		t.Fatal("the transaction is still waiting for the lock")
+		return nil
+	}
+}
+
+func TestDeadlockAbortsYoungest(t *testing.T) {
+	s := newTwoPhaseLockStore(t, nil)
+	older, younger := txContext(2), txContext(3)
+
+	set(t, s, older, "a", "2")
+	set(t, s, younger, "b", "3")
+
+	done := setAsync(s, older, "b", "2")
+	awaitQueued(t, s, 2)
+
+	// Waiting for a would close the cycle, so the younger transaction is chosen as the victim.
+	err := s.Set(younger, "a", "3")
+	if !errors.Is(err, ErrDeadlock) || !stores.AbortsTransaction(err) {
+		t.Fatalf("younger transaction closing the cycle: got %v, want %v", err, ErrDeadlock)
+	}
+
+	s.Release(younger)
+	if err := result(t, done); err != nil {
+		t.Fatalf("older transaction once the victim was rolled back: %v", err)
+	}
+	s.Release(older)
+
+	if table := s.(LockInspector).Locks(); len(table.Keys) != 0 || len(table.WaitsFor) != 0 {
+		t.Errorf("locks left after both transactions ended: %+v", table)
+	}
+}
+
+func TestDeadlockAbortsWaitingVictim(t *testing.T) {
+	s := newTwoPhaseLockStore(t, nil)
+	older, younger := txContext(2), txContext(3)
+
+	set(t, s, older, "a", "2")
+	set(t, s, younger, "b", "3")
+
+	// The younger transaction is queued first, so it is woken as the victim when the older one closes the cycle.
+	done := setAsync(s, younger, "a", "3")
+	awaitQueued(t, s, 3)
+	waiting := setAsync(s, older, "b", "2")
+
+	if err := result(t, done); !errors.Is(err, ErrDeadlock) {
+		t.Fatalf("waiting victim: got %v, want %v", err, ErrDeadlock)
+	}
+	s.Release(younger)
+	if err := result(t, waiting); err != nil {
+		t.Fatalf("older transaction once the victim was rolled back: %v", err)
+	}
+	s.Release(older)
+}
+
+func TestLockTimeout(t *testing.T) {
+	s := NewTwoPhaseLockStore(stores.NewInMemoryStore(), Options{LockTimeout: 20 * time.Millisecond})
+	holder, waiter := txContext(2), txContext(3)
+
+	set(t, s, holder, "a", "2")
+
+	start := time.Now()
+	err := s.Set(waiter, "a", "3")
+	if !errors.Is(err, ErrLockTimeout) || !errors.Is(err, stores.ErrLockTimeout) {
+		t.Fatalf("write of a locked key: got %v, want %v", err, ErrLockTimeout)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("gave up after %v, before the lock timeout", waited)
+	}
+	// Only the statement fails, so the transaction stays open and is not aborted.
+	if stores.AbortsTransaction(err) {
+		t.Errorf("a lock timeout aborts the transaction")
+	}
+	if _, err := s.Get(waiter, "a"); !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("read of a locked key: got %v, want %v", err, ErrLockTimeout)
+	}
+
+	// The context overrides the store's timeout, and zero waits until the lock is released.
+	done := setAsync(s, context.WithValue(waiter, stores.ContextKeyLockTimeout, time.Duration(0)), "a", "3")
+	awaitQueued(t, s, 3)
+	time.Sleep(40 * time.Millisecond)
+	s.Release(holder)
+	if err := result(t, done); err != nil {
+		t.Fatalf("write without a lock timeout once the lock was released: %v", err)
+	}
+	if v := get(t, s, waiter, "a"); v != "3" {
+		t.Errorf("read after the write: got %s, want 3", v)
+	}
+	s.Release(waiter)
+}
@@ -0,0 +1,186 @@
+package serializable
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A LockInspector can report the locks held and waited for by transactions.
+type LockInspector interface {
+	Locks() LockTable
+}
+
+// LockMode is how a lock on a key is held.
+type LockMode string
+
+const (
+	// LockShared is a read lock, which any number of transactions can hold.
+	LockShared LockMode = "shared"
+	// LockExclusive is a write lock, held by a single transaction.
+	LockExclusive LockMode = "exclusive"
+)
+
+// A LockTable is a snapshot of the lock manager. Each key is read at a slightly different moment,
+// so the snapshot may not be consistent while transactions are acquiring and releasing locks.
+type LockTable struct {
+	// Keys holds the keys that are locked or waited for, in order.
+	Keys []KeyLock
+	// Ranges holds the range locks, which keep other transactions from writing in them.
+	Ranges []RangeLock
+	// WaitsFor holds the edges of the wait-for graph, from each waiting transaction to those it waits for.
+	WaitsFor []WaitsFor
+}
+
+// A KeyLock is the state of the lock on a key.
+type KeyLock struct {
+	Key     string
+	Mode    LockMode
+	Holders []int64
+	// WaitingReaders and WaitingWriters are queued for the lock, in order.
+	WaitingReaders []LockWaiter
+	WaitingWriters []LockWaiter
+}
+
+// A RangeLock is a shared lock on the keys in [Start, End), where an empty End is unbounded.
+type RangeLock struct {
+	TransactionID int64
+	Start, End    string
+}
+
+// A LockWaiter is a transaction queued for a lock.
+type LockWaiter struct {
+	TransactionID int64
+	// Waited is how long the transaction has been waiting for the lock.
+	Waited time.Duration
+}
+
+// A WaitsFor is a transaction waiting for the lock on a key, which is held or first queued for by others.
+type WaitsFor struct {
+	TransactionID int64
+	Key           string
+	WaitsOn       []int64
+}
+
+// Locks returns a snapshot of the locks held and waited for.
+func (ts *twoPhaseLockStore) Locks() LockTable {
+	return ts.lm.table()
+}
+
+func (lm *lockerMap) table() LockTable {
+	now := time.Now()
+
+	lm.mu.RLock()
+	lockers := make(map[string]*keyLocker, len(lm.lockers))
+	for k, l := range lm.lockers {
+		lockers[k] = l
+	}
+	lm.mu.RUnlock()
+
+	var table LockTable
+	for key, locker := range lockers {
+		locker.mu.Lock()
+		lock := KeyLock{
+			Key:            key,
+			Mode:           LockShared,
+			WaitingReaders: lockWaiters(locker.waitingReaders, now),
+			WaitingWriters: lockWaiters(locker.waitingWriters, now),
+		}
+		if locker.writeLockTxID != 0 {
+			lock.Mode = LockExclusive
+		}
+		for txID := range locker.activeTransactions {
+			lock.Holders = append(lock.Holders, txID)
+		}
+		locker.mu.Unlock()
+
+		if len(lock.Holders) == 0 && len(lock.WaitingReaders) == 0 && len(lock.WaitingWriters) == 0 {
+			continue
+		}
+		sortIDs(lock.Holders)
+		table.Keys = append(table.Keys, lock)
+	}
+	sort.Slice(table.Keys, func(i, j int) bool { return table.Keys[i].Key < table.Keys[j].Key })
+
+	lm.rangesMu.Lock()
+	for _, r := range lm.ranges {
+		table.Ranges = append(table.Ranges, RangeLock{TransactionID: r.txID, Start: r.start, End: r.end})
+	}
+	lm.rangesMu.Unlock()
+
+	lm.waitsMu.Lock()
+	for txID, w := range lm.waits {
+		waitsOn := append([]int64(nil), w.waitsOn...)
+		sortIDs(waitsOn)
+		table.WaitsFor = append(table.WaitsFor, WaitsFor{TransactionID: txID, Key: w.key, WaitsOn: waitsOn})
+	}
+	lm.waitsMu.Unlock()
+	sort.Slice(table.WaitsFor, func(i, j int) bool { return table.WaitsFor[i].TransactionID < table.WaitsFor[j].TransactionID })
+
+	return table
+}
+
+func lockWaiters(waiters []waiter, now time.Time) []LockWaiter {
+	var result []LockWaiter
+	for _, w := range waiters {
+		result = append(result, LockWaiter{TransactionID: w.txID, Waited: now.Sub(w.since)})
+	}
+
+	return result
+}
+
+func sortIDs(ids []int64) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+}
+
+// String lists the lock on each key, with its holders and waiters, then the range locks, followed by the wait-for graph.
+func (t LockTable) String() string {
+	var b strings.Builder
+	for _, lock := range t.Keys {
+		if len(lock.Holders) == 0 {
+			fmt.Fprintf(&b, "%s free\n", lock.Key)
+		} else {
+			fmt.Fprintf(&b, "%s %s held by %s\n", lock.Key, lock.Mode, joinIDs(lock.Holders, ", "))
+		}
+		for _, w := range lock.WaitingWriters {
+			fmt.Fprintf(&b, "  writer %d waiting %v\n", w.TransactionID, w.Waited.Round(time.Millisecond))
+		}
+		for _, w := range lock.WaitingReaders {
+			fmt.Fprintf(&b, "  reader %d waiting %v\n", w.TransactionID, w.Waited.Round(time.Millisecond))
+		}
+	}
+	for _, r := range t.Ranges {
+		fmt.Fprintf(&b, "range [%s, %s) shared held by %d\n", r.Start, r.End, r.TransactionID)
+	}
+	if len(t.Keys) != 0 || len(t.Ranges) != 0 {
+		b.WriteString("\n")
+	}
+	b.WriteString(t.DOT())
+
+	return b.String()
+}
+
+// DOT writes the wait-for graph in the Graphviz DOT language. Each edge points from a waiting
+// transaction to one it waits for, and is labelled with the key.
+func (t LockTable) DOT() string {
+	var b strings.Builder
+	b.WriteString("digraph waits_for {\n")
+	for _, w := range t.WaitsFor {
+		for _, on := range w.WaitsOn {
+			fmt.Fprintf(&b, "  %d -> %d [label=%q];\n", w.TransactionID, on, w.Key)
+		}
+	}
+	b.WriteString("}\n")
+
+	return b.String()
+}
+
+func joinIDs(ids []int64, sep string) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = fmt.Sprint(id)
+	}
+
+	return strings.Join(s, sep)
+}
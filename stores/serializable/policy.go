@@ -0,0 +1,96 @@
+package serializable
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A Policy decides what a transaction does when a lock it asks for is held by another transaction.
+// Transactions are aged by their IDs, which are assigned in the order they begin.
+type Policy string
+
+const (
+	// PolicyDetect waits for the lock, and aborts the youngest transaction in any deadlock that forms.
+	PolicyDetect Policy = "detect"
+	// PolicyWaitDie waits only for younger transactions. A transaction asking for a lock held by an
+	// older one dies instead.
+	PolicyWaitDie Policy = "wait-die"
+	// PolicyWoundWait wounds the younger transactions holding the lock, aborting them, and waits for
+	// older ones.
+	PolicyWoundWait Policy = "wound-wait"
+	// PolicyNoWait never waits, failing as soon as the lock is held by another transaction.
+	PolicyNoWait Policy = "no-wait"
+)
+
+// ErrLockConflict is returned to a transaction that asked for a held lock, and was aborted by the
+// policy rather than allowed to wait. The transaction must be rolled back, and can then be retried.
+var ErrLockConflict error = abortError("could not obtain lock")
+
+// ErrWounded is returned to a transaction that was wounded by an older transaction under
+// PolicyWoundWait. The transaction must be rolled back, and can then be retried.
+var ErrWounded error = abortError("transaction was wounded")
+
+// ParsePolicy parses the name of a policy.
+func ParsePolicy(name string) (Policy, error) {
+	switch p := Policy(name); p {
+	case PolicyDetect, PolicyWaitDie, PolicyWoundWait, PolicyNoWait:
+		return p, nil
+	}
+
+	return "", fmt.Errorf("unknown lock policy '%s': expected '%s', '%s', '%s' or '%s'", name, PolicyDetect, PolicyWaitDie, PolicyWoundWait, PolicyNoWait)
+}
+
+// prevent applies the policy to a transaction about to wait for others to release the lock on a key.
+// An error means the transaction must not wait. The caller must hold waitsMu.
+func (lm *lockerMap) prevent(txID int64, key string, waitsOn []int64) error {
+	switch lm.policy {
+	case PolicyNoWait:
+		if len(waitsOn) > 0 {
+			return fmt.Errorf("%w: '%s' is held by transaction %d", ErrLockConflict, key, waitsOn[0])
+		}
+	case PolicyWaitDie:
+		for _, other := range waitsOn {
+			if other < txID {
+				return fmt.Errorf("%w: '%s' is held by the older transaction %d", ErrLockConflict, key, other)
+			}
+		}
+	case PolicyWoundWait:
+		for _, other := range waitsOn {
+			if other > txID {
+				lm.wound(other, txID, key)
+			}
+		}
+	}
+
+	return nil
+}
+
+// wound aborts a younger transaction that holds a lock an older transaction is about to wait for. A
+// waiting transaction is woken with ErrWounded, and any other is left to OnWound to roll back. Either
+// way, its later requests for locks fail. The caller must hold waitsMu.
+func (lm *lockerMap) wound(txID, by int64, key string) {
+	if _, ok := lm.wounded[txID]; ok {
+		return
+	}
+
+	err := fmt.Errorf("%w by the older transaction %d, which is waiting for '%s'", ErrWounded, by, key)
+	lm.wounded[txID] = err
+	logrus.WithField("txID", txID).Infof("Wounded by transaction %d", by)
+
+	if _, ok := lm.waits[txID]; ok {
+		lm.abortWait(txID, err)
+		return
+	}
+	if lm.onWound != nil {
+		go lm.onWound(txID, err)
+	}
+}
+
+// woundedError returns the error a wounded transaction is given for any lock it asks for.
+func (lm *lockerMap) woundedError(txID int64) error {
+	lm.waitsMu.Lock()
+	defer lm.waitsMu.Unlock()
+
+	return lm.wounded[txID]
+}
@@ -0,0 +1,112 @@
+package serializable
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/christianalexander/kvdb/stores"
+)
+
+// newPolicyStore returns a two-phase lock store with a policy, where transaction 2 is older than transaction 3.
+func newPolicyStore(policy Policy, onWound func(txID int64, err error)) stores.Store {
+	return NewTwoPhaseLockStore(stores.NewInMemoryStore(), Options{Policy: policy, OnWound: onWound})
+}
+
+func TestPolicyWaitDie(t *testing.T) {
+	s := newPolicyStore(PolicyWaitDie, nil)
+	older, younger := txContext(2), txContext(3)
+
+	set(t, s, older, "a", "2")
+	set(t, s, younger, "b", "3")
+
+	// A younger transaction dies rather than wait for an older one.
+	err := s.Set(younger, "a", "3")
+	if !errors.Is(err, ErrLockConflict) || !stores.AbortsTransaction(err) {
+		t.Fatalf("younger transaction asking for an older one's lock: got %v, want %v", err, ErrLockConflict)
+	}
+
+	// An older transaction waits for a younger one.
+	done := setAsync(s, older, "b", "2")
+	awaitQueued(t, s, 2)
+	s.Release(younger)
+	if err := result(t, done); err != nil {
+		t.Fatalf("older transaction once the younger one ended: %v", err)
+	}
+	s.Release(older)
+}
+
+func TestPolicyWoundWait(t *testing.T) {
+	wounded := make(chan int64, 1)
+	s := newPolicyStore(PolicyWoundWait, func(txID int64, err error) {
+		if !errors.Is(err, ErrWounded) {
+			t.Errorf("wound of transaction %d: got %v, want %v", txID, err, ErrWounded)
+		}
+		wounded <- txID
+	})
+	older, younger := txContext(2), txContext(3)
+
+	set(t, s, older, "a", "2")
+	set(t, s, younger, "b", "3")
+
+	// A younger transaction waits for an older one.
+	waiting := setAsync(s, younger, "a", "3")
+	awaitQueued(t, s, 3)
+
+	// An older transaction wounds the younger one holding the lock it asks for, and waits for it.
+	done := setAsync(s, older, "b", "2")
+	if err := result(t, waiting); !errors.Is(err, ErrWounded) || !stores.AbortsTransaction(err) {
+		t.Fatalf("waiting younger transaction: got %v, want %v", err, ErrWounded)
+	}
+	if err := s.Set(younger, "c", "3"); !errors.Is(err, ErrWounded) {
+		t.Errorf("later lock of the wounded transaction: got %v, want %v", err, ErrWounded)
+	}
+	s.Release(younger)
+	if err := result(t, done); err != nil {
+		t.Fatalf("older transaction once the younger one was rolled back: %v", err)
+	}
+
+	// A younger transaction that is not waiting is left to OnWound.
+	younger = txContext(4)
+	set(t, s, younger, "c", "4")
+	done = setAsync(s, older, "c", "2")
+	select {
+	case txID := <-wounded:
+		if txID != 4 {
+			t.Errorf("wounded transaction %d, want 4", txID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnWound was not called")
+	}
+	s.Release(younger)
+	if err := result(t, done); err != nil {
+		t.Fatalf("older transaction once the younger one was rolled back: %v", err)
+	}
+	s.Release(older)
+}
+
+func TestPolicyNoWait(t *testing.T) {
+	s := newPolicyStore(PolicyNoWait, nil)
+	older, younger := txContext(2), txContext(3)
+
+	set(t, s, txContext(1), "c", "1")
+	s.Release(txContext(1))
+	set(t, s, older, "a", "2")
+	set(t, s, younger, "b", "3")
+
+	// Neither transaction waits, whatever its age.
+	for name, err := range map[string]error{
+		"older":   s.Set(older, "b", "2"),
+		"younger": s.Set(younger, "a", "3"),
+	} {
+		if !errors.Is(err, ErrLockConflict) {
+			t.Errorf("%s transaction asking for a held lock: got %v, want %v", name, err, ErrLockConflict)
+		}
+	}
+
+	// Shared locks are not in conflict.
+	get(t, s, older, "c")
+	get(t, s, younger, "c")
+	s.Release(older)
+	s.Release(younger)
+}
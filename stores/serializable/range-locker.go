@@ -0,0 +1,152 @@
+package serializable
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/christianalexander/kvdb/stores"
+	"github.com/sirupsen/logrus"
+)
+
+// A rangeLock is a shared lock on the keys in [start, end), where an empty end is unbounded,
+// including the keys that do not exist yet. It keeps other transactions from writing in the range,
+// so that a transaction that enumerates it sees no phantoms.
+type rangeLock struct {
+	txID       int64
+	start, end string
+}
+
+func (r rangeLock) String() string {
+	return fmt.Sprintf("[%s, %s)", r.start, r.end)
+}
+
+// covers reports whether a range lock makes another by the same transaction unnecessary.
+func (r rangeLock) covers(other rangeLock) bool {
+	return r.txID == other.txID && r.start <= other.start && (r.end == "" || (other.end != "" && other.end <= r.end))
+}
+
+// AcquireRange gets a shared lock on a range of keys for a transaction. It waits for the other
+// transactions that have written, or are waiting to write, keys in the range.
+func (lm *lockerMap) AcquireRange(ctx context.Context, txID int64, start, end string) error {
+	r := rangeLock{txID, start, end}
+	logrus.WithField("txID", txID).Debugf("Acquiring range lock for %s", r)
+
+	return lm.awaitRanges(ctx, txID, r.String(), func() []int64 {
+		for _, held := range lm.ranges {
+			if held.covers(r) {
+				return nil
+			}
+		}
+
+		var waitsOn []int64
+		for other, keys := range lm.writeKeys {
+			if other == txID {
+				continue
+			}
+			for key := range keys {
+				if stores.InRange(key, start, end) {
+					waitsOn = append(waitsOn, other)
+					break
+				}
+			}
+		}
+		if len(waitsOn) == 0 {
+			lm.ranges = append(lm.ranges, r)
+		}
+
+		return waitsOn
+	})
+}
+
+// acquireGap marks a key as written by a transaction, so that no other transaction can lock a range
+// that covers it. It waits for the other transactions holding such a range.
+func (lm *lockerMap) acquireGap(ctx context.Context, txID int64, key string) error {
+	return lm.awaitRanges(ctx, txID, key, func() []int64 {
+		if _, ok := lm.writeKeys[txID][key]; ok {
+			return nil
+		}
+
+		var waitsOn []int64
+		for _, r := range lm.ranges {
+			if r.txID != txID && stores.InRange(key, r.start, r.end) {
+				waitsOn = append(waitsOn, r.txID)
+			}
+		}
+		if len(waitsOn) == 0 {
+			if lm.writeKeys[txID] == nil {
+				lm.writeKeys[txID] = make(map[string]struct{})
+			}
+			lm.writeKeys[txID][key] = struct{}{}
+		}
+
+		return waitsOn
+	})
+}
+
+// awaitRanges calls try, holding rangesMu, until it returns no transactions to wait for. Meanwhile, the
+// transaction waits in the wait-for graph, woken whenever a range or written key is released.
+func (lm *lockerMap) awaitRanges(ctx context.Context, txID int64, key string, try func() []int64) error {
+	var timedOut <-chan time.Time
+	if timeout := lm.timeout(ctx); timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timedOut = timer.C
+	}
+
+	for {
+		lm.rangesMu.Lock()
+		waitsOn := try()
+		if len(waitsOn) == 0 {
+			lm.rangesMu.Unlock()
+			return nil
+		}
+
+		w, err := lm.wait(txID, key, waitsOn)
+		changed := lm.rangesChanged
+		lm.rangesMu.Unlock()
+		if err != nil {
+			return err
+		}
+
+		logrus.WithField("txID", txID).Debugf("Entering range wait for %s", key)
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-timedOut:
+			err = fmt.Errorf("%w: transaction %d gave up waiting for '%s'", ErrLockTimeout, txID, key)
+		case <-w.abort:
+			err = w.err
+		}
+		lm.unwait(txID)
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// releaseRanges gives up the ranges and written keys of a transaction, waking the transactions waiting for them.
+func (lm *lockerMap) releaseRanges(txID int64) {
+	lm.rangesMu.Lock()
+	defer lm.rangesMu.Unlock()
+
+	_, released := lm.writeKeys[txID]
+	delete(lm.writeKeys, txID)
+
+	ranges := lm.ranges[:0]
+	for _, r := range lm.ranges {
+		if r.txID == txID {
+			released = true
+			continue
+		}
+		ranges = append(ranges, r)
+	}
+	lm.ranges = ranges
+
+	if released {
+		close(lm.rangesChanged)
+		lm.rangesChanged = make(chan struct{})
+	}
+}
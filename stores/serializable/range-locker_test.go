@@ -0,0 +1,67 @@
+package serializable
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRangeLockBlocksPhantoms(t *testing.T) {
+	s := newTwoPhaseLockStore(t, map[string]string{"a": "1", "b": "1", "d": "1"})
+	scanner, writer := levelContext(2, ""), levelContext(3, "")
+
+	it, err := s.Scan(scanner, "b", "d", 0)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	it.Close()
+
+	// An insert into the scanned range would be a phantom, so it waits for the scanner.
+	if err := s.Set(writer, "c", "3"); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("insert into a scanned range: got %v, want %v", err, ErrLockTimeout)
+	}
+	assertScan(t, s, scanner, "scan after the blocked insert", "a=1", "b=1", "d=1")
+
+	// Once the scanner ends, the insert goes through.
+	done := setAsync(s, txContext(3), "c", "3")
+	awaitQueued(t, s, 3)
+	s.Release(scanner)
+	if err := result(t, done); err != nil {
+		t.Fatalf("insert once the scanner ended: %v", err)
+	}
+	s.Release(writer)
+
+	if keys, err := s.Keys(levelContext(4, "")); err != nil || !reflect.DeepEqual(keys, []string{"a", "b", "c", "d"}) {
+		t.Errorf("keys after the insert: got %v, %v", keys, err)
+	}
+	s.Release(levelContext(4, ""))
+}
+
+func TestRangeLockBounds(t *testing.T) {
+	s := newTwoPhaseLockStore(t, map[string]string{"b": "1"})
+	scanner, writer := levelContext(2, ""), levelContext(3, "")
+
+	it, err := s.Scan(scanner, "b", "d", 0)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	it.Close()
+
+	// Keys outside [b, d) are not covered, including the end.
+	for _, key := range []string{"a", "d", "e"} {
+		set(t, s, writer, key, "3")
+	}
+	if err := s.Set(writer, "b0", "3"); !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("insert inside the range: got %v, want %v", err, ErrLockTimeout)
+	}
+	s.Release(writer)
+	s.Release(scanner)
+
+	// A scan waits for a transaction that has written in its range, as its write could be undone.
+	set(t, s, writer, "c", "3")
+	if _, err := s.Scan(scanner, "a", "", 0); !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("scan over an uncommitted write: got %v, want %v", err, ErrLockTimeout)
+	}
+	s.Release(writer)
+	s.Release(scanner)
+}
@@ -0,0 +1,226 @@
+package serializable
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/christianalexander/kvdb/stores"
+)
+
+// beforeImages keeps the committed values that writers have overwritten, so that read-only transactions
+// can read a consistent snapshot without taking locks.
+//
+// A writer records the committed value of each key before its first write to it, while it holds the
+// exclusive lock. When the writer is released, its before-images become versions that were replaced at
+// the new clock, whether it committed or rolled back. A snapshot taken at a clock then sees the writers
+// released before it, and the before-images of all others. Since a writer holds its locks until it is
+// released, that is a serial order of the transactions.
+type beforeImages struct {
+	mu    sync.Mutex
+	clock uint64
+	// pending holds the before-images of each open writer.
+	pending map[int64]map[string]beforeImage
+	// history holds the replaced versions of each key, oldest first, for as long as a snapshot can see them.
+	history map[string][]beforeImage
+	// snapshots holds the clock each open read-only transaction reads at.
+	snapshots map[int64]uint64
+}
+
+type beforeImage struct {
+	value     string
+	expiresAt time.Time
+	exists    bool
+	// replaced is the clock when the version stopped being the latest, or zero while its writer is open.
+	replaced uint64
+}
+
+func (b beforeImage) visible(now time.Time) bool {
+	return b.exists && (b.expiresAt.IsZero() || now.Before(b.expiresAt))
+}
+
+func newBeforeImages() *beforeImages {
+	return &beforeImages{
+		pending:   make(map[int64]map[string]beforeImage),
+		history:   make(map[string][]beforeImage),
+		snapshots: make(map[int64]uint64),
+	}
+}
+
+// readOnly reports whether the transaction in a context is read-only.
+func readOnly(ctx context.Context) bool {
+	readOnly, _ := ctx.Value(stores.ContextKeyReadOnly).(bool)
+	return readOnly
+}
+
+// record keeps the committed value of a key before a transaction first writes it. The caller must hold
+// the exclusive lock on the key, and write it only after record returns.
+func (ts *twoPhaseLockStore) record(ctx context.Context, txID int64, key string) {
+	b := ts.images
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.pending[txID][key]; ok {
+		return
+	}
+	if b.pending[txID] == nil {
+		b.pending[txID] = make(map[string]beforeImage)
+	}
+
+	image := beforeImage{}
+	if value, err := ts.Store.Get(ctx, key); err == nil {
+		image.value, image.exists = value, true
+		image.expiresAt, _ = ts.Store.Expiry(ctx, key)
+	}
+	b.pending[txID][key] = image
+}
+
+// snapshot returns the clock the read-only transaction in a context reads at. Under READ COMMITTED,
+// each read sees the latest commits, and otherwise the snapshot is taken by the first read.
+// The caller must hold the mutex.
+func (b *beforeImages) snapshot(ctx context.Context, txID int64) uint64 {
+	if isolation(ctx) == stores.IsolationReadCommitted {
+		return b.clock
+	}
+
+	s, ok := b.snapshots[txID]
+	if !ok {
+		s = b.clock
+		b.snapshots[txID] = s
+	}
+
+	return s
+}
+
+// image returns the version of a key a snapshot sees, if it is no longer in the store.
+// The caller must hold the mutex.
+func (b *beforeImages) image(snapshot uint64, key string) (beforeImage, bool) {
+	for _, image := range b.history[key] {
+		if image.replaced > snapshot {
+			return image, true
+		}
+	}
+	for _, images := range b.pending {
+		if image, ok := images[key]; ok {
+			return image, true
+		}
+	}
+
+	return beforeImage{}, false
+}
+
+// readSnapshot returns the version of a key seen by the read-only transaction in a context.
+func (ts *twoPhaseLockStore) readSnapshot(ctx context.Context, txID int64, key string) (beforeImage, bool) {
+	b := ts.images
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	image, ok := b.image(b.snapshot(ctx, txID), key)
+	if !ok {
+		// No writer has touched the key since the snapshot, and none can until the mutex is released.
+		if value, err := ts.Store.Get(ctx, key); err == nil {
+			image.value, image.exists = value, true
+			image.expiresAt, _ = ts.Store.Expiry(ctx, key)
+		}
+	}
+	if !image.visible(time.Now()) {
+		return beforeImage{}, false
+	}
+
+	return image, true
+}
+
+// scanSnapshot returns the live keys and values in a range seen by the read-only transaction in a context.
+func (ts *twoPhaseLockStore) scanSnapshot(ctx context.Context, txID int64, start, end string, limit int) ([]stores.KeyValue, error) {
+	b := ts.images
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	snapshot := b.snapshot(ctx, txID)
+
+	values := make(map[string]string)
+	it, err := ts.Store.Scan(ctx, start, end, 0)
+	if err != nil {
+		return nil, err
+	}
+	for it.Next() {
+		values[it.Key()] = it.Value()
+	}
+	it.Close()
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	// Keys that were written since the snapshot are read from their before-images, which also brings
+	// back those deleted since.
+	now := time.Now()
+	overwritten := make(map[string]struct{})
+	for k := range b.history {
+		overwritten[k] = struct{}{}
+	}
+	for _, images := range b.pending {
+		for k := range images {
+			overwritten[k] = struct{}{}
+		}
+	}
+	for k := range overwritten {
+		if !stores.InRange(k, start, end) {
+			continue
+		}
+		image, ok := b.image(snapshot, k)
+		if !ok {
+			continue
+		}
+		delete(values, k)
+		if image.visible(now) {
+			values[k] = image.value
+		}
+	}
+
+	result := make([]stores.KeyValue, 0, len(values))
+	for k, v := range values {
+		result = append(result, stores.KeyValue{Key: k, Value: v})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+
+	return result, nil
+}
+
+// release ends a transaction's snapshot, and turns its before-images into replaced versions, dropping
+// the versions no open snapshot can see.
+func (b *beforeImages) release(txID int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.snapshots, txID)
+	if images, ok := b.pending[txID]; ok {
+		delete(b.pending, txID)
+		b.clock++
+		for k, image := range images {
+			image.replaced = b.clock
+			b.history[k] = append(b.history[k], image)
+		}
+	}
+
+	oldest := b.clock
+	for _, s := range b.snapshots {
+		if s < oldest {
+			oldest = s
+		}
+	}
+	for k, images := range b.history {
+		i := 0
+		for i < len(images) && images[i].replaced <= oldest {
+			i++
+		}
+		if i == len(images) {
+			delete(b.history, k)
+			continue
+		}
+		b.history[k] = images[i:]
+	}
+}
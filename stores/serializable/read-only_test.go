@@ -0,0 +1,191 @@
+package serializable
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/christianalexander/kvdb/stores"
+	"github.com/christianalexander/kvdb/stores/deferred"
+)
+
+// readOnlyContext returns the context of a read-only transaction at an isolation level.
+func readOnlyContext(txID int64, level stores.IsolationLevel) context.Context {
+	return context.WithValue(levelContext(txID, level), stores.ContextKeyReadOnly, true)
+}
+
+// scan returns the keys and values a transaction sees, as key=value.
+func scan(t *testing.T, s stores.Store, ctx context.Context) []string {
+	t.Helper()
+
+	it, err := s.Scan(ctx, "", "", 0)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	defer it.Close()
+
+	var pairs []string
+	for it.Next() {
+		pairs = append(pairs, it.Key()+"="+it.Value())
+	}
+
+	return pairs
+}
+
+func assertScan(t *testing.T, s stores.Store, ctx context.Context, when string, want ...string) {
+	t.Helper()
+
+	if got := scan(t, s, ctx); !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: got %v, want %v", when, got, want)
+	}
+}
+
+func TestReadOnlyTakesNoLocks(t *testing.T) {
+	s := newTwoPhaseLockStore(t, map[string]string{"x": "1"})
+	writer, reader := levelContext(2, ""), readOnlyContext(3, "")
+
+	set(t, s, writer, "x", "2")
+
+	// The uncommitted write is neither waited for nor read.
+	if v := get(t, s, reader, "x"); v != "1" {
+		t.Errorf("read of an uncommitted write: got %s, want 1", v)
+	}
+	// The reader holds no lock the writer has to wait for.
+	set(t, s, writer, "x", "3")
+
+	if locks := s.(LockInspector).Locks(); len(locks.Keys) != 1 || !reflect.DeepEqual(locks.Keys[0].Holders, []int64{2}) {
+		t.Errorf("locks: got %+v, want only the writer's", locks.Keys)
+	}
+	s.Release(writer)
+	s.Release(reader)
+}
+
+func TestReadOnlySnapshot(t *testing.T) {
+	for name, store := range map[string]stores.Store{
+		"in place": stores.NewInMemoryStore(),
+		"deferred": deferred.NewStore(stores.NewInMemoryStore()),
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := NewTwoPhaseLockStore(store, Options{})
+			run := func(txID int64, fn func(ctx context.Context)) {
+				ctx := levelContext(txID, "")
+				if _, ok := s.(stores.TransactionalStore); !ok {
+					defer s.Release(ctx)
+					fn(ctx)
+					return
+				}
+
+				begin(t, s, ctx)
+				fn(ctx)
+				if err := commit(s, ctx); err != nil {
+					t.Fatalf("commit: %v", err)
+				}
+			}
+			run(1, func(ctx context.Context) {
+				set(t, s, ctx, "a", "1")
+				set(t, s, ctx, "b", "1")
+			})
+
+			reader := readOnlyContext(10, "")
+			assertScan(t, s, reader, "first scan", "a=1", "b=1")
+
+			run(2, func(ctx context.Context) {
+				set(t, s, ctx, "a", "2")
+				if err := s.Delete(ctx, "b"); err != nil {
+					t.Fatalf("delete: %v", err)
+				}
+				set(t, s, ctx, "c", "2")
+				assertScan(t, s, reader, "scan during a commit", "a=1", "b=1")
+			})
+			assertScan(t, s, reader, "scan after a commit", "a=1", "b=1")
+			if v := get(t, s, reader, "b"); v != "1" {
+				t.Errorf("read of a key deleted since the snapshot: got %s, want 1", v)
+			}
+
+			later := readOnlyContext(11, "")
+			assertScan(t, s, later, "scan in a later snapshot", "a=2", "c=2")
+			keys, err := s.Keys(later)
+			if err != nil || !reflect.DeepEqual(keys, []string{"a", "c"}) {
+				t.Errorf("keys in a later snapshot: got %v, %v", keys, err)
+			}
+
+			readCommitted := readOnlyContext(12, stores.IsolationReadCommitted)
+			get(t, s, readCommitted, "a")
+			run(3, func(ctx context.Context) { set(t, s, ctx, "a", "3") })
+			if v := get(t, s, readCommitted, "a"); v != "3" {
+				t.Errorf("READ COMMITTED read after a commit: got %s, want 3", v)
+			}
+			if v := get(t, s, reader, "a"); v != "1" {
+				t.Errorf("read after two commits: got %s, want 1", v)
+			}
+
+			for _, ctx := range []context.Context{reader, later, readCommitted} {
+				s.Release(ctx)
+			}
+			assertPruned(t, s)
+		})
+	}
+}
+
+func TestReadOnlySnapshotAfterRollback(t *testing.T) {
+	s := newTwoPhaseLockStore(t, map[string]string{"a": "1"})
+	reader, writer := readOnlyContext(10, ""), levelContext(2, "")
+
+	get(t, s, reader, "a")
+
+	// A rollback in place undoes the write by writing the old value back.
+	set(t, s, writer, "a", "2")
+	set(t, s, writer, "a", "1")
+	s.Release(writer)
+
+	if v := get(t, s, reader, "a"); v != "1" {
+		t.Errorf("read after a rollback: got %s, want 1", v)
+	}
+	if v := get(t, s, readOnlyContext(11, ""), "a"); v != "1" {
+		t.Errorf("read in a later snapshot: got %s, want 1", v)
+	}
+	s.Release(reader)
+	s.Release(readOnlyContext(11, ""))
+	assertPruned(t, s)
+}
+
+func TestReadOnlyRejectsWrites(t *testing.T) {
+	s := newTwoPhaseLockStore(t, map[string]string{"a": "1"})
+	ctx := readOnlyContext(2, "")
+
+	for name, write := range map[string]func() error{
+		"set":    func() error { return s.Set(ctx, "a", "2") },
+		"delete": func() error { return s.Delete(ctx, "a") },
+		"expire": func() error { return s.Expire(ctx, "a", time.Now()) },
+	} {
+		if err := write(); !errors.Is(err, stores.ErrReadOnlyTransaction) {
+			t.Errorf("%s: got %v, want %v", name, err, stores.ErrReadOnlyTransaction)
+		}
+	}
+	if v := get(t, s, ctx, "a"); v != "1" {
+		t.Errorf("read after the rejected writes: got %s, want 1", v)
+	}
+	s.Release(ctx)
+}
+
+// assertPruned checks that no before-image is kept once every transaction has ended.
+func assertPruned(t *testing.T, s stores.Store) {
+	t.Helper()
+
+	var images *beforeImages
+	switch ts := s.(type) {
+	case *twoPhaseLockStore:
+		images = ts.images
+	case transactionalTwoPhaseLockStore:
+		images = ts.images
+	}
+	images.mu.Lock()
+	defer images.mu.Unlock()
+
+	if len(images.pending) != 0 || len(images.history) != 0 || len(images.snapshots) != 0 {
+		t.Errorf("before-images left after every transaction ended: %d pending, %d keys of history, %d snapshots",
+			len(images.pending), len(images.history), len(images.snapshots))
+	}
+}
@@ -0,0 +1,378 @@
+package serializable
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/christianalexander/kvdb/stores"
+	"github.com/christianalexander/kvdb/stores/snapshot"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrSerializationFailure is returned by Commit when committing a transaction could make the history
+// of transactions impossible to order serially. The transaction has been rolled back, and can be retried.
+var ErrSerializationFailure = errors.New("could not serialize access due to read/write dependencies among transactions")
+
+// ssiStore implements serializable snapshot isolation, an optimistic alternative to two-phase locking.
+//
+// Transactions run on snapshots, so readers and writers never block each other, and every key and range
+// a transaction reads is recorded. Transaction A has a rw-antidependency on a concurrent transaction B
+// when A read a key that B wrote: A did not see B's write, so A must come before B in any serial order.
+// Every cycle of dependencies between concurrent transactions has a pivot, with a rw-antidependency both
+// into and out of it. Commit fails with ErrSerializationFailure when it would complete such a pivot.
+// This can abort transactions whose history was serializable after all, but never lets one through that
+// was not.
+//
+// Transactions begun at a weaker isolation level run on the snapshot store at that level, and take no part
+// in the checks, so the guarantee holds among the SERIALIZABLE transactions only.
+type ssiStore struct {
+	stores.Store
+
+	mu    sync.Mutex
+	clock uint64
+	txs   map[int64]*ssiTransaction
+	// committed holds the committed transactions that are concurrent with an open transaction, oldest first.
+	committed []*ssiTransaction
+}
+
+type ssiTransaction struct {
+	id int64
+	// tracked is set for SERIALIZABLE transactions, whose reads and writes are checked.
+	tracked bool
+	// begin is the clock when the snapshot was taken, and commit is the clock when the transaction
+	// committed, or zero while it is open.
+	begin, commit uint64
+
+	reads  map[string]struct{}
+	ranges []rangeLock
+	writes map[string]struct{}
+
+	// in is set when a concurrent transaction has a rw-antidependency on this one, and out when this
+	// one has a rw-antidependency on a concurrent transaction.
+	in, out bool
+}
+
+// NewSSIStore returns a store with serializable snapshot isolation, which is optimistic where
+// NewTwoPhaseLockStore is pessimistic. Transactions read from snapshots of store, and those that
+// conflict fail to commit with ErrSerializationFailure rather than waiting for locks.
+// The returned store is a stores.SavepointStore, and commits its writes to store.
+func NewSSIStore(store stores.Store) stores.Store {
+	return &ssiStore{
+		Store: snapshot.NewStore(store),
+		txs:   make(map[int64]*ssiTransaction),
+	}
+}
+
+func (s *ssiStore) Begin(ctx context.Context) error {
+	txID, ok := ctx.Value(stores.ContextKeyTransactionID).(int64)
+	if !ok || txID == 0 {
+		return fmt.Errorf("ssi store could not begin without a transaction ID")
+	}
+
+	// The snapshot is taken while no transaction can commit, so that it matches the clock.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Serializable transactions run on snapshots, and their dependencies are checked on top.
+	level := stores.IsolationLevelFromContext(ctx, stores.IsolationSerializable)
+	tracked := level == stores.IsolationSerializable
+	if tracked {
+		ctx = context.WithValue(ctx, stores.ContextKeyIsolationLevel, stores.IsolationRepeatableRead)
+	}
+
+	err := s.Store.(stores.TransactionalStore).Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.txs[txID] = &ssiTransaction{
+		id:      txID,
+		tracked: tracked,
+		begin:   s.clock,
+		reads:   make(map[string]struct{}),
+		writes:  make(map[string]struct{}),
+	}
+
+	return nil
+}
+
+// transaction returns the open transaction in the context. The caller must hold the lock.
+func (s *ssiStore) transaction(ctx context.Context) (*ssiTransaction, error) {
+	txID, _ := ctx.Value(stores.ContextKeyTransactionID).(int64)
+	tx, ok := s.txs[txID]
+	if !ok || tx.commit != 0 {
+		return nil, fmt.Errorf("ssi store has no open transaction %d", txID)
+	}
+
+	return tx, nil
+}
+
+// read records a key read by the transaction in the context.
+func (s *ssiStore) read(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.transaction(ctx)
+	if err != nil {
+		return err
+	}
+	if tx.tracked {
+		tx.reads[key] = struct{}{}
+	}
+
+	return nil
+}
+
+// readRange records a range scanned by the transaction in the context, so that writes of keys that
+// did not exist yet are seen as conflicts too.
+func (s *ssiStore) readRange(ctx context.Context, start, end string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.transaction(ctx)
+	if err != nil {
+		return err
+	}
+	if tx.tracked {
+		tx.ranges = append(tx.ranges, rangeLock{tx.id, start, end})
+	}
+
+	return nil
+}
+
+// write records a key written by the transaction in the context.
+func (s *ssiStore) write(ctx context.Context, key string) error {
+	if err := stores.CheckWritable(ctx, key); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.transaction(ctx)
+	if err != nil {
+		return err
+	}
+	if tx.tracked {
+		tx.writes[key] = struct{}{}
+	}
+
+	return nil
+}
+
+func (s *ssiStore) Get(ctx context.Context, key string) (string, error) {
+	if err := s.read(ctx, key); err != nil {
+		return "", err
+	}
+
+	return s.Store.Get(ctx, key)
+}
+
+func (s *ssiStore) Expiry(ctx context.Context, key string) (time.Time, error) {
+	if err := s.read(ctx, key); err != nil {
+		return time.Time{}, err
+	}
+
+	return s.Store.Expiry(ctx, key)
+}
+
+func (s *ssiStore) Keys(ctx context.Context) ([]string, error) {
+	if err := s.readRange(ctx, "", ""); err != nil {
+		return nil, err
+	}
+
+	return s.Store.Keys(ctx)
+}
+
+func (s *ssiStore) Scan(ctx context.Context, start, end string, limit int) (stores.Iterator, error) {
+	if err := s.readRange(ctx, start, end); err != nil {
+		return nil, err
+	}
+
+	return s.Store.Scan(ctx, start, end, limit)
+}
+
+func (s *ssiStore) Set(ctx context.Context, key, value string) error {
+	if err := s.write(ctx, key); err != nil {
+		return err
+	}
+
+	return s.Store.Set(ctx, key, value)
+}
+
+func (s *ssiStore) Delete(ctx context.Context, key string) error {
+	if err := s.write(ctx, key); err != nil {
+		return err
+	}
+
+	return s.Store.Delete(ctx, key)
+}
+
+// Expire is both a read and a write, as it fails for a key that does not exist.
+func (s *ssiStore) Expire(ctx context.Context, key string, at time.Time) error {
+	if err := s.read(ctx, key); err != nil {
+		return err
+	}
+	if err := s.write(ctx, key); err != nil {
+		return err
+	}
+
+	return s.Store.Expire(ctx, key, at)
+}
+
+// readsKey reports whether a transaction read a key, directly or in a range.
+func (tx *ssiTransaction) readsKey(key string) bool {
+	if _, ok := tx.reads[key]; ok {
+		return true
+	}
+	for _, r := range tx.ranges {
+		if stores.InRange(key, r.start, r.end) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readsAny reports whether a transaction read any of a set of keys.
+func (tx *ssiTransaction) readsAny(keys map[string]struct{}) bool {
+	for key := range keys {
+		if tx.readsKey(key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// concurrent reports whether two transactions overlapped, so that neither saw the other's writes.
+func (tx *ssiTransaction) concurrent(other *ssiTransaction) bool {
+	return (tx.commit == 0 || tx.commit > other.begin) && (other.commit == 0 || other.commit > tx.begin)
+}
+
+// Commit checks the rw-antidependencies the transaction forms with concurrent transactions, and
+// commits it to the snapshot store unless it would complete a pivot.
+func (s *ssiStore) Commit(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.transaction(ctx)
+	if err != nil {
+		return err
+	}
+	if !tx.tracked {
+		return s.Store.(stores.TransactionalStore).Commit(ctx)
+	}
+
+	// readers have a rw-antidependency on tx, and tx on writers. Neither is flagged until tx can commit.
+	var readers, writers []*ssiTransaction
+	for _, other := range s.others(tx) {
+		if len(tx.writes) > 0 && other.readsAny(tx.writes) {
+			readers = append(readers, other)
+		}
+		if other.commit != 0 && tx.readsAny(other.writes) {
+			writers = append(writers, other)
+		}
+	}
+
+	in, out := tx.in || len(readers) > 0, tx.out || len(writers) > 0
+	if in && out {
+		return s.fail(tx, tx)
+	}
+	// A committed pivot can no longer be aborted, so the transaction completing it is.
+	for _, r := range readers {
+		if r.commit != 0 && r.in {
+			return s.fail(tx, r)
+		}
+	}
+	for _, w := range writers {
+		if w.commit != 0 && w.out {
+			return s.fail(tx, w)
+		}
+	}
+
+	err = s.Store.(stores.TransactionalStore).Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.clock++
+	tx.commit = s.clock
+	tx.in, tx.out = in, out
+	for _, r := range readers {
+		r.out = true
+	}
+	for _, w := range writers {
+		w.in = true
+	}
+	s.committed = append(s.committed, tx)
+
+	return nil
+}
+
+// others returns the open and committed transactions that are concurrent with a transaction.
+// The caller must hold the lock.
+func (s *ssiStore) others(tx *ssiTransaction) []*ssiTransaction {
+	var others []*ssiTransaction
+	for _, other := range s.txs {
+		if other != tx && other.commit == 0 {
+			others = append(others, other)
+		}
+	}
+	for _, other := range s.committed {
+		if tx.concurrent(other) {
+			others = append(others, other)
+		}
+	}
+
+	return others
+}
+
+// fail refuses to commit a transaction that would complete a pivot.
+func (s *ssiStore) fail(tx, pivot *ssiTransaction) error {
+	logrus.WithField("txID", tx.id).Infof("Serialization failure with transaction %d as the pivot", pivot.id)
+	if pivot == tx {
+		return fmt.Errorf("%w: transaction %d would have rw-antidependencies both into and out of it", ErrSerializationFailure, tx.id)
+	}
+
+	return fmt.Errorf("%w: transaction %d would give the committed transaction %d rw-antidependencies both into and out of it", ErrSerializationFailure, tx.id, pivot.id)
+}
+
+// Savepoint passes a savepoint on to the snapshot store. The reads and writes since are still
+// counted after rolling back to it.
+func (s *ssiStore) Savepoint(ctx context.Context) (int, error) {
+	return s.Store.(stores.SavepointStore).Savepoint(ctx)
+}
+
+func (s *ssiStore) RollbackTo(ctx context.Context, savepoint int) error {
+	return s.Store.(stores.SavepointStore).RollbackTo(ctx, savepoint)
+}
+
+// Release ends a transaction, forgetting the committed transactions no open transaction is concurrent with.
+func (s *ssiStore) Release(ctx context.Context) {
+	s.Store.Release(ctx)
+
+	txID, _ := ctx.Value(stores.ContextKeyTransactionID).(int64)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.txs, txID)
+
+	oldest := s.clock
+	for _, tx := range s.txs {
+		if tx.begin < oldest {
+			oldest = tx.begin
+		}
+	}
+	committed := s.committed[:0]
+	for _, tx := range s.committed {
+		if tx.commit > oldest {
+			committed = append(committed, tx)
+		}
+	}
+	s.committed = committed
+}
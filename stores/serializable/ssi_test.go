@@ -0,0 +1,294 @@
+package serializable
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/christianalexander/kvdb/stores"
+	"github.com/christianalexander/kvdb/stores/snapshot"
+)
+
+func txContext(txID int64) context.Context {
+	return context.WithValue(context.Background(), stores.ContextKeyTransactionID, txID)
+}
+
+// newSSIStore returns an SSI store holding values, committed by transaction 1.
+func newSSIStore(t *testing.T, values map[string]string) stores.Store {
+	t.Helper()
+
+	s := NewSSIStore(stores.NewInMemoryStore())
+	ctx := txContext(1)
+	begin(t, s, ctx)
+	for k, v := range values {
+		if err := s.Set(ctx, k, v); err != nil {
+			t.Fatalf("set %s: %v", k, err)
+		}
+	}
+	if err := commit(s, ctx); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	return s
+}
+
+func begin(t *testing.T, s stores.Store, ctx context.Context) {
+	t.Helper()
+
+	if err := s.(stores.TransactionalStore).Begin(ctx); err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+}
+
+// commit commits and releases a transaction.
+func commit(s stores.Store, ctx context.Context) error {
+	defer s.Release(ctx)
+
+	return s.(stores.TransactionalStore).Commit(ctx)
+}
+
+func get(t *testing.T, s stores.Store, ctx context.Context, key string) string {
+	t.Helper()
+
+	v, err := s.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("get %s: %v", key, err)
+	}
+
+	return v
+}
+
+func set(t *testing.T, s stores.Store, ctx context.Context, key, value string) {
+	t.Helper()
+
+	if err := s.Set(ctx, key, value); err != nil {
+		t.Fatalf("set %s: %v", key, err)
+	}
+}
+
+func TestSSIWriteSkew(t *testing.T) {
+	s := newSSIStore(t, map[string]string{"alice": "on-call", "bob": "on-call"})
+	alice, bob := txContext(2), txContext(3)
+	begin(t, s, alice)
+	begin(t, s, bob)
+
+	// Each sees the other on call, and goes off call.
+	get(t, s, alice, "alice")
+	get(t, s, alice, "bob")
+	get(t, s, bob, "alice")
+	get(t, s, bob, "bob")
+	set(t, s, alice, "alice", "off")
+	set(t, s, bob, "bob", "off")
+
+	if err := commit(s, alice); err != nil {
+		t.Fatalf("first commit: %v", err)
+	}
+	if err := commit(s, bob); !errors.Is(err, ErrSerializationFailure) {
+		t.Fatalf("second commit: got %v, want %v", err, ErrSerializationFailure)
+	}
+
+	ctx := txContext(4)
+	begin(t, s, ctx)
+	if v := get(t, s, ctx, "bob"); v != "on-call" {
+		t.Errorf("bob is %s after the failed commit, want on-call", v)
+	}
+	commit(s, ctx)
+}
+
+func TestSSILostUpdate(t *testing.T) {
+	s := newSSIStore(t, map[string]string{"counter": "0"})
+	a, b := txContext(2), txContext(3)
+	begin(t, s, a)
+	begin(t, s, b)
+
+	get(t, s, a, "counter")
+	get(t, s, b, "counter")
+	set(t, s, a, "counter", "1")
+	set(t, s, b, "counter", "1")
+
+	if err := commit(s, a); err != nil {
+		t.Fatalf("first commit: %v", err)
+	}
+	if err := commit(s, b); !errors.Is(err, ErrSerializationFailure) {
+		t.Fatalf("second commit: got %v, want %v", err, ErrSerializationFailure)
+	}
+}
+
+func TestSSIReadSkew(t *testing.T) {
+	s := newSSIStore(t, map[string]string{"x": "50", "y": "50"})
+	reader, transfer := txContext(2), txContext(3)
+	begin(t, s, reader)
+	begin(t, s, transfer)
+
+	x := get(t, s, reader, "x")
+
+	get(t, s, transfer, "x")
+	get(t, s, transfer, "y")
+	set(t, s, transfer, "x", "40")
+	set(t, s, transfer, "y", "60")
+	if err := commit(s, transfer); err != nil {
+		t.Fatalf("transfer commit: %v", err)
+	}
+
+	// The reader still sees the snapshot from before the transfer, so it is ordered first.
+	y := get(t, s, reader, "y")
+	if x != "50" || y != "50" {
+		t.Errorf("reader saw x=%s y=%s, want both 50", x, y)
+	}
+	set(t, s, reader, "total", "100")
+	if err := commit(s, reader); err != nil {
+		t.Fatalf("reader commit: %v", err)
+	}
+}
+
+func TestSSIReadOnlyAnomaly(t *testing.T) {
+	s := newSSIStore(t, map[string]string{"batch": "1", "receipts": "0"})
+	pivot, closing, report := txContext(2), txContext(3), txContext(4)
+
+	// The pivot adds a receipt to the current batch, which is closed before it commits.
+	begin(t, s, pivot)
+	get(t, s, pivot, "batch")
+	get(t, s, pivot, "receipts")
+
+	begin(t, s, closing)
+	get(t, s, closing, "batch")
+	set(t, s, closing, "batch", "2")
+	if err := commit(s, closing); err != nil {
+		t.Fatalf("close commit: %v", err)
+	}
+
+	// The report sees batch 1 closed without the pivot's receipt, so the pivot must not commit.
+	begin(t, s, report)
+	get(t, s, report, "batch")
+	get(t, s, report, "receipts")
+	if err := commit(s, report); err != nil {
+		t.Fatalf("report commit: %v", err)
+	}
+
+	set(t, s, pivot, "receipts", "1")
+	if err := commit(s, pivot); !errors.Is(err, ErrSerializationFailure) {
+		t.Fatalf("pivot commit: got %v, want %v", err, ErrSerializationFailure)
+	}
+}
+
+func TestSSIPhantom(t *testing.T) {
+	s := newSSIStore(t, map[string]string{"shift/alice": "on-call"})
+	a, b := txContext(2), txContext(3)
+	begin(t, s, a)
+	begin(t, s, b)
+
+	// Each checks that only one doctor is on call, and adds another.
+	for _, ctx := range []context.Context{a, b} {
+		it, err := s.Scan(ctx, "shift/", "shift0", 0)
+		if err != nil {
+			t.Fatalf("scan: %v", err)
+		}
+		it.Close()
+	}
+	set(t, s, a, "shift/bob", "on-call")
+	set(t, s, b, "shift/carol", "on-call")
+
+	if err := commit(s, a); err != nil {
+		t.Fatalf("first commit: %v", err)
+	}
+	if err := commit(s, b); !errors.Is(err, ErrSerializationFailure) {
+		t.Fatalf("second commit: got %v, want %v", err, ErrSerializationFailure)
+	}
+}
+
+func TestSSISerializableHistory(t *testing.T) {
+	s := newSSIStore(t, map[string]string{"x": "1", "y": "1"})
+	a, b, c := txContext(2), txContext(3), txContext(4)
+	begin(t, s, a)
+	begin(t, s, b)
+	begin(t, s, c)
+
+	// a did not see b's write, so it comes first, even though b commits first. c is independent.
+	get(t, s, a, "x")
+	set(t, s, a, "a", "done")
+	get(t, s, b, "y")
+	set(t, s, b, "x", "2")
+	set(t, s, c, "z", "2")
+
+	for i, ctx := range []context.Context{b, c, a} {
+		if err := commit(s, ctx); err != nil {
+			t.Fatalf("commit %d: %v", i, err)
+		}
+	}
+}
+
+func TestSSIWeakerIsolationIsNotChecked(t *testing.T) {
+	s := newSSIStore(t, map[string]string{"alice": "on-call", "bob": "on-call"})
+	alice := context.WithValue(txContext(2), stores.ContextKeyIsolationLevel, stores.IsolationRepeatableRead)
+	bob := context.WithValue(txContext(3), stores.ContextKeyIsolationLevel, stores.IsolationRepeatableRead)
+	begin(t, s, alice)
+	begin(t, s, bob)
+
+	get(t, s, alice, "bob")
+	get(t, s, bob, "alice")
+	set(t, s, alice, "alice", "off")
+	set(t, s, bob, "bob", "off")
+
+	if err := commit(s, alice); err != nil {
+		t.Fatalf("first commit: %v", err)
+	}
+	if err := commit(s, bob); err != nil {
+		t.Fatalf("second commit: %v", err)
+	}
+}
+
+func TestSSIConcurrentIncrements(t *testing.T) {
+	s := newSSIStore(t, map[string]string{"counter": "0"})
+
+	const workers, increments = 8, 20
+	var mu sync.Mutex
+	nextID := int64(100)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for done := 0; done < increments; {
+				mu.Lock()
+				nextID++
+				ctx := txContext(nextID)
+				mu.Unlock()
+
+				if err := s.(stores.TransactionalStore).Begin(ctx); err != nil {
+					t.Errorf("begin: %v", err)
+					return
+				}
+				v, err := s.Get(ctx, "counter")
+				if err == nil {
+					n, _ := strconv.Atoi(v)
+					err = s.Set(ctx, "counter", strconv.Itoa(n+1))
+				}
+				if err == nil {
+					err = commit(s, ctx)
+				} else {
+					s.Release(ctx)
+				}
+
+				switch {
+				case err == nil:
+					done++
+				case errors.Is(err, ErrSerializationFailure), errors.Is(err, snapshot.ErrWriteConflict):
+				default:
+					t.Errorf("increment: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	ctx := txContext(1000)
+	begin(t, s, ctx)
+	if v := get(t, s, ctx, "counter"); v != strconv.Itoa(workers*increments) {
+		t.Errorf("counter is %s, want %d", v, workers*increments)
+	}
+	commit(s, ctx)
+}
@@ -3,25 +3,65 @@ package serializable
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/christianalexander/kvdb/stores"
 )
 
 // twoPhaseLockStore implements two-phase locking for serializable isolation.
+// Read-only transactions take no locks, and read a snapshot from the before-images of writers instead.
 type twoPhaseLockStore struct {
 	stores.Store
-	lm lockerMap
+	lm     lockerMap
+	images *beforeImages
+}
+
+// transactionalTwoPhaseLockStore is a twoPhaseLockStore over a store that takes part in transactions.
+type transactionalTwoPhaseLockStore struct {
+	*twoPhaseLockStore
+}
+
+// Options configures a two-phase lock store.
+type Options struct {
+	// LockTimeout is how long a lock is waited for before ErrLockTimeout is returned, unless the
+	// context has a stores.ContextKeyLockTimeout. Zero waits for as long as the context lasts.
+	LockTimeout time.Duration
+	// Policy decides what a transaction does when a lock it asks for is held. It defaults to PolicyDetect.
+	Policy Policy
+	// OnWound is called, on a goroutine of its own, when a transaction that is not waiting for a
+	// lock is wounded under PolicyWoundWait. It should roll the transaction back, so that the older
+	// transaction can have its locks. Until then, any lock the wounded transaction asks for fails
+	// with ErrWounded.
+	OnWound func(txID int64, err error)
 }
 
 // NewTwoPhaseLockStore returns a store with two-phase locking for serializable isolation.
-func NewTwoPhaseLockStore(store stores.Store) stores.Store {
-	return &twoPhaseLockStore{
+// If store is a stores.TransactionalStore, such as one that defers writes, so is the returned store.
+func NewTwoPhaseLockStore(store stores.Store, options Options) stores.Store {
+	if options.Policy == "" {
+		options.Policy = PolicyDetect
+	}
+
+	ts := &twoPhaseLockStore{
 		Store: store,
 		lm: lockerMap{
-			lockers: make(map[string]*keyLocker),
-			keys:    make(map[int64][]string),
+			lockers:       make(map[string]*keyLocker),
+			keys:          make(map[int64][]string),
+			lockTimeout:   options.LockTimeout,
+			policy:        options.Policy,
+			onWound:       options.OnWound,
+			waits:         make(map[int64]*wait),
+			wounded:       make(map[int64]error),
+			writeKeys:     make(map[int64]map[string]struct{}),
+			rangesChanged: make(chan struct{}),
 		},
+		images: newBeforeImages(),
+	}
+	if _, ok := store.(stores.TransactionalStore); ok {
+		return transactionalTwoPhaseLockStore{ts}
 	}
+
+	return ts
 }
 
 func (ts *twoPhaseLockStore) Set(ctx context.Context, key, value string) error {
@@ -29,11 +69,15 @@ func (ts *twoPhaseLockStore) Set(ctx context.Context, key, value string) error {
 	if !ok || txID == 0 {
 		return fmt.Errorf("two phase lock store could not set without a transaction ID")
 	}
+	if err := stores.CheckWritable(ctx, key); err != nil {
+		return err
+	}
 
 	err := ts.lm.Acquire(ctx, txID, key)
 	if err != nil {
 		return err
 	}
+	ts.record(ctx, txID, key)
 
 	err = ts.Store.Set(ctx, key, value)
 	if err != nil {
@@ -48,12 +92,20 @@ func (ts *twoPhaseLockStore) Get(ctx context.Context, key string) (string, error
 	if !ok || txID == 0 {
 		return "", fmt.Errorf("two phase lock store could not get without a transaction ID")
 	}
+	if readOnly(ctx) {
+		image, ok := ts.readSnapshot(ctx, txID, key)
+		if !ok {
+			return "", fmt.Errorf("value for key '%s' not found", key)
+		}
+		return image.value, nil
+	}
 
 	err := ts.lm.RAcquire(ctx, txID, key)
 	if err != nil {
 		return "", err
 	}
 	v, err := ts.Store.Get(ctx, key)
+	ts.releaseRead(ctx, txID, key)
 	if err != nil {
 		return "", err
 	}
@@ -61,16 +113,35 @@ func (ts *twoPhaseLockStore) Get(ctx context.Context, key string) (string, error
 	return v, nil
 }
 
+// isolation returns the isolation level of the transaction in a context. Locks are held as the
+// lock-based definitions of the levels require: reads under READ COMMITTED only wait for uncommitted
+// writes, and only SERIALIZABLE transactions lock the ranges they scan, which keeps out phantoms.
+func isolation(ctx context.Context) stores.IsolationLevel {
+	return stores.IsolationLevelFromContext(ctx, stores.IsolationSerializable)
+}
+
+// releaseRead gives up the shared lock on a key that was just read, if the transaction does not need
+// repeatable reads.
+func (ts *twoPhaseLockStore) releaseRead(ctx context.Context, txID int64, key string) {
+	if isolation(ctx) == stores.IsolationReadCommitted {
+		ts.lm.ReleaseRead(txID, key)
+	}
+}
+
 func (ts *twoPhaseLockStore) Delete(ctx context.Context, key string) error {
 	txID, ok := ctx.Value(stores.ContextKeyTransactionID).(int64)
 	if !ok || txID == 0 {
 		return fmt.Errorf("two phase lock store could not delete without a transaction ID")
 	}
+	if err := stores.CheckWritable(ctx, key); err != nil {
+		return err
+	}
 
 	err := ts.lm.Acquire(ctx, txID, key)
 	if err != nil {
 		return err
 	}
+	ts.record(ctx, txID, key)
 
 	err = ts.Store.Delete(ctx, key)
 	if err != nil {
@@ -85,8 +156,27 @@ func (ts *twoPhaseLockStore) Keys(ctx context.Context) ([]string, error) {
 	if !ok || txID == 0 {
 		return nil, fmt.Errorf("two phase lock store could not get keys without a transaction ID")
 	}
+	if readOnly(ctx) {
+		pairs, err := ts.scanSnapshot(ctx, txID, "", "", 0)
+		if err != nil {
+			return nil, err
+		}
+		keys := make([]string, len(pairs))
+		for i, p := range pairs {
+			keys[i] = p.Key
+		}
+		return keys, nil
+	}
+
+	// The whole keyspace is locked, so that no key can be added or removed until the transaction ends.
+	if isolation(ctx) == stores.IsolationSerializable {
+		err := ts.lm.AcquireRange(ctx, txID, "", "")
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	keys, err := ts.Keys(ctx)
+	keys, err := ts.Store.Keys(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -96,15 +186,144 @@ func (ts *twoPhaseLockStore) Keys(ctx context.Context) ([]string, error) {
 		if err != nil {
 			return nil, err
 		}
+		ts.releaseRead(ctx, txID, k)
 	}
 
 	return keys, nil
 }
 
+func (ts *twoPhaseLockStore) Scan(ctx context.Context, start, end string, limit int) (stores.Iterator, error) {
+	txID, ok := ctx.Value(stores.ContextKeyTransactionID).(int64)
+	if !ok || txID == 0 {
+		return nil, fmt.Errorf("two phase lock store could not scan without a transaction ID")
+	}
+	if readOnly(ctx) {
+		pairs, err := ts.scanSnapshot(ctx, txID, start, end, limit)
+		if err != nil {
+			return nil, err
+		}
+		return stores.NewIterator(pairs), nil
+	}
+
+	// The range is locked, so that no key can be added to or removed from it until the transaction ends.
+	if isolation(ctx) == stores.IsolationSerializable {
+		err := ts.lm.AcquireRange(ctx, txID, start, end)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	it, err := ts.Store.Scan(ctx, start, end, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	// Values are read again once the lock is held, as they may have changed since the scan.
+	var result []stores.KeyValue
+	for _, k := range keys {
+		err := ts.lm.RAcquire(ctx, txID, k)
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := ts.Store.Get(ctx, k)
+		ts.releaseRead(ctx, txID, k)
+		if err != nil {
+			continue
+		}
+		result = append(result, stores.KeyValue{Key: k, Value: v})
+	}
+
+	return stores.NewIterator(result), nil
+}
+
+func (ts *twoPhaseLockStore) Expire(ctx context.Context, key string, at time.Time) error {
+	txID, ok := ctx.Value(stores.ContextKeyTransactionID).(int64)
+	if !ok || txID == 0 {
+		return fmt.Errorf("two phase lock store could not expire without a transaction ID")
+	}
+	if err := stores.CheckWritable(ctx, key); err != nil {
+		return err
+	}
+
+	err := ts.lm.Acquire(ctx, txID, key)
+	if err != nil {
+		return err
+	}
+	ts.record(ctx, txID, key)
+
+	return ts.Store.Expire(ctx, key, at)
+}
+
+func (ts *twoPhaseLockStore) Expiry(ctx context.Context, key string) (time.Time, error) {
+	txID, ok := ctx.Value(stores.ContextKeyTransactionID).(int64)
+	if !ok || txID == 0 {
+		return time.Time{}, fmt.Errorf("two phase lock store could not get expiry without a transaction ID")
+	}
+	if readOnly(ctx) {
+		image, ok := ts.readSnapshot(ctx, txID, key)
+		if !ok {
+			return time.Time{}, fmt.Errorf("value for key '%s' not found", key)
+		}
+		return image.expiresAt, nil
+	}
+
+	err := ts.lm.RAcquire(ctx, txID, key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer ts.releaseRead(ctx, txID, key)
+
+	return ts.Store.Expiry(ctx, key)
+}
+
+func (ts transactionalTwoPhaseLockStore) Begin(ctx context.Context) error {
+	return ts.Store.(stores.TransactionalStore).Begin(ctx)
+}
+
+// Commit passes a commit on to the wrapped store while the locks are still held, so deferred
+// writes are applied before any other transaction can see the keys.
+func (ts transactionalTwoPhaseLockStore) Commit(ctx context.Context) error {
+	return ts.Store.(stores.TransactionalStore).Commit(ctx)
+}
+
+// Savepoint passes a savepoint on to the wrapped store. Locks are not affected by savepoints.
+func (ts transactionalTwoPhaseLockStore) Savepoint(ctx context.Context) (int, error) {
+	inner, ok := ts.Store.(stores.SavepointStore)
+	if !ok {
+		return 0, fmt.Errorf("store does not support savepoints")
+	}
+
+	return inner.Savepoint(ctx)
+}
+
+// RollbackTo passes a rollback to a savepoint on to the wrapped store. The transaction keeps
+// every lock it holds, including those taken since the savepoint.
+func (ts transactionalTwoPhaseLockStore) RollbackTo(ctx context.Context, savepoint int) error {
+	inner, ok := ts.Store.(stores.SavepointStore)
+	if !ok {
+		return fmt.Errorf("store does not support savepoints")
+	}
+
+	return inner.RollbackTo(ctx, savepoint)
+}
+
 func (ts *twoPhaseLockStore) Release(ctx context.Context) {
+	ts.Store.Release(ctx)
+
 	txID, ok := ctx.Value(stores.ContextKeyTransactionID).(int64)
 	if !ok || txID == 0 {
 		return
 	}
+	ts.images.release(txID)
 	ts.lm.Release(txID)
 }
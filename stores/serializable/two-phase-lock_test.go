@@ -0,0 +1,99 @@
+package serializable
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/christianalexander/kvdb/stores"
+)
+
+// levelContext returns the context of a transaction at an isolation level, which gives up on locks quickly.
+func levelContext(txID int64, level stores.IsolationLevel) context.Context {
+	ctx := context.WithValue(txContext(txID), stores.ContextKeyLockTimeout, 50*time.Millisecond)
+	if level != "" {
+		ctx = context.WithValue(ctx, stores.ContextKeyIsolationLevel, level)
+	}
+
+	return ctx
+}
+
+// newTwoPhaseLockStore returns a two-phase lock store holding values, written by transaction 1.
+func newTwoPhaseLockStore(t *testing.T, values map[string]string) stores.Store {
+	t.Helper()
+
+	s := NewTwoPhaseLockStore(stores.NewInMemoryStore(), Options{})
+	ctx := txContext(1)
+	for k, v := range values {
+		set(t, s, ctx, k, v)
+	}
+	s.Release(ctx)
+
+	return s
+}
+
+func TestTwoPhaseLockReadCommitted(t *testing.T) {
+	s := newTwoPhaseLockStore(t, map[string]string{"x": "1"})
+	reader, writer := levelContext(2, stores.IsolationReadCommitted), levelContext(3, "")
+
+	if v := get(t, s, reader, "x"); v != "1" {
+		t.Fatalf("first read: got %s, want 1", v)
+	}
+
+	// The read lock was given up, so the writer does not wait for the reader to end.
+	set(t, s, writer, "x", "2")
+
+	// An uncommitted write is waited for, rather than read.
+	if _, err := s.Get(reader, "x"); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("read of an uncommitted write: got %v, want %v", err, ErrLockTimeout)
+	}
+
+	s.Release(writer)
+	if v := get(t, s, reader, "x"); v != "2" {
+		t.Errorf("read after the commit: got %s, want 2", v)
+	}
+	s.Release(reader)
+}
+
+func TestTwoPhaseLockRepeatableRead(t *testing.T) {
+	s := newTwoPhaseLockStore(t, map[string]string{"x": "1"})
+	reader, writer := levelContext(2, stores.IsolationRepeatableRead), levelContext(3, "")
+
+	get(t, s, reader, "x")
+	if err := s.Set(writer, "x", "2"); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("write of a key that was read: got %v, want %v", err, ErrLockTimeout)
+	}
+
+	// No range is locked, so a key can be added to a listing the reader made.
+	if _, err := s.Keys(reader); err != nil {
+		t.Fatalf("keys: %v", err)
+	}
+	set(t, s, writer, "y", "1")
+	s.Release(writer)
+
+	keys, err := s.Keys(reader)
+	if err != nil {
+		t.Fatalf("keys: %v", err)
+	}
+	if len(keys) != 2 {
+		t.Errorf("keys after the insert: got %v, want the phantom y too", keys)
+	}
+	s.Release(reader)
+}
+
+func TestTwoPhaseLockSerializable(t *testing.T) {
+	for _, level := range []stores.IsolationLevel{"", stores.IsolationSerializable} {
+		s := newTwoPhaseLockStore(t, map[string]string{"x": "1"})
+		reader, writer := levelContext(2, level), levelContext(3, "")
+
+		if _, err := s.Keys(reader); err != nil {
+			t.Fatalf("keys: %v", err)
+		}
+		if err := s.Set(writer, "y", "1"); !errors.Is(err, ErrLockTimeout) {
+			t.Errorf("insert into a listed range at level '%s': got %v, want %v", level, err, ErrLockTimeout)
+		}
+		s.Release(writer)
+		s.Release(reader)
+	}
+}
@@ -0,0 +1,142 @@
+package skiplist
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	maxLevel    = 24
+	probability = 0.25
+)
+
+// A List is an ordered map from string keys to values, implemented as a skip list.
+// It is not safe for concurrent use; callers are expected to provide their own locking.
+type List struct {
+	head   *Element
+	level  int
+	length int
+	rand   *rand.Rand
+}
+
+// An Element is an entry in a List.
+type Element struct {
+	Key   string
+	Value interface{}
+
+	next []*Element
+}
+
+// New creates an empty List.
+func New() *List {
+	return &List{
+		head:  &Element{next: make([]*Element, maxLevel)},
+		level: 1,
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Next returns the element following e, or nil at the end of the list.
+func (e *Element) Next() *Element {
+	return e.next[0]
+}
+
+// Len returns the number of elements in the list.
+func (l *List) Len() int {
+	return l.length
+}
+
+// Front returns the element with the smallest key, or nil if the list is empty.
+func (l *List) Front() *Element {
+	return l.head.next[0]
+}
+
+// Seek returns the first element with a key greater than or equal to key, or nil if there is none.
+func (l *List) Seek(key string) *Element {
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].Key < key {
+			x = x.next[i]
+		}
+	}
+
+	return x.next[0]
+}
+
+// Get returns the value stored for key.
+func (l *List) Get(key string) (interface{}, bool) {
+	e := l.Seek(key)
+	if e == nil || e.Key != key {
+		return nil, false
+	}
+
+	return e.Value, true
+}
+
+// Set stores value for key, replacing any existing value.
+func (l *List) Set(key string, value interface{}) {
+	var update [maxLevel]*Element
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].Key < key {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+
+	if n := x.next[0]; n != nil && n.Key == key {
+		n.Value = value
+		return
+	}
+
+	level := l.randomLevel()
+	if level > l.level {
+		for i := l.level; i < level; i++ {
+			update[i] = l.head
+		}
+		l.level = level
+	}
+
+	e := &Element{Key: key, Value: value, next: make([]*Element, level)}
+	for i := 0; i < level; i++ {
+		e.next[i] = update[i].next[i]
+		update[i].next[i] = e
+	}
+	l.length++
+}
+
+// Delete removes key from the list, reporting whether it was present.
+func (l *List) Delete(key string) bool {
+	var update [maxLevel]*Element
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].Key < key {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+
+	e := x.next[0]
+	if e == nil || e.Key != key {
+		return false
+	}
+
+	for i := 0; i < len(e.next); i++ {
+		update[i].next[i] = e.next[i]
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+	l.length--
+
+	return true
+}
+
+func (l *List) randomLevel() int {
+	level := 1
+	for level < maxLevel && l.rand.Float64() < probability {
+		level++
+	}
+
+	return level
+}
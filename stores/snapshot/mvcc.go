@@ -0,0 +1,482 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/christianalexander/kvdb/stores"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrWriteConflict is returned by Commit when another transaction committed a write
+// to the same key after the committing transaction took its snapshot.
+var ErrWriteConflict = errors.New("could not serialize access due to a concurrent update")
+
+// mvccStore implements snapshot isolation with multi-version concurrency control.
+//
+// Every committed write becomes a version stamped with the committing transaction and a
+// commit timestamp. A transaction reads the newest versions committed before its snapshot
+// was taken, and keeps its own writes in a private buffer until Commit, so readers and
+// writers never block each other. The inner store always holds the latest committed state.
+//
+// Transactions begun at READ COMMITTED read the newest committed versions instead, and are not
+// checked for write conflicts. SERIALIZABLE transactions are refused, as snapshot isolation
+// allows write skew.
+type mvccStore struct {
+	inner stores.Store
+
+	mu    sync.RWMutex
+	clock uint64
+
+	// versions holds the version chain, oldest first, for keys written since startup.
+	// Keys without a chain have only ever had the value held by the inner store.
+	versions map[string][]version
+	txs      map[int64]*transaction
+}
+
+type version struct {
+	txID      int64
+	commitTS  uint64
+	value     string
+	expiresAt time.Time
+	deleted   bool
+}
+
+func (v version) visible(now time.Time) bool {
+	return !v.deleted && (v.expiresAt.IsZero() || now.Before(v.expiresAt))
+}
+
+type transaction struct {
+	snapshot uint64
+	// readCommitted is set when the transaction reads the newest committed versions, rather than its snapshot.
+	readCommitted bool
+	writes        map[string]version
+	// savepoints holds copies of writes, oldest first.
+	savepoints []map[string]version
+}
+
+// NewStore returns a store that gives each transaction snapshot isolation.
+// The returned store is a stores.TransactionalStore, and commits its writes to store.
+func NewStore(store stores.Store) stores.Store {
+	return &mvccStore{
+		inner:    store,
+		versions: make(map[string][]version),
+		txs:      make(map[int64]*transaction),
+	}
+}
+
+func txIDFromContext(ctx context.Context) int64 {
+	txID, _ := ctx.Value(stores.ContextKeyTransactionID).(int64)
+	return txID
+}
+
+func (s *mvccStore) Begin(ctx context.Context) error {
+	txID := txIDFromContext(ctx)
+	if txID == 0 {
+		return fmt.Errorf("snapshot store could not begin without a transaction ID")
+	}
+
+	level := stores.IsolationLevelFromContext(ctx, stores.IsolationRepeatableRead)
+	if level == stores.IsolationSerializable {
+		return fmt.Errorf("snapshot store can not run %s transactions, only %s and %s", level, stores.IsolationReadCommitted, stores.IsolationRepeatableRead)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := s.begin(txID)
+	tx.readCommitted = level == stores.IsolationReadCommitted
+
+	return nil
+}
+
+// begin takes a snapshot for a transaction. The caller must hold the write lock.
+func (s *mvccStore) begin(txID int64) *transaction {
+	tx, ok := s.txs[txID]
+	if !ok {
+		tx = &transaction{
+			snapshot: s.clock,
+			writes:   make(map[string]version),
+		}
+		s.txs[txID] = tx
+		logrus.WithField("txID", txID).Debugf("Snapshot taken at %d", tx.snapshot)
+	}
+
+	return tx
+}
+
+// transaction returns the state of the transaction in the context, beginning it if needed.
+func (s *mvccStore) transaction(ctx context.Context) (*transaction, error) {
+	txID := txIDFromContext(ctx)
+	if txID == 0 {
+		return nil, fmt.Errorf("snapshot store could not write without a transaction ID")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.begin(txID), nil
+}
+
+// read returns the version of a key seen by a transaction, which is nil outside of a transaction.
+// The caller must hold the lock.
+func (s *mvccStore) read(ctx context.Context, tx *transaction, key string) (version, bool) {
+	if tx != nil {
+		if v, ok := tx.writes[key]; ok {
+			return v, true
+		}
+	}
+
+	chain := s.versions[key]
+	if len(chain) == 0 {
+		value, err := s.inner.Get(ctx, key)
+		if err != nil {
+			return version{}, false
+		}
+		expiresAt, _ := s.inner.Expiry(ctx, key)
+
+		return version{value: value, expiresAt: expiresAt}, true
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		if tx == nil || tx.readCommitted || chain[i].commitTS <= tx.snapshot {
+			return chain[i], true
+		}
+	}
+
+	return version{}, false
+}
+
+// get returns the live value of a key as seen from the context.
+func (s *mvccStore) get(ctx context.Context, key string) (version, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	v, ok := s.read(ctx, s.txs[txIDFromContext(ctx)], key)
+	if !ok || !v.visible(time.Now()) {
+		return version{}, false
+	}
+
+	return v, true
+}
+
+func (s *mvccStore) Get(ctx context.Context, key string) (string, error) {
+	v, ok := s.get(ctx, key)
+	if !ok {
+		return "", fmt.Errorf("value for key '%s' not found", key)
+	}
+
+	return v.value, nil
+}
+
+func (s *mvccStore) Expiry(ctx context.Context, key string) (time.Time, error) {
+	v, ok := s.get(ctx, key)
+	if !ok {
+		return time.Time{}, fmt.Errorf("value for key '%s' not found", key)
+	}
+
+	return v.expiresAt, nil
+}
+
+func (s *mvccStore) Set(ctx context.Context, key, value string) error {
+	if err := stores.CheckWritable(ctx, key); err != nil {
+		return err
+	}
+
+	tx, err := s.transaction(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	tx.writes[key] = version{value: value}
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *mvccStore) Delete(ctx context.Context, key string) error {
+	if err := stores.CheckWritable(ctx, key); err != nil {
+		return err
+	}
+
+	tx, err := s.transaction(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	tx.writes[key] = version{deleted: true}
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *mvccStore) Expire(ctx context.Context, key string, at time.Time) error {
+	if err := stores.CheckWritable(ctx, key); err != nil {
+		return err
+	}
+
+	tx, err := s.transaction(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.read(ctx, tx, key)
+	if !ok || !v.visible(time.Now()) {
+		return fmt.Errorf("value for key '%s' not found", key)
+	}
+
+	v.expiresAt = at
+	tx.writes[key] = v
+
+	return nil
+}
+
+func (s *mvccStore) Keys(ctx context.Context) ([]string, error) {
+	it, err := s.Scan(ctx, "", "", 0)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+
+	return keys, it.Err()
+}
+
+func (s *mvccStore) Scan(ctx context.Context, start, end string, limit int) (stores.Iterator, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tx := s.txs[txIDFromContext(ctx)]
+
+	// Candidates are the keys committed now, plus any with versions or buffered writes,
+	// which covers keys that were deleted after the snapshot was taken.
+	candidates := make(map[string]struct{})
+	it, err := s.inner.Scan(ctx, start, end, 0)
+	if err != nil {
+		return nil, err
+	}
+	for it.Next() {
+		candidates[it.Key()] = struct{}{}
+	}
+	it.Close()
+	for k := range s.versions {
+		if stores.InRange(k, start, end) {
+			candidates[k] = struct{}{}
+		}
+	}
+	if tx != nil {
+		for k := range tx.writes {
+			if stores.InRange(k, start, end) {
+				candidates[k] = struct{}{}
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(candidates))
+	for k := range candidates {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	now := time.Now()
+	var result []stores.KeyValue
+	for _, k := range keys {
+		if limit > 0 && len(result) == limit {
+			break
+		}
+
+		v, ok := s.read(ctx, tx, k)
+		if !ok || !v.visible(now) {
+			continue
+		}
+		result = append(result, stores.KeyValue{Key: k, Value: v.value})
+	}
+
+	return stores.NewIterator(result), nil
+}
+
+// Commit checks the transaction for write-write conflicts, then applies its writes to the inner
+// store and installs them as new versions with one commit timestamp. If the inner store fails a
+// write, the writes already applied are undone and no version is installed, so that no snapshot
+// sees part of the transaction.
+func (s *mvccStore) Commit(ctx context.Context) error {
+	txID := txIDFromContext(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, ok := s.txs[txID]
+	if !ok || len(tx.writes) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(tx.writes))
+	for k := range tx.writes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		chain := s.versions[k]
+		if !tx.readCommitted && len(chain) != 0 && chain[len(chain)-1].commitTS > tx.snapshot {
+			return fmt.Errorf("%w: key '%s' was changed by transaction %d", ErrWriteConflict, k, chain[len(chain)-1].txID)
+		}
+	}
+
+	commitTS := s.clock + 1
+
+	// bases holds the latest committed version of each key, from before this commit.
+	bases := make([]version, 0, len(keys))
+	for i, k := range keys {
+		base, ok := s.read(ctx, nil, k)
+		if !ok {
+			base = version{deleted: true}
+		}
+		bases = append(bases, base)
+
+		err := s.apply(ctx, k, tx.writes[k])
+		if err != nil {
+			// The failed write may have set the value before failing to set its expiry, so it is undone too.
+			s.undo(ctx, keys[:i+1], bases)
+			return fmt.Errorf("failed to apply committed write for key '%s': %v", k, err)
+		}
+	}
+
+	for i, k := range keys {
+		chain := s.versions[k]
+		if len(chain) == 0 {
+			// Preserve the value from before this commit for snapshots that are still open.
+			chain = append(chain, bases[i])
+		}
+
+		v := tx.writes[k]
+		v.txID = txID
+		v.commitTS = commitTS
+		s.versions[k] = append(chain, v)
+	}
+	s.clock = commitTS
+
+	tx.writes = make(map[string]version)
+	logrus.WithField("txID", txID).Debugf("Committed at %d", commitTS)
+
+	return nil
+}
+
+// undo puts back the versions keys had in the inner store before a commit failed, newest write first.
+func (s *mvccStore) undo(ctx context.Context, keys []string, bases []version) {
+	for i := len(keys) - 1; i >= 0; i-- {
+		err := s.apply(ctx, keys[i], bases[i])
+		if err != nil {
+			logrus.Errorf("Failed to undo write for key '%s' of a failed commit: %v", keys[i], err)
+		}
+	}
+}
+
+// apply writes a committed version to the inner store.
+func (s *mvccStore) apply(ctx context.Context, key string, v version) error {
+	if v.deleted {
+		return s.inner.Delete(ctx, key)
+	}
+
+	err := s.inner.Set(ctx, key, v.value)
+	if err != nil || v.expiresAt.IsZero() {
+		return err
+	}
+
+	return s.inner.Expire(ctx, key, v.expiresAt)
+}
+
+// Savepoint keeps a copy of the writes buffered by the transaction in the context.
+func (s *mvccStore) Savepoint(ctx context.Context) (int, error) {
+	tx, err := s.transaction(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx.savepoints = append(tx.savepoints, copyWrites(tx.writes))
+
+	return len(tx.savepoints) - 1, nil
+}
+
+// RollbackTo restores the writes buffered by the transaction in the context from a savepoint.
+// The transaction keeps its snapshot.
+func (s *mvccStore) RollbackTo(ctx context.Context, savepoint int) error {
+	tx, err := s.transaction(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if savepoint < 0 || savepoint >= len(tx.savepoints) {
+		return fmt.Errorf("transaction %d has no savepoint %d", txIDFromContext(ctx), savepoint)
+	}
+
+	// The savepoint is kept, so that the transaction can roll back to it again.
+	tx.writes = copyWrites(tx.savepoints[savepoint])
+	tx.savepoints = tx.savepoints[:savepoint+1]
+
+	return nil
+}
+
+func copyWrites(writes map[string]version) map[string]version {
+	c := make(map[string]version, len(writes))
+	for k, v := range writes {
+		c[k] = v
+	}
+
+	return c
+}
+
+// Release discards the transaction's snapshot and any writes it did not commit.
+func (s *mvccStore) Release(ctx context.Context) {
+	txID := txIDFromContext(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.txs, txID)
+	s.prune()
+	s.inner.Release(ctx)
+}
+
+// prune drops versions that no open snapshot can see. The caller must hold the write lock.
+func (s *mvccStore) prune() {
+	oldest := s.clock
+	for _, tx := range s.txs {
+		if !tx.readCommitted && tx.snapshot < oldest {
+			oldest = tx.snapshot
+		}
+	}
+
+	for k, chain := range s.versions {
+		i := len(chain) - 1
+		for i > 0 && chain[i].commitTS > oldest {
+			i--
+		}
+
+		// Once every snapshot sees the newest version, the inner store has all that is needed.
+		if i == len(chain)-1 {
+			delete(s.versions, k)
+			continue
+		}
+		s.versions[k] = chain[i:]
+	}
+}
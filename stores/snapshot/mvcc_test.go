@@ -0,0 +1,178 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/christianalexander/kvdb/stores"
+)
+
+func txContext(txID int64, level stores.IsolationLevel) context.Context {
+	ctx := context.WithValue(context.Background(), stores.ContextKeyTransactionID, txID)
+	if level != "" {
+		ctx = context.WithValue(ctx, stores.ContextKeyIsolationLevel, level)
+	}
+
+	return ctx
+}
+
+// newStore returns a snapshot store holding x=1, committed by transaction 1.
+func newStore(t *testing.T) stores.TransactionalStore {
+	t.Helper()
+
+	s := NewStore(stores.NewInMemoryStore()).(stores.TransactionalStore)
+	ctx := txContext(1, "")
+	if err := s.Set(ctx, "x", "1"); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := s.Commit(ctx); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	s.Release(ctx)
+
+	return s
+}
+
+// update commits x=value in a transaction of its own.
+func update(t *testing.T, s stores.TransactionalStore, txID int64, value string) {
+	t.Helper()
+
+	ctx := txContext(txID, "")
+	if err := s.Begin(ctx); err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	if err := s.Set(ctx, "x", value); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := s.Commit(ctx); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	s.Release(ctx)
+}
+
+func TestReadCommittedSeesLatestCommit(t *testing.T) {
+	for _, tc := range []struct {
+		level stores.IsolationLevel
+		want  string
+	}{
+		{stores.IsolationReadCommitted, "2"},
+		{stores.IsolationRepeatableRead, "1"},
+		{"", "1"},
+	} {
+		s := newStore(t)
+		ctx := txContext(2, tc.level)
+		if err := s.Begin(ctx); err != nil {
+			t.Fatalf("begin: %v", err)
+		}
+
+		update(t, s, 3, "2")
+
+		v, err := s.Get(ctx, "x")
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if v != tc.want {
+			t.Errorf("read at level '%s' after a commit: got %s, want %s", tc.level, v, tc.want)
+		}
+		s.Release(ctx)
+	}
+}
+
+func TestReadCommittedIsNotCheckedForConflicts(t *testing.T) {
+	for _, tc := range []struct {
+		level    stores.IsolationLevel
+		conflict bool
+	}{
+		{stores.IsolationReadCommitted, false},
+		{stores.IsolationRepeatableRead, true},
+	} {
+		s := newStore(t)
+		ctx := txContext(2, tc.level)
+		if err := s.Begin(ctx); err != nil {
+			t.Fatalf("begin: %v", err)
+		}
+		if err := s.Set(ctx, "x", "3"); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+
+		update(t, s, 3, "2")
+
+		err := s.Commit(ctx)
+		if tc.conflict && !errors.Is(err, ErrWriteConflict) {
+			t.Errorf("commit at level '%s' after a concurrent update: got %v, want %v", tc.level, err, ErrWriteConflict)
+		}
+		if !tc.conflict && err != nil {
+			t.Errorf("commit at level '%s' after a concurrent update: %v", tc.level, err)
+		}
+		s.Release(ctx)
+	}
+}
+
+func TestSerializableIsRefused(t *testing.T) {
+	s := newStore(t)
+	if err := s.Begin(txContext(2, stores.IsolationSerializable)); err == nil {
+		t.Error("began a SERIALIZABLE transaction on snapshot isolation")
+	}
+}
+
+// failingStore fails to set one key.
+type failingStore struct {
+	stores.Store
+	key string
+}
+
+func (s failingStore) Set(ctx context.Context, key, value string) error {
+	if key == s.key {
+		return errors.New("disk full")
+	}
+
+	return s.Store.Set(ctx, key, value)
+}
+
+func TestCommitIsAtomic(t *testing.T) {
+	inner := stores.NewInMemoryStore()
+	s := NewStore(failingStore{inner, "c"}).(stores.TransactionalStore)
+
+	reader := txContext(2, "")
+	if err := s.Begin(reader); err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+
+	// Keys are applied in order, so a and b are written before c fails.
+	ctx := txContext(3, "")
+	if err := s.Begin(ctx); err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if err := s.Set(ctx, k, "1"); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	if err := s.Commit(ctx); err == nil {
+		t.Fatal("commit succeeded, although a write failed")
+	}
+	s.Release(ctx)
+
+	later := txContext(4, "")
+	if err := s.Begin(later); err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	for _, tc := range []struct {
+		name  string
+		store stores.Store
+		ctx   context.Context
+	}{
+		{"inner store", inner, txContext(0, "")},
+		{"open snapshot", s, reader},
+		{"later snapshot", s, later},
+	} {
+		for _, k := range []string{"a", "b", "c"} {
+			if v, err := tc.store.Get(tc.ctx, k); err == nil {
+				t.Errorf("%s: %s=%s after a failed commit", tc.name, k, v)
+			}
+		}
+	}
+	s.Release(reader)
+	s.Release(later)
+}
@@ -1,11 +1,22 @@
 package stores
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 type Store interface {
 	Set(ctx context.Context, key, value string) error
 	Get(ctx context.Context, key string) (string, error)
 	Delete(ctx context.Context, key string) error
 	Keys(ctx context.Context) ([]string, error)
+	// Scan returns the keys in the range [start, end) in ascending order.
+	// An empty end scans to the last key, and a limit of zero or less returns the whole range.
+	Scan(ctx context.Context, start, end string, limit int) (Iterator, error)
+	// Expire sets the time at which an existing key expires. A zero time removes the expiry.
+	// Setting a key's value clears its expiry.
+	Expire(ctx context.Context, key string, at time.Time) error
+	// Expiry returns the time at which a key expires, or a zero time if it never does.
+	Expiry(ctx context.Context, key string) (time.Time, error)
 	Release(ctx context.Context)
 }
@@ -0,0 +1,26 @@
+package stores
+
+import "context"
+
+// A TransactionalStore is a Store that takes part in the transaction lifecycle.
+// Transactors call Begin when a transaction starts and Commit before it is released,
+// which lets a store defer work to commit time or refuse to commit.
+//
+// The writes of a transaction must not reach the stores beneath until Commit, so a
+// transaction that rolls back is only released, rather than having its commands undone.
+type TransactionalStore interface {
+	Store
+	Begin(ctx context.Context) error
+	Commit(ctx context.Context) error
+}
+
+// A SavepointStore is a TransactionalStore that can roll the writes of a transaction back to a savepoint,
+// without ending the transaction.
+type SavepointStore interface {
+	TransactionalStore
+	// Savepoint marks the writes of the transaction in the context so far, returning an ID to roll back to.
+	Savepoint(ctx context.Context) (int, error)
+	// RollbackTo discards the writes made by the transaction in the context since a savepoint,
+	// along with the savepoints after it.
+	RollbackTo(ctx context.Context, savepoint int) error
+}
@@ -7,3 +7,10 @@ import (
 type Writer interface {
 	Write(ctx context.Context, record Record) error
 }
+
+// A DurableWriter is a Writer that can wait for the records written to it to reach stable storage.
+type DurableWriter interface {
+	Writer
+	// Sync returns once every record written before it was called is durable.
+	Sync(ctx context.Context) error
+}
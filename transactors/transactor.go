@@ -2,9 +2,11 @@ package transactors
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/christianalexander/kvdb"
 	"github.com/christianalexander/kvdb/stores"
@@ -14,53 +16,244 @@ import (
 // A Transactor is able to orchestrate transactions.
 type Transactor interface {
 	Execute(ctx context.Context, command kvdb.Command) error
+	// Begin starts a transaction with the default options.
 	Begin(ctx context.Context) (transactionID int64, err error)
+	// BeginTx starts a transaction with options, which apply to every command it executes.
+	BeginTx(ctx context.Context, options TxOptions) (transactionID int64, err error)
 	Commit(ctx context.Context) error
 	Rollback(ctx context.Context) error
+	// Savepoint marks a point in the transaction that it can later be rolled back to by name.
+	Savepoint(ctx context.Context, name string) error
+	// RollbackToSavepoint undoes the commands executed since the latest savepoint with a name, and
+	// forgets the savepoints after it. The transaction stays open, and keeps the locks it holds.
+	RollbackToSavepoint(ctx context.Context, name string) error
+	// ReleaseSavepoint forgets the latest savepoint with a name and the savepoints after it,
+	// keeping the commands executed since.
+	ReleaseSavepoint(ctx context.Context, name string) error
+	// Quiesce waits until no transaction is open, then calls fn with the ID of the latest
+	// transaction while no new transaction is allowed to begin. New transactions can begin while
+	// it waits, so it gives up with the context's error if the transactor is never idle.
+	Quiesce(ctx context.Context, fn func(latestTransactionID int64) error) error
 }
 
+// ErrCommitNotLogged is returned by Commit when a transactional store has applied the writes of a
+// transaction, but its commit record could not be written to the log. The store then holds writes
+// that the log does not commit, and that replaying the log drops, so the caller should stop serving.
+// The transaction is left open, keeping its locks, so that no other transaction acts on its writes.
+var ErrCommitNotLogged = errors.New("writes were applied, but their commit could not be written to the log")
+
 type transactor struct {
 	store               stores.Store
 	mu                  sync.Mutex
 	transactionCommands map[int64][]kvdb.Command
+	savepoints          map[int64][]savepoint
+	txOptions           map[int64]TxOptions
+	// wrote holds the transactions that executed a command that may write, which are logged.
+	wrote               map[int64]bool
 	latestTransactionID int64
 	writer              stores.Writer
+
+	// active holds the open transactions. While quiescing, which is only while a quiesced function
+	// runs, new transactions wait on idle.
+	active    map[int64]struct{}
+	quiescing bool
+	idle      *sync.Cond
+}
+
+// A savepoint is a named point in the command history of a transaction.
+type savepoint struct {
+	name string
+	// commands is the length of the command history when the savepoint was taken.
+	commands int
+	// storeID identifies the savepoint to a stores.SavepointStore.
+	storeID int
+}
+
+// TxOptions configures a transaction.
+type TxOptions struct {
+	// Isolation is the isolation level of the transaction. The store applies its own if it is empty.
+	Isolation stores.IsolationLevel
+	// ReadOnly rejects writes, so that the store can serve reads from a snapshot without taking locks.
+	ReadOnly bool
+}
+
+// Options configures a Transactor.
+type Options struct {
+	// LatestTransactionID is the highest transaction ID already in use, such as in a replayed log.
+	// New transactions are given IDs above it.
+	LatestTransactionID int64
 }
 
 // New creates a new Transactor.
-func New(store stores.Store, writer stores.Writer) Transactor {
-	return &transactor{
+func New(store stores.Store, writer stores.Writer, options Options) Transactor {
+	t := &transactor{
 		store:               store,
 		transactionCommands: make(map[int64][]kvdb.Command),
+		savepoints:          make(map[int64][]savepoint),
+		txOptions:           make(map[int64]TxOptions),
+		wrote:               make(map[int64]bool),
+		latestTransactionID: options.LatestTransactionID,
 		writer:              writer,
+		active:              make(map[int64]struct{}),
 	}
+	t.idle = sync.NewCond(&t.mu)
+
+	return t
 }
 
-func (t *transactor) Execute(ctx context.Context, command kvdb.Command) error {
+func (t *transactor) Execute(ctx context.Context, command kvdb.Command) (err error) {
 	txID, ok := ctx.Value(stores.ContextKeyTransactionID).(int64)
 	if command.ShouldAutoTransact() && (!ok || txID == 0) {
+		txID = t.start()
 		logrus.Printf("Assigned txID %d", txID)
-		txID = atomic.AddInt64(&t.latestTransactionID, 1)
 		ctx = context.WithValue(ctx, stores.ContextKeyTransactionID, txID)
-		defer t.Commit(ctx)
+		if err := t.beginStore(ctx); err != nil {
+			t.finish(txID)
+			return err
+		}
+
+		// A failed statement is rolled back so that it can not leave partial writes behind.
+		defer func() {
+			if err != nil {
+				t.Rollback(ctx)
+				return
+			}
+			err = t.Commit(ctx)
+		}()
 	}
 
-	err := command.Execute(ctx)
+	err = command.Execute(t.withOptions(ctx, txID))
 
 	t.mu.Lock()
 	t.transactionCommands[txID] = append(t.transactionCommands[txID], command)
+	if writes(command) {
+		t.wrote[txID] = true
+	}
 	t.mu.Unlock()
 
 	return err
 }
 
+// writes reports whether a command may write to the store. Commands that are not auto-transacted
+// manage transactions or the connection rather than the data, so they never do.
+func writes(command kvdb.Command) bool {
+	if !command.ShouldAutoTransact() {
+		return false
+	}
+
+	ro, ok := command.(kvdb.ReadOnlyCommand)
+	return !ok || !ro.ReadOnly()
+}
+
 func (t *transactor) Begin(ctx context.Context) (transactionID int64, err error) {
+	return t.BeginTx(ctx, TxOptions{})
+}
+
+func (t *transactor) BeginTx(ctx context.Context, options TxOptions) (transactionID int64, err error) {
 	existingID, ok := ctx.Value(stores.ContextKeyTransactionID).(int64)
 	if ok && existingID != 0 {
 		return 0, fmt.Errorf("can not start a transaction within the existing transaction '%d'", existingID)
 	}
 
-	return atomic.AddInt64(&t.latestTransactionID, 1), nil
+	txID := t.start()
+	t.mu.Lock()
+	t.txOptions[txID] = options
+	t.mu.Unlock()
+
+	err = t.beginStore(t.withOptions(context.WithValue(ctx, stores.ContextKeyTransactionID, txID), txID))
+	if err != nil {
+		t.finish(txID)
+		return 0, err
+	}
+
+	return txID, nil
+}
+
+// start assigns the ID of a new transaction, waiting while the transactor is quiescing.
+func (t *transactor) start() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for t.quiescing {
+		t.idle.Wait()
+	}
+
+	txID := atomic.AddInt64(&t.latestTransactionID, 1)
+	t.active[txID] = struct{}{}
+
+	return txID
+}
+
+// withOptions adds the options of a transaction to a context, for the store to apply.
+func (t *transactor) withOptions(ctx context.Context, txID int64) context.Context {
+	t.mu.Lock()
+	options := t.txOptions[txID]
+	t.mu.Unlock()
+
+	if options.Isolation != "" {
+		ctx = context.WithValue(ctx, stores.ContextKeyIsolationLevel, options.Isolation)
+	}
+	if options.ReadOnly {
+		ctx = context.WithValue(ctx, stores.ContextKeyReadOnly, true)
+	}
+
+	return ctx
+}
+
+// finish marks a transaction as no longer open.
+func (t *transactor) finish(txID int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.active, txID)
+	delete(t.txOptions, txID)
+	t.idle.Broadcast()
+}
+
+func (t *transactor) Quiesce(ctx context.Context, fn func(latestTransactionID int64) error) error {
+	// Waiters are woken when the context is done, so that they can give up.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			t.mu.Lock()
+			t.idle.Broadcast()
+			t.mu.Unlock()
+		case <-stop:
+		}
+	}()
+
+	// New transactions are only held off once none is open, so that a transaction left open by an
+	// idle client can not stall every other one.
+	t.mu.Lock()
+	for (t.quiescing || len(t.active) > 0) && ctx.Err() == nil {
+		t.idle.Wait()
+	}
+	if ctx.Err() != nil {
+		t.mu.Unlock()
+		return ctx.Err()
+	}
+
+	t.quiescing = true
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.quiescing = false
+		t.idle.Broadcast()
+		t.mu.Unlock()
+	}()
+
+	return fn(atomic.LoadInt64(&t.latestTransactionID))
+}
+
+// beginStore tells a transactional store that the transaction in the context has started.
+func (t *transactor) beginStore(ctx context.Context) error {
+	if ts, ok := t.store.(stores.TransactionalStore); ok {
+		return ts.Begin(ctx)
+	}
+
+	return nil
 }
 
 func (t *transactor) Commit(ctx context.Context) error {
@@ -69,20 +262,58 @@ func (t *transactor) Commit(ctx context.Context) error {
 		return fmt.Errorf("can not commit without a transaction")
 	}
 
-	t.store.Release(ctx)
-
 	t.mu.Lock()
-	delete(t.transactionCommands, txID)
+	wrote := t.wrote[txID]
 	t.mu.Unlock()
 
-	if t.writer != nil {
-		t.writer.Write(ctx, stores.Record{
+	ts, transactional := t.store.(stores.TransactionalStore)
+	if transactional {
+		err := ts.Commit(ctx)
+		if err != nil {
+			t.Rollback(ctx)
+			return err
+		}
+	}
+
+	// The commit record is written while the transaction still holds its locks, so that
+	// no other transaction can act on its writes before they are committed in the log.
+	// A transaction that only read has nothing in the log to commit.
+	if t.writer != nil && wrote {
+		err := t.writer.Write(ctx, stores.Record{
 			Kind:          stores.RecordKindCommit,
 			TransactionID: txID,
+			Timestamp:     time.Now(),
 		})
+		if err != nil && transactional {
+			// A transactional store has already applied the writes, and can not undo them.
+			return fmt.Errorf("%w: transaction %d: %v", ErrCommitNotLogged, txID, err)
+		}
+		if err != nil {
+			t.Rollback(ctx)
+			return fmt.Errorf("failed to write commit of transaction %d: %v", txID, err)
+		}
 	}
 
-	return nil
+	var err error
+	if dw, ok := t.writer.(stores.DurableWriter); ok && wrote {
+		// The commit record may already be on disk, so the transaction can not be rolled back.
+		err = dw.Sync(ctx)
+		if err != nil {
+			err = fmt.Errorf("commit of transaction %d may not be durable: %v", txID, err)
+		}
+	}
+
+	t.store.Release(ctx)
+
+	t.mu.Lock()
+	delete(t.transactionCommands, txID)
+	delete(t.savepoints, txID)
+	delete(t.wrote, txID)
+	t.mu.Unlock()
+
+	t.finish(txID)
+
+	return err
 }
 
 func (t *transactor) Rollback(ctx context.Context) error {
@@ -91,20 +322,142 @@ func (t *transactor) Rollback(ctx context.Context) error {
 		return fmt.Errorf("can not rollback without a transaction")
 	}
 
-	commands, ok := t.transactionCommands[txID]
-	if !ok {
-		return fmt.Errorf("can not roll back transaction without command history")
+	// A transaction without command history has nothing to undo, but may still hold resources in the store.
+	// A transactional store holds writes back until commit, so releasing it discards them without undoing anything.
+	// Commands are undone with the options of the transaction, so a read-only one can not write while undoing.
+	t.mu.Lock()
+	commands := t.transactionCommands[txID]
+	wrote := t.wrote[txID]
+	t.mu.Unlock()
+
+	if _, ok := t.store.(stores.TransactionalStore); !ok {
+		for i := len(commands) - 1; i >= 0; i-- {
+			commands[i].Undo(t.withOptions(ctx, txID))
+		}
 	}
 
-	for i := len(commands) - 1; i >= 0; i-- {
-		commands[i].Undo(ctx)
+	// The abort record lets replay drop the transaction's writes as soon as it is read. A missing
+	// abort only leaves the transaction uncommitted, so a failure to write it does not fail the rollback.
+	if t.writer != nil && wrote {
+		err := t.writer.Write(ctx, stores.Record{
+			Kind:          stores.RecordKindAbort,
+			TransactionID: txID,
+			Timestamp:     time.Now(),
+		})
+		if err != nil {
+			logrus.Warnf("Failed to write abort of transaction %d: %v", txID, err)
+		}
 	}
 
 	t.store.Release(ctx)
 
 	t.mu.Lock()
 	delete(t.transactionCommands, txID)
+	delete(t.savepoints, txID)
+	delete(t.wrote, txID)
+	t.mu.Unlock()
+
+	t.finish(txID)
+
+	return nil
+}
+
+func (t *transactor) Savepoint(ctx context.Context, name string) error {
+	txID, ok := ctx.Value(stores.ContextKeyTransactionID).(int64)
+	if !ok || txID == 0 {
+		return fmt.Errorf("can not set a savepoint without a transaction")
+	}
+
+	sp := savepoint{name: name}
+	if ss, ok := t.store.(stores.SavepointStore); ok {
+		id, err := ss.Savepoint(ctx)
+		if err != nil {
+			return err
+		}
+		sp.storeID = id
+	} else if _, ok := t.store.(stores.TransactionalStore); ok {
+		return fmt.Errorf("the store does not support savepoints")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sp.commands = len(t.transactionCommands[txID])
+	t.savepoints[txID] = append(t.savepoints[txID], sp)
+
+	return nil
+}
+
+// findSavepoint returns the index of the latest savepoint of a transaction with a name. The caller must hold the lock.
+func (t *transactor) findSavepoint(txID int64, name string) (int, error) {
+	savepoints := t.savepoints[txID]
+	for i := len(savepoints) - 1; i >= 0; i-- {
+		if savepoints[i].name == name {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("savepoint '%s' does not exist", name)
+}
+
+func (t *transactor) RollbackToSavepoint(ctx context.Context, name string) error {
+	txID, ok := ctx.Value(stores.ContextKeyTransactionID).(int64)
+	if !ok || txID == 0 {
+		return fmt.Errorf("can not rollback to a savepoint without a transaction")
+	}
+
+	t.mu.Lock()
+	i, err := t.findSavepoint(txID, name)
+	if err != nil {
+		t.mu.Unlock()
+		return err
+	}
+	sp := t.savepoints[txID][i]
+	commands := t.transactionCommands[txID]
+	if sp.commands < len(commands) {
+		commands = commands[sp.commands:]
+	} else {
+		commands = nil
+	}
 	t.mu.Unlock()
 
+	// Without a transactional store, the writes since the savepoint are undone in place. The undo writes
+	// are logged as part of the transaction, so replaying its records in order has the same result.
+	if ss, ok := t.store.(stores.SavepointStore); ok {
+		err := ss.RollbackTo(ctx, sp.storeID)
+		if err != nil {
+			return err
+		}
+	} else {
+		for j := len(commands) - 1; j >= 0; j-- {
+			commands[j].Undo(t.withOptions(ctx, txID))
+		}
+	}
+
+	// The savepoint itself is kept, so that the transaction can roll back to it again.
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.transactionCommands[txID] = t.transactionCommands[txID][:sp.commands]
+	t.savepoints[txID] = t.savepoints[txID][:i+1]
+
+	return nil
+}
+
+func (t *transactor) ReleaseSavepoint(ctx context.Context, name string) error {
+	txID, ok := ctx.Value(stores.ContextKeyTransactionID).(int64)
+	if !ok || txID == 0 {
+		return fmt.Errorf("can not release a savepoint without a transaction")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	i, err := t.findSavepoint(txID, name)
+	if err != nil {
+		return err
+	}
+	t.savepoints[txID] = t.savepoints[txID][:i]
+
 	return nil
 }
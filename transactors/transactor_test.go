@@ -0,0 +1,142 @@
+package transactors_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/christianalexander/kvdb"
+	"github.com/christianalexander/kvdb/commands"
+	"github.com/christianalexander/kvdb/stores"
+	"github.com/christianalexander/kvdb/stores/deferred"
+	"github.com/christianalexander/kvdb/transactors"
+)
+
+// recordingWriter keeps the records written to it, and counts syncs. It fails every write once err is set.
+type recordingWriter struct {
+	records []stores.Record
+	syncs   int
+	err     error
+}
+
+func (w *recordingWriter) Write(ctx context.Context, record stores.Record) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.records = append(w.records, record)
+	return nil
+}
+
+func (w *recordingWriter) Sync(ctx context.Context) error {
+	w.syncs++
+	return nil
+}
+
+func TestReadsAreNotLogged(t *testing.T) {
+	w := &recordingWriter{}
+	store := stores.NewInMemoryStore()
+	tr := transactors.New(store, w, transactors.Options{})
+	ctx := context.Background()
+
+	for _, cmd := range []kvdb.Command{
+		commands.NewGet(ioutil.Discard, store, "k"),
+		commands.NewTTL(ioutil.Discard, store, "k"),
+	} {
+		if err := tr.Execute(ctx, cmd); err != nil {
+			t.Fatalf("execute: %v", err)
+		}
+	}
+
+	txID, err := tr.Begin(ctx)
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	txCtx := context.WithValue(ctx, stores.ContextKeyTransactionID, txID)
+	if err := tr.Execute(txCtx, commands.NewGet(ioutil.Discard, store, "k")); err != nil {
+		t.Fatalf("execute: %v", err)
+	}
+	if err := tr.Commit(txCtx); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	if len(w.records) != 0 || w.syncs != 0 {
+		t.Fatalf("reads wrote %v and synced %d times", w.records, w.syncs)
+	}
+
+	if err := tr.Execute(ctx, commands.NewSet(ioutil.Discard, store, "k", "v")); err != nil {
+		t.Fatalf("execute: %v", err)
+	}
+	if len(w.records) != 1 || w.records[0].Kind != stores.RecordKindCommit || w.syncs != 1 {
+		t.Errorf("a write wrote %v and synced %d times, want one commit and one sync", w.records, w.syncs)
+	}
+}
+
+func TestCommitNotLogged(t *testing.T) {
+	w := &recordingWriter{err: errors.New("disk full")}
+	store := deferred.NewStore(stores.NewInMemoryStore())
+	tr := transactors.New(store, w, transactors.Options{})
+
+	err := tr.Execute(context.Background(), commands.NewSet(ioutil.Discard, store, "k", "v"))
+	if !errors.Is(err, transactors.ErrCommitNotLogged) {
+		t.Errorf("commit of applied writes that could not be logged: got %v, want %v", err, transactors.ErrCommitNotLogged)
+	}
+}
+
+func TestRollbackLogsAbort(t *testing.T) {
+	w := &recordingWriter{}
+	store := stores.WithPersistence(w, stores.NewInMemoryStore())
+	tr := transactors.New(store, w, transactors.Options{})
+	ctx := context.Background()
+
+	rollback := func(cmd kvdb.Command) {
+		t.Helper()
+
+		txID, err := tr.Begin(ctx)
+		if err != nil {
+			t.Fatalf("begin: %v", err)
+		}
+		txCtx := context.WithValue(ctx, stores.ContextKeyTransactionID, txID)
+		if err := tr.Execute(txCtx, cmd); err != nil {
+			t.Fatalf("execute: %v", err)
+		}
+		if err := tr.Rollback(txCtx); err != nil {
+			t.Fatalf("rollback: %v", err)
+		}
+	}
+
+	// The store is not transactional, so the write is undone by another, which the abort follows.
+	rollback(commands.NewSet(ioutil.Discard, store, "k", "v"))
+	n := len(w.records)
+	if n < 2 || w.records[n-1].Kind != stores.RecordKindAbort || w.records[n-1].TransactionID != w.records[0].TransactionID {
+		t.Fatalf("rollback of a write wrote %v, want it to end with an abort", w.records)
+	}
+
+	// A transaction that only read has nothing in the log to abort.
+	rollback(commands.NewGet(ioutil.Discard, store, "k"))
+	if len(w.records) != n {
+		t.Errorf("rollback of a read wrote %v", w.records[n:])
+	}
+
+	// Replay drops the rolled back write, rather than reporting its transaction as in flight.
+	replayed := stores.NewInMemoryStore()
+	result, err := stores.Replay(ctx, sliceReader(w.records), replayed, stores.ReplayOptions{})
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if _, err := replayed.Get(ctx, "k"); err == nil || len(result.InFlight) != 0 {
+		t.Errorf("replay of a rollback: got %v in flight and k %v", result.InFlight, err)
+	}
+}
+
+// sliceReader reads its records, then io.EOF.
+type sliceReader []stores.Record
+
+func (r sliceReader) Read(ctx context.Context, records chan<- stores.Record) error {
+	for _, record := range r {
+		records <- record
+	}
+
+	return io.EOF
+}
@@ -0,0 +1,96 @@
+package wal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/christianalexander/kvdb/stores"
+	"github.com/sirupsen/logrus"
+)
+
+// A Quiescer can hold off transactions, such as a transactors.Transactor.
+type Quiescer interface {
+	Quiesce(ctx context.Context, fn func(latestTransactionID int64) error) error
+}
+
+// Replay loads the latest checkpoint of a log into a store, then replays the segments written since,
+// stopping early if the options say so. A log can not be replayed to a point its checkpoint is past.
+func Replay(ctx context.Context, log Log, store stores.Store, options stores.ReplayOptions) (stores.ReplayResult, error) {
+	var checkpointTransactionID int64
+	if r := log.CheckpointReader(); r != nil {
+		checkpoint, err := stores.FromCheckpoint(ctx, r, store)
+		if err != nil {
+			return stores.ReplayResult{}, err
+		}
+		if options.UntilTransactionID != 0 && checkpoint.TransactionID >= options.UntilTransactionID {
+			return stores.ReplayResult{}, fmt.Errorf("the checkpoint at txID %d already includes transaction %d", checkpoint.TransactionID, options.UntilTransactionID)
+		}
+		if !options.UntilTime.IsZero() && !checkpoint.Timestamp.Before(options.UntilTime) {
+			return stores.ReplayResult{}, fmt.Errorf("the checkpoint written at %s is not before %s", checkpoint.Timestamp.Format(time.RFC3339), options.UntilTime.Format(time.RFC3339))
+		}
+		logrus.Infof("Loaded checkpoint at txID %d", checkpoint.TransactionID)
+		checkpointTransactionID = checkpoint.TransactionID
+	}
+
+	result, err := stores.Replay(ctx, log.Reader(), store, options)
+	if err != nil {
+		return result, err
+	}
+	if checkpointTransactionID > result.LastTransactionID {
+		result.LastTransactionID = checkpointTransactionID
+	}
+	if checkpointTransactionID > result.HighestTransactionID {
+		result.HighestTransactionID = checkpointTransactionID
+	}
+	if options.UntilTransactionID != 0 && result.StoppedAt == nil {
+		return result, fmt.Errorf("transaction %d is not committed in the log", options.UntilTransactionID)
+	}
+
+	return result, nil
+}
+
+// Restore replays a log up to a point in time, then checkpoints the restored state into a log.
+// Restoring into the log that was replayed discards everything after that point.
+func Restore(ctx context.Context, from Log, to Log, store stores.Store, options stores.ReplayOptions) (stores.ReplayResult, error) {
+	result, err := Replay(ctx, from, store, options)
+	if err != nil {
+		return result, err
+	}
+
+	err = to.Checkpoint(func(w io.Writer) error {
+		return stores.WriteCheckpoint(ctx, store, to.Format().NewWriter(w), result.LastTransactionID)
+	})
+
+	return result, err
+}
+
+// RunCheckpoints periodically checkpoints a store into a log until the context is done.
+// Transactions are quiesced while a checkpoint is written, so it only holds committed state.
+// A checkpoint waits at most one interval for a moment when no transaction is open, and is
+// otherwise skipped until the next.
+func RunCheckpoints(ctx context.Context, log Log, quiescer Quiescer, store stores.Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			wctx, cancel := context.WithTimeout(ctx, interval)
+			err := quiescer.Quiesce(wctx, func(latestTransactionID int64) error {
+				return log.Checkpoint(func(w io.Writer) error {
+					return stores.WriteCheckpoint(ctx, store, log.Format().NewWriter(w), latestTransactionID)
+				})
+			})
+			cancel()
+			if err == context.DeadlineExceeded {
+				logrus.Warnf("Skipped a checkpoint, as transactions stayed open for %v", interval)
+			} else if err != nil && err != context.Canceled {
+				logrus.Errorf("Failed to write checkpoint: %v", err)
+			}
+		}
+	}
+}
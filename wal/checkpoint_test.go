@@ -0,0 +1,196 @@
+package wal
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/christianalexander/kvdb/stores"
+)
+
+// pitrLog returns a log of three transactions committed a second apart from base, where the
+// second begins before the first commits and the third writes without a transaction:
+//
+//	base+0s  tx 1 sets a
+//	base+1s  tx 2 sets b
+//	base+2s  tx 1 commits
+//	base+3s  c is set outside a transaction
+//	base+4s  tx 2 commits
+//	base+5s  tx 3 sets d and commits
+func pitrLog(t *testing.T, base time.Time) Log {
+	t.Helper()
+
+	l := open(t, t.TempDir(), Options{})
+	w := l.Format().NewWriter(l)
+	at := func(s int) time.Time { return base.Add(time.Duration(s) * time.Second) }
+	for _, r := range []stores.Record{
+		{Kind: stores.RecordKindSet, Key: "a", Value: "1", TransactionID: 1, Timestamp: at(0)},
+		{Kind: stores.RecordKindSet, Key: "b", Value: "2", TransactionID: 2, Timestamp: at(1)},
+		{Kind: stores.RecordKindCommit, TransactionID: 1, Timestamp: at(2)},
+		{Kind: stores.RecordKindSet, Key: "c", Value: "3", Timestamp: at(3)},
+		{Kind: stores.RecordKindCommit, TransactionID: 2, Timestamp: at(4)},
+		{Kind: stores.RecordKindSet, Key: "d", Value: "4", TransactionID: 3, Timestamp: at(5)},
+		{Kind: stores.RecordKindCommit, TransactionID: 3, Timestamp: at(5)},
+	} {
+		if err := w.Write(context.Background(), r); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	return l
+}
+
+func TestReplayUntil(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := pitrLog(t, base)
+	defer l.Close()
+
+	for name, tc := range map[string]struct {
+		options   stores.ReplayOptions
+		keys      []string
+		stoppedAt *stores.Record
+		inFlight  []int64
+	}{
+		"everything": {keys: []string{"a", "b", "c", "d"}},
+		// The transaction's own writes are left out, as well as those of transactions that commit after it.
+		"before the first commit": {
+			options:   stores.ReplayOptions{UntilTransactionID: 1},
+			stoppedAt: &stores.Record{Kind: stores.RecordKindCommit, TransactionID: 1},
+			inFlight:  []int64{1, 2},
+		},
+		"before an interleaved commit": {
+			options:   stores.ReplayOptions{UntilTransactionID: 2},
+			keys:      []string{"a", "c"},
+			stoppedAt: &stores.Record{Kind: stores.RecordKindCommit, TransactionID: 2},
+			inFlight:  []int64{2},
+		},
+		"before the last commit": {
+			options:   stores.ReplayOptions{UntilTransactionID: 3},
+			keys:      []string{"a", "b", "c"},
+			stoppedAt: &stores.Record{Kind: stores.RecordKindCommit, TransactionID: 3},
+			inFlight:  []int64{3},
+		},
+		// A commit at the time is left out, and one just before it is kept.
+		"at a commit's time": {
+			options:   stores.ReplayOptions{UntilTime: base.Add(2 * time.Second)},
+			stoppedAt: &stores.Record{Kind: stores.RecordKindCommit, TransactionID: 1},
+			inFlight:  []int64{1, 2},
+		},
+		"just after a commit's time": {
+			options:   stores.ReplayOptions{UntilTime: base.Add(2*time.Second + time.Nanosecond)},
+			keys:      []string{"a"},
+			stoppedAt: &stores.Record{Kind: stores.RecordKindSet, Key: "c"},
+			inFlight:  []int64{2},
+		},
+		// Uncommitted writes do not stop the replay, even when they are past the time.
+		"between a write and its commit": {
+			options:   stores.ReplayOptions{UntilTime: base.Add(3*time.Second + time.Nanosecond)},
+			keys:      []string{"a", "c"},
+			stoppedAt: &stores.Record{Kind: stores.RecordKindCommit, TransactionID: 2},
+			inFlight:  []int64{2},
+		},
+		"after the end": {
+			options: stores.ReplayOptions{UntilTime: base.Add(time.Hour)},
+			keys:    []string{"a", "b", "c", "d"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := stores.NewInMemoryStore()
+			result, err := Replay(context.Background(), l, store, tc.options)
+			if err != nil {
+				t.Fatalf("replay: %v", err)
+			}
+
+			keys, _ := store.Keys(context.Background())
+			if !reflect.DeepEqual(keys, tc.keys) {
+				t.Errorf("keys: got %v, want %v", keys, tc.keys)
+			}
+			if !reflect.DeepEqual(result.InFlight, tc.inFlight) {
+				t.Errorf("in flight: got %v, want %v", result.InFlight, tc.inFlight)
+			}
+			switch {
+			case tc.stoppedAt == nil && result.StoppedAt != nil:
+				t.Errorf("stopped at %s, want the whole log", result.StoppedAt)
+			case tc.stoppedAt != nil && result.StoppedAt == nil:
+				t.Errorf("replayed the whole log, want to stop at %s", tc.stoppedAt)
+			case tc.stoppedAt != nil && (result.StoppedAt.Kind != tc.stoppedAt.Kind || result.StoppedAt.TransactionID != tc.stoppedAt.TransactionID || result.StoppedAt.Key != tc.stoppedAt.Key):
+				t.Errorf("stopped at %s, want %s", result.StoppedAt, tc.stoppedAt)
+			}
+		})
+	}
+
+	if _, err := Replay(context.Background(), l, stores.NewInMemoryStore(), stores.ReplayOptions{UntilTransactionID: 4}); err == nil {
+		t.Errorf("replay to a transaction that is not in the log succeeded")
+	}
+}
+
+func TestReplayUntilBeforeCheckpoint(t *testing.T) {
+	base := time.Now().Add(-time.Hour)
+	l := pitrLog(t, base)
+	defer l.Close()
+	ctx := context.Background()
+
+	store := stores.NewInMemoryStore()
+	if _, err := Replay(ctx, l, store, stores.ReplayOptions{}); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	err := l.Checkpoint(func(w io.Writer) error {
+		return stores.WriteCheckpoint(ctx, store, l.Format().NewWriter(w), 3)
+	})
+	if err != nil {
+		t.Fatalf("checkpoint: %v", err)
+	}
+
+	// The segments before the checkpoint are gone, so a point before it can not be restored.
+	for _, options := range []stores.ReplayOptions{
+		{UntilTransactionID: 3},
+		{UntilTime: base.Add(time.Second)},
+	} {
+		if _, err := Replay(ctx, l, stores.NewInMemoryStore(), options); err == nil {
+			t.Errorf("replay to %+v, before the checkpoint, succeeded", options)
+		}
+	}
+}
+
+func TestRestore(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	from := pitrLog(t, base)
+	defer from.Close()
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	to := open(t, dir, Options{})
+	result, err := Restore(ctx, from, to, stores.NewInMemoryStore(), stores.ReplayOptions{UntilTransactionID: 3})
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if result.LastTransactionID != 2 {
+		t.Errorf("last transaction restored: got %d, want 2", result.LastTransactionID)
+	}
+	to.Close()
+
+	// The restored log starts from a checkpoint of the state, and the log restored from is unchanged.
+	to = open(t, dir, Options{})
+	defer to.Close()
+	for name, l := range map[string]Log{"restored": to, "original": from} {
+		store := stores.NewInMemoryStore()
+		if _, err := Replay(ctx, l, store, stores.ReplayOptions{}); err != nil {
+			t.Fatalf("replay %s log: %v", name, err)
+		}
+		keys, _ := store.Keys(ctx)
+		want := []string{"a", "b", "c"}
+		if name == "original" {
+			want = append(want, "d")
+		}
+		if !reflect.DeepEqual(keys, want) {
+			t.Errorf("%s log: got %v, want %v", name, keys, want)
+		}
+	}
+	if r := to.CheckpointReader(); r == nil {
+		t.Errorf("restored log has no checkpoint")
+	} else if keys := readAll(t, to.Reader()); len(keys) != 0 {
+		t.Errorf("restored log has records besides its checkpoint: %v", keys)
+	}
+}
@@ -0,0 +1,81 @@
+package wal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/christianalexander/kvdb/stores"
+)
+
+// Convert copies the log in a directory into a new directory in another format. The copy has
+// the same checkpoint and segments as the original, which is not changed.
+func Convert(from string, to string, format Format) error {
+	if _, err := ParseFormat(string(format)); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(to, manifestName)); err == nil {
+		return fmt.Errorf("'%s' already holds a log", to)
+	}
+
+	l, err := openReadOnly(from)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(to, 0775)
+	if err != nil {
+		return fmt.Errorf("failed to create log directory '%s': %v", to, err)
+	}
+
+	ctx := context.Background()
+	if l.manifest.checkpoint != "" {
+		err := ConvertFile(ctx, l.CheckpointReader(), filepath.Join(to, l.manifest.checkpoint), format)
+		if err != nil {
+			return err
+		}
+	}
+	for i, id := range l.manifest.segments {
+		file := logFile{path: l.path(segmentName(id)), size: -1}
+		if i == len(l.manifest.segments)-1 {
+			file.size = l.readable
+		}
+
+		err := ConvertFile(ctx, fileReader{[]logFile{file}, l.manifest.format}, filepath.Join(to, segmentName(id)), format)
+		if err != nil {
+			return err
+		}
+	}
+
+	m := l.manifest
+	m.format = format
+	return writeManifest(to, m)
+}
+
+// ConvertFile writes every record of a reader to a new file in a format.
+func ConvertFile(ctx context.Context, reader stores.Reader, path string, format Format) error {
+	return writeFileWith(path, func(w io.Writer) error {
+		records := make(chan stores.Record)
+		errs := make(chan error, 1)
+		go func() {
+			errs <- reader.Read(ctx, records)
+			close(records)
+		}()
+
+		// Records are drained after a failed write, so that the reader is not left blocked.
+		writer := format.NewWriter(w)
+		var err error
+		for r := range records {
+			if err == nil {
+				err = writer.Write(ctx, r)
+			}
+		}
+		if rerr := <-errs; rerr != io.EOF && err == nil {
+			err = rerr
+		}
+
+		return err
+	})
+}
@@ -0,0 +1,107 @@
+package wal
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/christianalexander/kvdb/stores"
+)
+
+func TestConvert(t *testing.T) {
+	ctx := context.Background()
+	from := filepath.Join(t.TempDir(), "from")
+	l := open(t, from, Options{MaxSegmentSize: 100})
+	writeSets(t, l, 1, 6)
+	store := stores.NewInMemoryStore()
+	if _, err := Replay(ctx, l, store, stores.ReplayOptions{}); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	err := l.Checkpoint(func(w io.Writer) error {
+		return stores.WriteCheckpoint(ctx, store, l.Format().NewWriter(w), 5)
+	})
+	if err != nil {
+		t.Fatalf("checkpoint: %v", err)
+	}
+	writeSets(t, l, 6, 12)
+	l.Close()
+
+	// Converting there and back keeps the checkpoint, the segments and every record in them.
+	json := filepath.Join(t.TempDir(), "json")
+	if err := Convert(from, json, FormatJSON); err != nil {
+		t.Fatalf("convert to json: %v", err)
+	}
+	back := filepath.Join(t.TempDir(), "back")
+	if err := Convert(json, back, FormatProtobuf); err != nil {
+		t.Fatalf("convert back to protobuf: %v", err)
+	}
+
+	want, _ := loadManifest(from)
+	for dir, format := range map[string]Format{from: FormatProtobuf, json: FormatJSON, back: FormatProtobuf} {
+		m, err := loadManifest(dir)
+		if err != nil {
+			t.Fatalf("load manifest of %s: %v", dir, err)
+		}
+		if m.format != format || m.checkpoint != want.checkpoint || !reflect.DeepEqual(m.segments, want.segments) {
+			t.Errorf("manifest of %s: got %+v, want %+v in %s", dir, m, want, format)
+		}
+
+		l := open(t, dir, Options{ReadOnly: true})
+		replayed := stores.NewInMemoryStore()
+		result, err := Replay(ctx, l, replayed, stores.ReplayOptions{})
+		l.Close()
+		if err != nil {
+			t.Fatalf("replay %s: %v", dir, err)
+		}
+		if keys, _ := replayed.Keys(ctx); len(keys) != 11 || result.LastTransactionID != 11 {
+			t.Errorf("replay %s: got %d keys up to txID %d, want 11 up to 11", dir, len(keys), result.LastTransactionID)
+		}
+	}
+
+	if err := Convert(from, json, FormatJSON); err == nil {
+		t.Errorf("converting into a directory that holds a log succeeded")
+	}
+	if err := Convert(from, filepath.Join(t.TempDir(), "x"), Format("xml")); err == nil {
+		t.Errorf("converting to an unknown format succeeded")
+	}
+}
+
+func TestOpenInAnotherFormat(t *testing.T) {
+	dir := t.TempDir()
+	l := open(t, dir, Options{Format: FormatJSON})
+	writeSets(t, l, 1, 3)
+	l.Close()
+
+	// A log is never appended to in a format other than the one it was written in.
+	if _, err := Open(dir, Options{Format: FormatProtobuf}); err == nil {
+		t.Fatal("opened a json log as protobuf")
+	}
+
+	l = open(t, dir, Options{})
+	defer l.Close()
+	if l.Format() != FormatJSON {
+		t.Errorf("format of a reopened log: got %s, want %s", l.Format(), FormatJSON)
+	}
+	if keys := readAll(t, l.Reader()); !reflect.DeepEqual(keys, keyRange(1, 3)) {
+		t.Errorf("records: got %v", keys)
+	}
+}
+
+func TestConvertFile(t *testing.T) {
+	ctx := context.Background()
+	l := open(t, t.TempDir(), Options{})
+	defer l.Close()
+	writeSets(t, l, 1, 4)
+
+	path := filepath.Join(t.TempDir(), "log.jsonl")
+	if err := ConvertFile(ctx, l.Reader(), path, FormatJSON); err != nil {
+		t.Fatalf("convert file: %v", err)
+	}
+
+	f := fileReader{[]logFile{{path: path, size: -1}}, FormatJSON}
+	if keys := readAll(t, f); !reflect.DeepEqual(keys, keyRange(1, 4)) {
+		t.Errorf("records of the converted file: got %v", keys)
+	}
+}
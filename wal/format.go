@@ -0,0 +1,58 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/christianalexander/kvdb/jsonl"
+	"github.com/christianalexander/kvdb/protobuf"
+	"github.com/christianalexander/kvdb/stores"
+)
+
+// A Format is how the records of a log are encoded. Every file of a log has the same format,
+// which is recorded in its manifest.
+type Format string
+
+const (
+	// FormatProtobuf frames each record as a checksummed protobuf message.
+	FormatProtobuf Format = "protobuf"
+	// FormatJSON writes each record as a line of JSON, which is easier to read but larger.
+	FormatJSON Format = "json"
+)
+
+// ParseFormat parses the name of a format.
+func ParseFormat(name string) (Format, error) {
+	switch f := Format(name); f {
+	case FormatProtobuf, FormatJSON:
+		return f, nil
+	}
+
+	return "", fmt.Errorf("unknown log format '%s': expected '%s' or '%s'", name, FormatProtobuf, FormatJSON)
+}
+
+// NewWriter creates a writer of records in the format.
+func (f Format) NewWriter(w io.Writer) stores.Writer {
+	if f == FormatJSON {
+		return jsonl.NewWriter(w)
+	}
+
+	return protobuf.NewWriter(w)
+}
+
+// NewReader creates a reader of records in the format.
+func (f Format) NewReader(r io.Reader) stores.Reader {
+	if f == FormatJSON {
+		return jsonl.NewReader(r)
+	}
+
+	return protobuf.NewReader(r)
+}
+
+// Verify reads every record of a file in the format, returning the first corruption, if any.
+func (f Format) Verify(r io.ReaderAt, size int64) (records int, corruption *stores.Corruption, err error) {
+	if f == FormatJSON {
+		return jsonl.Verify(r, size)
+	}
+
+	return protobuf.Verify(r, size)
+}
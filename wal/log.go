@@ -0,0 +1,499 @@
+package wal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/christianalexander/kvdb/stores"
+	"github.com/sirupsen/logrus"
+)
+
+// Options configures a segmented log.
+type Options struct {
+	// MaxSegmentSize is the size in bytes at which a segment is closed and a new one started.
+	MaxSegmentSize int64
+	// MaxSegmentAge is how long a segment is written to before a new one is started. Zero disables rotation by age.
+	MaxSegmentAge time.Duration
+	// Repair truncates the log at corruption found before its end, rather than refusing to open it.
+	Repair bool
+	// ReadOnly opens an existing log only to read it. Nothing in the directory is changed, and a
+	// torn write at the end of the newest segment is skipped rather than truncated.
+	ReadOnly bool
+	// Format is the format of a new log, which defaults to protobuf. An existing log must already
+	// be in the format, if one is given. A read-only log is read in the format it was written in.
+	Format Format
+}
+
+const defaultMaxSegmentSize = 64 << 20
+
+var errReadOnly = errors.New("log is read-only")
+
+// A Log is a directory of numbered segment files, written in order. A manifest lists the segments,
+// and the latest checkpoint, which replaces the segments written before it.
+//
+// The log is written a record at a time through its io.Writer, so it is wrapped by a writer of its format.
+type Log interface {
+	io.Writer
+	Syncer
+	io.Closer
+	// Format is the format the records of the log are written in.
+	Format() Format
+	// Reader reads the records of every segment, oldest first.
+	Reader() stores.Reader
+	// CheckpointReader reads the latest checkpoint. It returns nil if there is none.
+	CheckpointReader() stores.Reader
+	// Checkpoint starts a new segment, then calls write to write a checkpoint of the state of the
+	// store as of the segments before it. Once the checkpoint is complete, those segments are deleted.
+	// Nothing may be written to the log while write runs.
+	Checkpoint(write func(w io.Writer) error) error
+}
+
+type segmentedLog struct {
+	dir     string
+	options Options
+
+	mu       sync.Mutex
+	manifest manifest
+	active   *os.File
+	size     int64
+	started  time.Time
+
+	// readable limits how much of the newest segment of a read-only log is read, when it has a torn tail.
+	readable int64
+}
+
+// Open opens or creates a log in a directory. A torn write at the end of the newest segment is truncated.
+func Open(dir string, options Options) (Log, error) {
+	if options.MaxSegmentSize <= 0 {
+		options.MaxSegmentSize = defaultMaxSegmentSize
+	}
+
+	if options.ReadOnly {
+		l, err := openReadOnly(dir)
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+	if options.Format != "" {
+		if _, err := ParseFormat(string(options.Format)); err != nil {
+			return nil, err
+		}
+	}
+
+	err := os.MkdirAll(dir, 0775)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create log directory '%s': %v", dir, err)
+	}
+
+	m, err := loadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.segments) == 0 {
+		if options.Format != "" {
+			m.format = options.Format
+		}
+		m.segments = []uint64{0}
+		err = writeManifest(dir, m)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if options.Format != "" && options.Format != m.format {
+		return nil, fmt.Errorf("log in '%s' is in %s format, not %s", dir, m.format, options.Format)
+	}
+	removeUnlistedFiles(dir, m)
+
+	l := &segmentedLog{dir: dir, options: options, manifest: m, readable: -1}
+
+	err = l.recover()
+	if err != nil {
+		return nil, err
+	}
+
+	last := l.manifest.segments[len(l.manifest.segments)-1]
+	l.active, l.size, err = openSegment(dir, last)
+	if err != nil {
+		return nil, err
+	}
+	l.started = time.Now()
+
+	logrus.Infof("Opened log in '%s' with %d segments", dir, len(l.manifest.segments))
+
+	return l, nil
+}
+
+func (l *segmentedLog) path(name string) string {
+	return filepath.Join(l.dir, name)
+}
+
+func openSegment(dir string, id uint64) (*os.File, int64, error) {
+	f, err := os.OpenFile(filepath.Join(dir, segmentName(id)), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0664)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open segment %d: %v", id, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("failed to stat segment %d: %v", id, err)
+	}
+
+	return f, info.Size(), nil
+}
+
+// recover validates every segment. Older segments were synced before the next one was started,
+// so only the newest can have a torn tail; corruption anywhere else requires a repair, which
+// truncates the log at the corruption and drops the segments after it.
+func (l *segmentedLog) recover() error {
+	for i, id := range l.manifest.segments {
+		f, _, err := openSegment(l.dir, id)
+		if err != nil {
+			return err
+		}
+
+		newest := i == len(l.manifest.segments)-1
+		corruption, err := recoverSegment(f, l.manifest.format, newest, l.options.Repair)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to recover segment %d: %v", id, err)
+		}
+		if corruption == nil {
+			continue
+		}
+
+		logrus.Warnf("Truncated segment %d at the %v", id, corruption)
+		if !newest {
+			dropped := l.manifest.segments[i+1:]
+			l.manifest.segments = l.manifest.segments[:i+1]
+			err = writeManifest(l.dir, l.manifest)
+			if err != nil {
+				return err
+			}
+			for _, d := range dropped {
+				logrus.Warnf("Removing segment %d, which follows the corruption", d)
+				os.Remove(l.path(segmentName(d)))
+			}
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// openReadOnly opens a log to read it, verifying every segment without changing anything.
+func openReadOnly(dir string) (*segmentedLog, error) {
+	m, err := loadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.segments) == 0 {
+		return nil, fmt.Errorf("there is no log in '%s'", dir)
+	}
+
+	l := &segmentedLog{dir: dir, options: Options{ReadOnly: true}, manifest: m, readable: -1}
+	for i, id := range m.segments {
+		f, err := os.Open(l.path(segmentName(id)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open segment %d: %v", id, err)
+		}
+
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to stat segment %d: %v", id, err)
+		}
+
+		_, corruption, err := m.format.Verify(f, info.Size())
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify segment %d: %v", id, err)
+		}
+		if corruption == nil {
+			continue
+		}
+		if !corruption.Torn() || i != len(m.segments)-1 {
+			return nil, fmt.Errorf("segment %d has a %v", id, corruption)
+		}
+
+		logrus.Warnf("Skipping the %v in segment %d", corruption, id)
+		l.readable = corruption.Offset
+	}
+
+	return l, nil
+}
+
+// recoverSegment truncates a segment at its first corruption. Only the newest segment may have
+// a torn tail truncated without a repair.
+func recoverSegment(f *os.File, format Format, newest, repair bool) (*stores.Corruption, error) {
+	if newest || repair {
+		return stores.RecoverLog(f, format.Verify, repair)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	_, corruption, err := format.Verify(f, info.Size())
+	if err == nil && corruption != nil {
+		err = corruption
+	}
+
+	return nil, err
+}
+
+// Write appends a frame to the active segment, starting a new segment first once the active one is full or old.
+func (l *segmentedLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.options.ReadOnly {
+		return 0, errReadOnly
+	}
+
+	full := l.size >= l.options.MaxSegmentSize
+	old := l.options.MaxSegmentAge > 0 && time.Since(l.started) >= l.options.MaxSegmentAge
+	if l.size > 0 && (full || old) {
+		err := l.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := l.active.Write(p)
+	l.size += int64(n)
+
+	return n, err
+}
+
+// rotate syncs and closes the active segment and starts the next one. The caller must hold the lock.
+func (l *segmentedLog) rotate() error {
+	last := l.manifest.segments[len(l.manifest.segments)-1]
+	next, size, err := openSegment(l.dir, last+1)
+	if err != nil {
+		return err
+	}
+
+	m := l.manifest
+	m.segments = append(append([]uint64(nil), m.segments...), last+1)
+	err = writeManifest(l.dir, m)
+	if err != nil {
+		next.Close()
+		os.Remove(l.path(segmentName(last + 1)))
+		return err
+	}
+
+	err = l.active.Sync()
+	l.active.Close()
+	if err != nil {
+		// The manifest already lists the new segment, so the log must move on to it.
+		logrus.Errorf("Failed to sync segment %d: %v", last, err)
+	}
+
+	l.manifest = m
+	l.active = next
+	l.size = size
+	l.started = time.Now()
+
+	logrus.Debugf("Started log segment %d", last+1)
+	return nil
+}
+
+// Sync syncs the active segment. Segments are synced when they are rotated, so a segment
+// closed while syncing is already durable.
+func (l *segmentedLog) Sync() error {
+	l.mu.Lock()
+	f := l.active
+	l.mu.Unlock()
+	if f == nil {
+		return nil
+	}
+
+	err := f.Sync()
+	if errors.Is(err, os.ErrClosed) {
+		l.mu.Lock()
+		rotated := l.active != f
+		l.mu.Unlock()
+		if rotated {
+			return nil
+		}
+	}
+
+	return err
+}
+
+func (l *segmentedLog) Format() Format {
+	return l.manifest.format
+}
+
+func (l *segmentedLog) Reader() stores.Reader {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	files := make([]logFile, 0, len(l.manifest.segments))
+	for _, id := range l.manifest.segments {
+		files = append(files, logFile{path: l.path(segmentName(id)), size: -1})
+	}
+	files[len(files)-1].size = l.readable
+
+	return fileReader{files, l.manifest.format}
+}
+
+func (l *segmentedLog) CheckpointReader() stores.Reader {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.manifest.checkpoint == "" {
+		return nil
+	}
+
+	return fileReader{[]logFile{{path: l.path(l.manifest.checkpoint), size: -1}}, l.manifest.format}
+}
+
+func (l *segmentedLog) Checkpoint(write func(w io.Writer) error) error {
+	l.mu.Lock()
+	if l.options.ReadOnly {
+		l.mu.Unlock()
+		return errReadOnly
+	}
+	if l.size == 0 && l.manifest.checkpoint == checkpointName(l.manifest.segments[len(l.manifest.segments)-1]) {
+		// Nothing has been written since the latest checkpoint.
+		l.mu.Unlock()
+		return nil
+	}
+	if l.size > 0 {
+		if err := l.rotate(); err != nil {
+			l.mu.Unlock()
+			return err
+		}
+	}
+	boundary := l.manifest.segments[len(l.manifest.segments)-1]
+	l.mu.Unlock()
+
+	name := checkpointName(boundary)
+	tmp := l.path(name + tmpSuffix)
+	err := writeFileWith(tmp, write)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, l.path(name))
+	if err != nil {
+		return fmt.Errorf("failed to replace checkpoint '%s': %v", name, err)
+	}
+
+	l.mu.Lock()
+	previous := l.manifest
+	m := manifest{format: previous.format, checkpoint: name}
+	for _, id := range previous.segments {
+		if id >= boundary {
+			m.segments = append(m.segments, id)
+		}
+	}
+	err = writeManifest(l.dir, m)
+	if err == nil {
+		l.manifest = m
+	}
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// The manifest no longer lists these files, so a crash before they are deleted only leaves them to be removed on open.
+	if previous.checkpoint != "" && previous.checkpoint != name {
+		os.Remove(l.path(previous.checkpoint))
+	}
+	removed := 0
+	for _, id := range previous.segments {
+		if id < boundary {
+			os.Remove(l.path(segmentName(id)))
+			removed++
+		}
+	}
+
+	logrus.Infof("Checkpoint '%s' replaced %d segments", name, removed)
+	return nil
+}
+
+// writeFileWith creates a file, calls write to write to it through a buffer, then syncs it.
+func writeFileWith(path string, write func(w io.Writer) error) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
+	if err != nil {
+		return fmt.Errorf("failed to create '%s': %v", path, err)
+	}
+
+	bw := bufio.NewWriter(f)
+	err = write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// Close syncs and closes the active segment.
+func (l *segmentedLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active == nil {
+		return nil
+	}
+
+	err := l.active.Sync()
+	if cerr := l.active.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// A logFile is a file to read records from, and how many bytes of it to read, or -1 to read all of it.
+type logFile struct {
+	path string
+	size int64
+}
+
+// fileReader reads the records of a sequence of files.
+type fileReader struct {
+	files  []logFile
+	format Format
+}
+
+func (r fileReader) Read(ctx context.Context, records chan<- stores.Record) error {
+	for _, file := range r.files {
+		f, err := os.Open(file.path)
+		if err != nil {
+			return fmt.Errorf("failed to open '%s': %v", file.path, err)
+		}
+
+		var in io.Reader = f
+		if file.size >= 0 {
+			in = io.LimitReader(f, file.size)
+		}
+
+		err = r.format.NewReader(in).Read(ctx, records)
+		f.Close()
+		if err != io.EOF {
+			return err
+		}
+	}
+
+	return io.EOF
+}
@@ -0,0 +1,263 @@
+package wal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/christianalexander/kvdb/stores"
+)
+
+func open(t *testing.T, dir string, options Options) Log {
+	t.Helper()
+
+	l, err := Open(dir, options)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	return l
+}
+
+// writeSets writes a committed set of key-<i> to i for each i in [from, to), one transaction each.
+func writeSets(t *testing.T, l Log, from, to int) {
+	t.Helper()
+
+	w := l.Format().NewWriter(l)
+	for i := from; i < to; i++ {
+		txID := int64(i)
+		err := w.Write(context.Background(), stores.Record{Kind: stores.RecordKindSet, Key: fmt.Sprintf("key-%d", i), Value: fmt.Sprint(i), TransactionID: txID})
+		if err == nil {
+			err = w.Write(context.Background(), stores.Record{Kind: stores.RecordKindCommit, TransactionID: txID})
+		}
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+}
+
+// readAll returns the keys of the set records a reader reads, in order.
+func readAll(t *testing.T, r stores.Reader) []string {
+	t.Helper()
+
+	records := make(chan stores.Record)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- r.Read(context.Background(), records)
+		close(records)
+	}()
+
+	var keys []string
+	for r := range records {
+		if r.Kind == stores.RecordKindSet {
+			keys = append(keys, r.Key)
+		}
+	}
+	if err := <-errs; err != io.EOF {
+		t.Fatalf("read: %v", err)
+	}
+
+	return keys
+}
+
+func keyRange(from, to int) []string {
+	var keys []string
+	for i := from; i < to; i++ {
+		keys = append(keys, fmt.Sprintf("key-%d", i))
+	}
+
+	return keys
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		t.Fatalf("list segments: %v", err)
+	}
+	for i, f := range files {
+		files[i] = filepath.Base(f)
+	}
+
+	return files
+}
+
+func TestRotation(t *testing.T) {
+	dir := t.TempDir()
+	l := open(t, dir, Options{MaxSegmentSize: 100})
+	writeSets(t, l, 1, 20)
+	l.Close()
+
+	m, err := loadManifest(dir)
+	if err != nil {
+		t.Fatalf("load manifest: %v", err)
+	}
+	if len(m.segments) < 3 {
+		t.Fatalf("got %d segments, want the writes to span several", len(m.segments))
+	}
+	var listed []string
+	for i, id := range m.segments {
+		if id != uint64(i) {
+			t.Errorf("manifest lists segment %d in position %d", id, i)
+		}
+		listed = append(listed, segmentName(id))
+	}
+	if files := segmentFiles(t, dir); !reflect.DeepEqual(files, listed) {
+		t.Errorf("segment files: got %v, want those listed, %v", files, listed)
+	}
+
+	// Reopening carries on writing to the newest segment, and reads every segment in order.
+	l = open(t, dir, Options{MaxSegmentSize: 100})
+	defer l.Close()
+	writeSets(t, l, 20, 25)
+	if keys := readAll(t, l.Reader()); !reflect.DeepEqual(keys, keyRange(1, 25)) {
+		t.Errorf("records after reopening: got %v", keys)
+	}
+}
+
+func TestReopenRemovesUnlistedSegments(t *testing.T) {
+	dir := t.TempDir()
+	l := open(t, dir, Options{})
+	writeSets(t, l, 1, 3)
+	l.Close()
+
+	// A rotation that stopped before the manifest listed its new segment leaves the segment behind.
+	if err := ioutil.WriteFile(filepath.Join(dir, segmentName(1)), []byte("partial"), 0664); err != nil {
+		t.Fatalf("write segment: %v", err)
+	}
+
+	l = open(t, dir, Options{})
+	defer l.Close()
+	if files := segmentFiles(t, dir); !reflect.DeepEqual(files, []string{segmentName(0)}) {
+		t.Errorf("segment files: got %v, want only the listed one", files)
+	}
+	if keys := readAll(t, l.Reader()); !reflect.DeepEqual(keys, keyRange(1, 3)) {
+		t.Errorf("records: got %v", keys)
+	}
+}
+
+func TestCorruptOlderSegment(t *testing.T) {
+	dir := t.TempDir()
+	l := open(t, dir, Options{MaxSegmentSize: 100})
+	writeSets(t, l, 1, 20)
+	l.Close()
+
+	// Older segments were synced before the next was started, so a torn tail in one is corruption.
+	path := filepath.Join(dir, segmentName(1))
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if err := os.Truncate(path, info.Size()-2); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+
+	if _, err := Open(dir, Options{}); err == nil {
+		t.Fatal("opened a log with a corrupt older segment")
+	}
+	if _, err := Open(dir, Options{ReadOnly: true}); err == nil {
+		t.Fatal("opened a log with a corrupt older segment read-only")
+	}
+
+	// A repair truncates the log at the corruption, dropping the segments after it.
+	l = open(t, dir, Options{Repair: true})
+	defer l.Close()
+	if files := segmentFiles(t, dir); !reflect.DeepEqual(files, []string{segmentName(0), segmentName(1)}) {
+		t.Errorf("segment files after a repair: got %v", files)
+	}
+	keys := readAll(t, l.Reader())
+	if len(keys) == 0 || !reflect.DeepEqual(keys, keyRange(1, len(keys)+1)) {
+		t.Errorf("records after a repair: got %v, want a prefix of the keys", keys)
+	}
+}
+
+func TestReadOnlySkipsTornTail(t *testing.T) {
+	dir := t.TempDir()
+	l := open(t, dir, Options{})
+	writeSets(t, l, 1, 4)
+	l.Close()
+
+	path := filepath.Join(dir, segmentName(0))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("open segment: %v", err)
+	}
+	f.Write([]byte{0x30, 0x0a})
+	f.Close()
+	info, _ := os.Stat(path)
+
+	l = open(t, dir, Options{ReadOnly: true})
+	if keys := readAll(t, l.Reader()); !reflect.DeepEqual(keys, keyRange(1, 4)) {
+		t.Errorf("records of a read-only log: got %v", keys)
+	}
+	if _, err := l.Write([]byte("x")); err != errReadOnly {
+		t.Errorf("write to a read-only log: got %v, want %v", err, errReadOnly)
+	}
+	l.Close()
+	if after, _ := os.Stat(path); after.Size() != info.Size() {
+		t.Errorf("read-only open changed the segment from %d to %d bytes", info.Size(), after.Size())
+	}
+
+	// Opened for writing, the torn tail is truncated.
+	l = open(t, dir, Options{})
+	defer l.Close()
+	if after, _ := os.Stat(path); after.Size() != info.Size()-2 {
+		t.Errorf("torn tail was not truncated: %d bytes, want %d", after.Size(), info.Size()-2)
+	}
+}
+
+func TestCheckpointReplacesSegments(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	l := open(t, dir, Options{MaxSegmentSize: 100})
+	writeSets(t, l, 1, 10)
+
+	store := stores.NewInMemoryStore()
+	if _, err := Replay(ctx, l, store, stores.ReplayOptions{}); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	err := l.Checkpoint(func(w io.Writer) error {
+		return stores.WriteCheckpoint(ctx, store, l.Format().NewWriter(w), 9)
+	})
+	if err != nil {
+		t.Fatalf("checkpoint: %v", err)
+	}
+
+	// Only the segment started for the checkpoint is left, and the checkpoint is named after it.
+	m, err := loadManifest(dir)
+	if err != nil {
+		t.Fatalf("load manifest: %v", err)
+	}
+	if len(m.segments) != 1 || m.checkpoint != checkpointName(m.segments[0]) {
+		t.Fatalf("manifest after a checkpoint: %+v", m)
+	}
+	if files := segmentFiles(t, dir); !reflect.DeepEqual(files, []string{segmentName(m.segments[0])}) {
+		t.Errorf("segment files after a checkpoint: got %v", files)
+	}
+
+	writeSets(t, l, 10, 12)
+	l.Close()
+
+	l = open(t, dir, Options{})
+	defer l.Close()
+	replayed := stores.NewInMemoryStore()
+	result, err := Replay(ctx, l, replayed, stores.ReplayOptions{})
+	if err != nil {
+		t.Fatalf("replay after a checkpoint: %v", err)
+	}
+	keys, _ := replayed.Keys(ctx)
+	if len(keys) != 11 || result.LastTransactionID != 11 {
+		t.Errorf("replay after a checkpoint: got %d keys up to txID %d, want 11 up to 11", len(keys), result.LastTransactionID)
+	}
+	for i := 1; i < 12; i++ {
+		if v, err := replayed.Get(ctx, fmt.Sprintf("key-%d", i)); err != nil || v != fmt.Sprint(i) {
+			t.Errorf("key-%d after a checkpoint: got %q, %v", i, v, err)
+		}
+	}
+}
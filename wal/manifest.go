@@ -0,0 +1,181 @@
+package wal
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	manifestName     = "MANIFEST"
+	segmentSuffix    = ".log"
+	checkpointSuffix = ".checkpoint"
+	tmpSuffix        = ".tmp"
+	formatPrefix     = "format "
+)
+
+func segmentName(id uint64) string {
+	return fmt.Sprintf("%020d%s", id, segmentSuffix)
+}
+
+// checkpointName names a checkpoint after the first segment it does not cover.
+func checkpointName(id uint64) string {
+	return fmt.Sprintf("%020d%s", id, checkpointSuffix)
+}
+
+// A manifest lists the format of the log, the latest checkpoint, if any, and the segments written since, oldest first.
+type manifest struct {
+	format     Format
+	checkpoint string
+	segments   []uint64
+}
+
+func loadManifest(dir string) (manifest, error) {
+	m := manifest{format: FormatProtobuf}
+
+	f, err := os.Open(filepath.Join(dir, manifestName))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return m, fmt.Errorf("failed to open manifest: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name := strings.TrimSpace(scanner.Text())
+		switch {
+		case name == "":
+		case strings.HasPrefix(name, formatPrefix):
+			m.format, err = ParseFormat(strings.TrimPrefix(name, formatPrefix))
+			if err != nil {
+				return m, fmt.Errorf("manifest has an invalid format: %v", err)
+			}
+		case strings.HasSuffix(name, checkpointSuffix):
+			m.checkpoint = name
+		case strings.HasSuffix(name, segmentSuffix):
+			id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+			if err != nil {
+				return m, fmt.Errorf("manifest lists invalid segment '%s'", name)
+			}
+			m.segments = append(m.segments, id)
+		default:
+			return m, fmt.Errorf("manifest lists unknown file '%s'", name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return m, fmt.Errorf("failed to read manifest: %v", err)
+	}
+
+	return m, nil
+}
+
+// writeManifest atomically replaces the manifest.
+func writeManifest(dir string, m manifest) error {
+	var b strings.Builder
+	b.WriteString(formatPrefix + string(m.format) + "\n")
+	if m.checkpoint != "" {
+		b.WriteString(m.checkpoint)
+		b.WriteString("\n")
+	}
+	for _, id := range m.segments {
+		b.WriteString(segmentName(id))
+		b.WriteString("\n")
+	}
+
+	tmp := filepath.Join(dir, manifestName+tmpSuffix)
+	err := writeFileSync(tmp, []byte(b.String()))
+	if err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+
+	err = os.Rename(tmp, filepath.Join(dir, manifestName))
+	if err != nil {
+		return fmt.Errorf("failed to replace manifest: %v", err)
+	}
+	syncDir(dir)
+
+	return nil
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+
+	d.Sync()
+}
+
+// removeUnlistedFiles deletes segments and checkpoints left behind by an interrupted rotation or checkpoint.
+func removeUnlistedFiles(dir string, m manifest) {
+	listed := map[string]bool{m.checkpoint: true}
+	for _, id := range m.segments {
+		listed[segmentName(id)] = true
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		if listed[name] || name == manifestName {
+			continue
+		}
+		if !strings.HasSuffix(name, segmentSuffix) && !strings.HasSuffix(name, checkpointSuffix) && !strings.HasSuffix(name, tmpSuffix) {
+			continue
+		}
+
+		logrus.Warnf("Removing '%s', which is not in the log manifest", name)
+		os.Remove(filepath.Join(dir, name))
+	}
+}
+
+// ListFiles returns the format of the log in a directory, and the paths of its files in the order
+// they are replayed: the latest checkpoint, if any, then the segments, oldest first.
+func ListFiles(dir string) ([]string, Format, error) {
+	m, err := loadManifest(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	if m.checkpoint == "" && len(m.segments) == 0 {
+		return nil, "", fmt.Errorf("there is no log in '%s'", dir)
+	}
+
+	var paths []string
+	if m.checkpoint != "" {
+		paths = append(paths, filepath.Join(dir, m.checkpoint))
+	}
+	for _, id := range m.segments {
+		paths = append(paths, filepath.Join(dir, segmentName(id)))
+	}
+
+	return paths, m.format, nil
+}
@@ -0,0 +1,159 @@
+package wal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/christianalexander/kvdb/stores"
+	"github.com/sirupsen/logrus"
+)
+
+// SyncPolicy decides when a log is synced to stable storage.
+type SyncPolicy string
+
+const (
+	// SyncAlways syncs before every commit returns. Concurrent commits share a sync.
+	SyncAlways SyncPolicy = "always"
+	// SyncEverySecond syncs once a second, so a crash loses at most the last second of commits.
+	SyncEverySecond SyncPolicy = "everysec"
+	// SyncNone leaves syncing to the operating system.
+	SyncNone SyncPolicy = "none"
+)
+
+// A Syncer flushes a file to stable storage, such as an *os.File.
+type Syncer interface {
+	Sync() error
+}
+
+// A SyncWriter is a DurableWriter that must be closed to stop syncing in the background.
+type SyncWriter interface {
+	stores.DurableWriter
+	io.Closer
+}
+
+type syncWriter struct {
+	writer stores.Writer
+	file   Syncer
+	policy SyncPolicy
+
+	mu      sync.Mutex
+	synced  *sync.Cond
+	written uint64 // the number of records written
+	durable uint64 // the number of records known to be synced
+	syncing bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewSyncWriter wraps a writer to a file, syncing the file according to a policy.
+//
+// Syncs are shared through group commit: a caller that finds a sync in progress waits for
+// it, and the next sync covers every record written by then, so concurrent committers
+// pay for one sync between them.
+func NewSyncWriter(writer stores.Writer, file Syncer, policy SyncPolicy) (SyncWriter, error) {
+	switch policy {
+	case SyncAlways, SyncEverySecond, SyncNone:
+	default:
+		return nil, fmt.Errorf("unknown sync policy '%s': expected '%s', '%s' or '%s'", policy, SyncAlways, SyncEverySecond, SyncNone)
+	}
+
+	w := &syncWriter{
+		writer: writer,
+		file:   file,
+		policy: policy,
+		done:   make(chan struct{}),
+	}
+	w.synced = sync.NewCond(&w.mu)
+
+	if policy == SyncEverySecond {
+		w.wg.Add(1)
+		go w.run(time.Second)
+	}
+
+	return w, nil
+}
+
+func (w *syncWriter) Write(ctx context.Context, record stores.Record) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.writer.Write(ctx, record)
+	if err != nil {
+		return err
+	}
+	w.written++
+
+	return nil
+}
+
+// Sync waits for the records written so far to be synced if the policy is to always sync.
+// Otherwise, it returns immediately.
+func (w *syncWriter) Sync(ctx context.Context) error {
+	if w.policy != SyncAlways {
+		return nil
+	}
+
+	return w.sync()
+}
+
+// sync returns once every record written before it was called has been synced.
+func (w *syncWriter) sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	target := w.written
+	for w.durable < target {
+		if w.syncing {
+			w.synced.Wait()
+			continue
+		}
+
+		// This sync covers every record written so far, including those of committers queued behind it.
+		w.syncing = true
+		upTo := w.written
+		w.mu.Unlock()
+		err := w.file.Sync()
+		w.mu.Lock()
+		w.syncing = false
+		w.synced.Broadcast()
+		if err != nil {
+			return fmt.Errorf("failed to sync log: %v", err)
+		}
+
+		logrus.Debugf("Synced %d records", upTo-w.durable)
+		w.durable = upTo
+	}
+
+	return nil
+}
+
+// run syncs periodically until the writer is closed.
+func (w *syncWriter) run(interval time.Duration) {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			if err := w.sync(); err != nil {
+				logrus.Errorln(err)
+			}
+		}
+	}
+}
+
+// Close stops syncing in the background, then syncs whatever is left.
+func (w *syncWriter) Close() error {
+	close(w.done)
+	w.wg.Wait()
+
+	return w.sync()
+}
@@ -0,0 +1,177 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/christianalexander/kvdb/stores"
+)
+
+// countingSyncer counts syncs. Each sync waits for gate to be closed, if it is set, then returns err.
+type countingSyncer struct {
+	mu    sync.Mutex
+	syncs int
+	gate  chan struct{}
+	err   error
+}
+
+func (s *countingSyncer) Sync() error {
+	s.mu.Lock()
+	s.syncs++
+	gate, err := s.gate, s.err
+	s.mu.Unlock()
+
+	if gate != nil {
+		<-gate
+	}
+
+	return err
+}
+
+func (s *countingSyncer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.syncs
+}
+
+func newSyncWriter(t *testing.T, file Syncer, policy SyncPolicy) *syncWriter {
+	t.Helper()
+
+	w, err := NewSyncWriter(FormatProtobuf.NewWriter(ioutil.Discard), file, policy)
+	if err != nil {
+		t.Fatalf("new sync writer: %v", err)
+	}
+
+	return w.(*syncWriter)
+}
+
+func commit(w *syncWriter) error {
+	ctx := context.Background()
+	if err := w.Write(ctx, stores.Record{Kind: stores.RecordKindCommit, TransactionID: 1}); err != nil {
+		return err
+	}
+
+	return w.Sync(ctx)
+}
+
+func TestGroupCommit(t *testing.T) {
+	file := &countingSyncer{gate: make(chan struct{})}
+	w := newSyncWriter(t, file, SyncAlways)
+
+	first := make(chan error, 1)
+	go func() { first <- commit(w) }()
+	for file.count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Commits made while the first is syncing wait for it, then share the next sync.
+	const committers = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, committers)
+	for i := 0; i < committers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- commit(w)
+		}()
+	}
+	for {
+		w.mu.Lock()
+		written := w.written
+		w.mu.Unlock()
+		if written == committers+1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(file.gate)
+	if err := <-first; err != nil {
+		t.Fatalf("first commit: %v", err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+	}
+
+	if n := file.count(); n != 2 {
+		t.Errorf("%d commits synced %d times, want twice", committers+1, n)
+	}
+	if w.durable != committers+1 {
+		t.Errorf("%d records are durable, want %d", w.durable, committers+1)
+	}
+
+	// Everything is synced already, so closing has nothing left to sync.
+	if err := w.Close(); err != nil || file.count() != 2 {
+		t.Errorf("close: %v, after %d syncs", err, file.count())
+	}
+}
+
+func TestSyncError(t *testing.T) {
+	file := &countingSyncer{err: errors.New("disk gone")}
+	w := newSyncWriter(t, file, SyncAlways)
+	defer w.Close()
+
+	if err := commit(w); err == nil {
+		t.Fatal("commit succeeded with a failing sync")
+	}
+
+	// The records of the failed sync are not durable, so the next sync retries them.
+	file.mu.Lock()
+	file.err = nil
+	file.mu.Unlock()
+	if err := w.Sync(context.Background()); err != nil || w.durable != 1 || file.count() != 2 {
+		t.Errorf("sync after a failure: %v, with %d records durable after %d syncs", err, w.durable, file.count())
+	}
+}
+
+func TestSyncPolicies(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncEverySecond, SyncNone} {
+		t.Run(string(policy), func(t *testing.T) {
+			file := &countingSyncer{}
+			w := newSyncWriter(t, file, policy)
+
+			// Commits return without waiting for a sync, and closing syncs what they wrote.
+			for i := 0; i < 3; i++ {
+				if err := commit(w); err != nil {
+					t.Fatalf("commit: %v", err)
+				}
+			}
+			if n := file.count(); n != 0 {
+				t.Errorf("commits synced %d times", n)
+			}
+			if err := w.Close(); err != nil || file.count() != 1 {
+				t.Errorf("close: %v, after %d syncs, want 1", err, file.count())
+			}
+		})
+	}
+
+	t.Run("background", func(t *testing.T) {
+		file := &countingSyncer{}
+		w := newSyncWriter(t, file, SyncEverySecond)
+		defer w.Close()
+
+		if err := commit(w); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+		deadline := time.Now().Add(3 * time.Second)
+		for file.count() == 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if file.count() == 0 {
+			t.Errorf("commit was not synced in the background")
+		}
+	})
+
+	if _, err := NewSyncWriter(FormatProtobuf.NewWriter(ioutil.Discard), &countingSyncer{}, SyncPolicy("sometimes")); err == nil {
+		t.Errorf("created a writer with an unknown sync policy")
+	}
+}